@@ -0,0 +1,215 @@
+/*******************************************************************************
+* Copyright (c) 2020 IBM Corporation and others.
+* All rights reserved. This program and the accompanying materials
+* are made available under the terms of the Eclipse Public License v2.0
+* which accompanies this distribution, and is available at
+* http://www.eclipse.org/legal/epl-v20.html
+*
+* Contributors:
+*     IBM Corporation - initial API and implementation
+*******************************************************************************/
+
+package main
+
+import (
+	"codewind/models"
+	"codewind/utils"
+	"errors"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// BatchPolicy determines when, and how, FileChangeEventBatchUtil sends a batch of file changes:
+//   - QuietPeriod: send once no new events have been seen for this long (the timer resets on each event)
+//   - MaxLatency: send once this much time has passed since the first event of the batch, even if events are
+//     still arriving (for example, a process continuously writing to a log file inside the project); this may only
+//     be disabled (set to 0) per project
+//   - MaxBatchSize: send immediately once the batch contains at least this many events; 0 to disable
+//
+// It also determines whether a batch is compacted before it is sent (see compactDirectoryEvents):
+//   - CompactionMinSubtreeSize: collapse a directory subtree into a single recursive directory event once the
+//     subtree contains at least this many CREATEs (or DELETEs); 0 to disable
+//   - CompactionMinBatchSize: only attempt compaction for batches of at least this many events
+//
+// The DeliveryMode determines whether the batch is communicated by running 'cwctl project sync', by sending the
+// change list to the server in HTTP POST requests, or both.
+//
+// The global defaults may be set with the FILEWATCHER_BATCH_QUIET_PERIOD_MS, FILEWATCHER_BATCH_MAX_LATENCY_MS,
+// FILEWATCHER_BATCH_MAX_SIZE, FILEWATCHER_COMPACTION_MIN_SUBTREE_SIZE, FILEWATCHER_COMPACTION_MIN_BATCH_SIZE and
+// FILEWATCHER_DELIVERY_MODE environment variables, and each of these may be overridden per project by the
+// ProjectToWatch.
+type BatchPolicy struct {
+	QuietPeriod  time.Duration
+	MaxLatency   time.Duration
+	MaxBatchSize int
+
+	CompactionMinSubtreeSize int
+	CompactionMinBatchSize   int
+
+	DeliveryMode DeliveryMode
+}
+
+// DeliveryMode is the mechanism by which file changes are communicated to the server.
+type DeliveryMode string
+
+const (
+	// DeliveryModeCwctl runs 'cwctl project sync', which detects and communicates the changes itself
+	DeliveryModeCwctl DeliveryMode = "cwctl"
+
+	// DeliveryModePost sends the list of changes to the server, in chunked HTTP POST requests
+	DeliveryModePost DeliveryMode = "post"
+
+	// DeliveryModeBoth does both of the above
+	DeliveryModeBoth DeliveryMode = "both"
+)
+
+// ParseDeliveryMode converts a (case-insensitive) string to a delivery mode, returning an error if it is not valid.
+func ParseDeliveryMode(str string) (DeliveryMode, error) {
+
+	mode := DeliveryMode(strings.ToLower(strings.TrimSpace(str)))
+
+	if mode != DeliveryModeCwctl && mode != DeliveryModePost && mode != DeliveryModeBoth {
+		return "", errors.New("Invalid delivery mode: " + str)
+	}
+
+	return mode, nil
+}
+
+// UsesCwctl returns true if changes should be communicated by running 'cwctl project sync'.
+func (mode DeliveryMode) UsesCwctl() bool {
+	return mode == DeliveryModeCwctl || mode == DeliveryModeBoth
+}
+
+// UsesPost returns true if changes should be communicated by HTTP POST requests.
+func (mode DeliveryMode) UsesPost() bool {
+	return mode == DeliveryModePost || mode == DeliveryModeBoth
+}
+
+const (
+	// The default maximum time from the first event of a batch until the batch is sent
+	defaultBatchMaxLatencyMsecs = 10000
+)
+
+// NewDefaultBatchPolicy returns the global batch policy, from environment variables if set.
+func NewDefaultBatchPolicy() BatchPolicy {
+
+	result := BatchPolicy{
+		QuietPeriod:  time.Duration(utils.GetEnvInt64("FILEWATCHER_BATCH_QUIET_PERIOD_MS", 1000)) * time.Millisecond,
+		MaxLatency:   time.Duration(utils.GetEnvInt64("FILEWATCHER_BATCH_MAX_LATENCY_MS", defaultBatchMaxLatencyMsecs)) * time.Millisecond,
+		MaxBatchSize: int(utils.GetEnvInt64("FILEWATCHER_BATCH_MAX_SIZE", 0)),
+
+		CompactionMinSubtreeSize: int(utils.GetEnvInt64("FILEWATCHER_COMPACTION_MIN_SUBTREE_SIZE", 0)),
+		CompactionMinBatchSize:   int(utils.GetEnvInt64("FILEWATCHER_COMPACTION_MIN_BATCH_SIZE", 100)),
+
+		DeliveryMode: DeliveryModeCwctl,
+	}
+
+	if value, ok := os.LookupEnv("FILEWATCHER_DELIVERY_MODE"); ok && strings.TrimSpace(value) != "" {
+		mode, err := ParseDeliveryMode(value)
+		if err != nil {
+			utils.LogErrorErr("Ignoring FILEWATCHER_DELIVERY_MODE environment variable", err)
+		} else {
+			result.DeliveryMode = mode
+		}
+	}
+
+	if result.QuietPeriod <= 0 {
+		utils.LogError("Batch quiet period must be greater than 0, so using the default.")
+		result.QuietPeriod = 1000 * time.Millisecond
+	}
+
+	// Otherwise, a file that is continuously written would postpone the batch indefinitely
+	if result.MaxLatency <= 0 {
+		utils.LogError("Batch maximum latency must be greater than 0, so using the default.")
+		result.MaxLatency = defaultBatchMaxLatencyMsecs * time.Millisecond
+	}
+
+	if result.MaxBatchSize < 0 {
+		result.MaxBatchSize = 0
+	}
+
+	if result.CompactionMinSubtreeSize < 0 {
+		result.CompactionMinSubtreeSize = 0
+	}
+
+	return result
+}
+
+// WithProjectOverrides returns a copy of the policy, with any (non-zero, or for the maximum latency, non-nil) batch
+// settings from the project applied.
+func (policy BatchPolicy) WithProjectOverrides(project *models.ProjectToWatch) BatchPolicy {
+
+	result := policy
+
+	if project == nil {
+		return result
+	}
+
+	if project.BatchQuietPeriodMsecs > 0 {
+		result.QuietPeriod = time.Duration(project.BatchQuietPeriodMsecs) * time.Millisecond
+	}
+
+	// Unlike the other settings, a project may set the maximum latency to 0, to disable it
+	if project.BatchMaxLatencyMsecs != nil && *project.BatchMaxLatencyMsecs >= 0 {
+		result.MaxLatency = time.Duration(*project.BatchMaxLatencyMsecs) * time.Millisecond
+	}
+
+	if project.BatchMaxSize > 0 {
+		result.MaxBatchSize = project.BatchMaxSize
+	}
+
+	if project.CompactionMinSubtreeSize > 0 {
+		result.CompactionMinSubtreeSize = project.CompactionMinSubtreeSize
+	}
+
+	if project.CompactionMinBatchSize > 0 {
+		result.CompactionMinBatchSize = project.CompactionMinBatchSize
+	}
+
+	if strings.TrimSpace(project.DeliveryMode) != "" {
+		mode, err := ParseDeliveryMode(project.DeliveryMode)
+		if err != nil {
+			utils.LogErrorErr("Ignoring delivery mode of project "+project.ProjectID, err)
+		} else {
+			result.DeliveryMode = mode
+		}
+	}
+
+	return result
+}
+
+// IsBatchFull returns true if a batch with the given number of events should be sent immediately.
+func (policy BatchPolicy) IsBatchFull(batchSize int) bool {
+	return policy.MaxBatchSize > 0 && batchSize >= policy.MaxBatchSize
+}
+
+// NextFlushDelay returns how long to wait (from 'now') before sending a batch whose first event was received at
+// 'firstEventTime', assuming the most recent event was received at 'now'.
+func (policy BatchPolicy) NextFlushDelay(firstEventTime time.Time, now time.Time) time.Duration {
+
+	delay := policy.QuietPeriod
+
+	if policy.MaxLatency > 0 {
+		remaining := firstEventTime.Add(policy.MaxLatency).Sub(now)
+		if remaining < delay {
+			delay = remaining
+		}
+	}
+
+	if delay < 0 {
+		delay = 0
+	}
+
+	return delay
+}
+
+func (policy BatchPolicy) toDebugString() string {
+	return "quietPeriod: " + strconv.FormatInt(int64(policy.QuietPeriod/time.Millisecond), 10) + "ms" +
+		" maxLatency: " + strconv.FormatInt(int64(policy.MaxLatency/time.Millisecond), 10) + "ms" +
+		" maxBatchSize: " + strconv.Itoa(policy.MaxBatchSize) +
+		" compactionMinSubtreeSize: " + strconv.Itoa(policy.CompactionMinSubtreeSize) +
+		" compactionMinBatchSize: " + strconv.Itoa(policy.CompactionMinBatchSize) +
+		" deliveryMode: " + string(policy.DeliveryMode)
+}
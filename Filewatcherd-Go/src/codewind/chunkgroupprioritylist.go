@@ -1,5 +1,5 @@
 /*******************************************************************************
-* Copyright (c) 2019 IBM Corporation and others.
+* Copyright (c) 2019, 2020 IBM Corporation and others.
 * All rights reserved. This program and the accompanying materials
 * are made available under the terms of the Eclipse Public License v2.0
 * which accompanies this distribution, and is available at
@@ -12,65 +12,191 @@
 package main
 
 import (
+	"container/heap"
 	"sort"
 )
 
-/** ChunkGroupPriorityList maintains a pseudo priority queue of chunk groups, sorted ascending by chunk group timestamp */
+/**
+ * ChunkGroupPriorityList maintains a separate priority queue ('lane') of chunk groups for each project, each sorted
+ * ascending by chunk group timestamp (and then by insertion order, for groups with the same timestamp).
+ *
+ * Chunk groups are only ever ordered relative to other chunk groups of the same project, so a project whose chunks
+ * cannot be sent (for example, because the project has been deleted on the server) does not prevent the chunks of
+ * other projects from being sent. The projects are scheduled round-robin: ProjectsInScheduleOrder() begins with the
+ * project after the one most recently passed to MarkScheduled(...).
+ *
+ * This class is not thread safe; it should only be used by the HTTP POST output queue's work manager goroutine.
+ */
 type ChunkGroupPriorityList struct {
-	list []*PostQueueChunkGroup
+	lanes map[string] /* project id -> */ *chunkGroupHeap
+
+	/** The project IDs of the non-empty lanes, in the order in which they were created */
+	projectOrder []string
+
+	/** The project most recently scheduled, used to begin the next schedule with the project after it */
+	lastScheduledProjectID string
+
+	/** Incremented for each added chunk group, to keep groups with the same timestamp in insertion order */
+	nextSequence uint64
+
+	size int
 }
 
 func NewChunkGroupPriorityList() *ChunkGroupPriorityList {
 
-	list := make([]*PostQueueChunkGroup, 0)
-
 	return &ChunkGroupPriorityList{
-		list,
+		lanes:        make(map[string]*chunkGroupHeap),
+		projectOrder: make([]string, 0),
 	}
 }
 
+/** Returns all of the chunk groups (for debug purposes): the groups of each project are in ascending timestamp order. */
 func (listObj *ChunkGroupPriorityList) GetList() []*PostQueueChunkGroup {
-	return listObj.list
+
+	result := make([]*PostQueueChunkGroup, 0, listObj.size)
+
+	for _, projectID := range listObj.projectOrder {
+
+		entries := make([]*chunkGroupHeapEntry, len(*listObj.lanes[projectID]))
+		copy(entries, *listObj.lanes[projectID])
+
+		sort.Slice(entries, func(i, j int) bool {
+			return entries[i].less(entries[j])
+		})
+
+		for _, entry := range entries {
+			result = append(result, entry.chunkGroup)
+		}
+	}
+
+	return result
 }
 
 func (listObj *ChunkGroupPriorityList) AddToList(newItem *PostQueueChunkGroup) {
-	listObj.list = append(listObj.list, newItem)
-	listObj.sortList()
+
+	lane, exists := listObj.lanes[newItem.projectID]
+	if !exists {
+		lane = &chunkGroupHeap{}
+		listObj.lanes[newItem.projectID] = lane
+		listObj.projectOrder = append(listObj.projectOrder, newItem.projectID)
+	}
+
+	heap.Push(lane, &chunkGroupHeapEntry{newItem, listObj.nextSequence})
+	listObj.nextSequence++
+	listObj.size++
 }
 
-func (listObj *ChunkGroupPriorityList) sortList() {
+/** The total number of chunk groups, across all projects */
+func (listObj *ChunkGroupPriorityList) Len() int {
+	return listObj.size
+}
 
-	if listObj.Len() < 2 {
-		return
+/** Returns the IDs of projects with at least one chunk group, starting with the project that should be scheduled next. */
+func (listObj *ChunkGroupPriorityList) ProjectsInScheduleOrder() []string {
+
+	start := 0
+	for index, projectID := range listObj.projectOrder {
+		if projectID == listObj.lastScheduledProjectID {
+			start = index + 1
+			break
+		}
 	}
 
-	sort.SliceStable(listObj.list, func(i, j int) bool {
-		// Sort ascending by timestamp (confirmed)
-		return (listObj.list)[i].timestamp < (listObj.list)[j].timestamp
-	})
+	result := make([]string, 0, len(listObj.projectOrder))
+	for x := 0; x < len(listObj.projectOrder); x++ {
+		result = append(result, listObj.projectOrder[(start+x)%len(listObj.projectOrder)])
+	}
 
+	return result
 }
 
-func (listObj *ChunkGroupPriorityList) Len() int {
-	return len(listObj.list)
+/** Inform the list that a chunk of the given project was scheduled, so that other projects are scheduled next. */
+func (listObj *ChunkGroupPriorityList) MarkScheduled(projectID string) {
+	listObj.lastScheduledProjectID = projectID
 }
 
-func (listObj *ChunkGroupPriorityList) Peek() *PostQueueChunkGroup {
-	if listObj.Len() == 0 {
+/** Returns the oldest chunk group of the project, or nil if there are none. */
+func (listObj *ChunkGroupPriorityList) Peek(projectID string) *PostQueueChunkGroup {
+
+	lane, exists := listObj.lanes[projectID]
+	if !exists || lane.Len() == 0 {
 		return nil
 	}
 
-	return listObj.list[0]
+	return (*lane)[0].chunkGroup
 }
 
-func (listObj *ChunkGroupPriorityList) Pop() *PostQueueChunkGroup {
-	if listObj.Len() == 0 {
+/** Removes and returns the oldest chunk group of the project, or nil if there are none. */
+func (listObj *ChunkGroupPriorityList) Pop(projectID string) *PostQueueChunkGroup {
+
+	lane, exists := listObj.lanes[projectID]
+	if !exists || lane.Len() == 0 {
 		return nil
 	}
 
-	result := listObj.list[0]
+	result := heap.Pop(lane).(*chunkGroupHeapEntry).chunkGroup
+	listObj.size--
+
+	if lane.Len() == 0 {
+		listObj.removeLane(projectID)
+	}
+
+	return result
+}
+
+func (listObj *ChunkGroupPriorityList) removeLane(projectID string) {
+
+	delete(listObj.lanes, projectID)
+
+	for index, val := range listObj.projectOrder {
+		if val != projectID {
+			continue
+		}
 
-	listObj.list = listObj.list[1:]
+		listObj.projectOrder = append(listObj.projectOrder[:index], listObj.projectOrder[index+1:]...)
+
+		// If the removed project was the most recently scheduled, then treat the project before it as the most
+		// recently scheduled, so that the next schedule begins with the project that followed the removed one.
+		if listObj.lastScheduledProjectID == projectID {
+			listObj.lastScheduledProjectID = ""
+			if len(listObj.projectOrder) > 0 {
+				listObj.lastScheduledProjectID = listObj.projectOrder[(index+len(listObj.projectOrder)-1)%len(listObj.projectOrder)]
+			}
+		}
+		break
+	}
+}
+
+type chunkGroupHeapEntry struct {
+	chunkGroup *PostQueueChunkGroup
+	sequence   uint64
+}
+
+func (entry *chunkGroupHeapEntry) less(other *chunkGroupHeapEntry) bool {
+	if entry.chunkGroup.timestamp != other.chunkGroup.timestamp {
+		return entry.chunkGroup.timestamp < other.chunkGroup.timestamp
+	}
+	return entry.sequence < other.sequence
+}
+
+/** Implements heap.Interface, as a min-heap of chunk groups of a single project */
+type chunkGroupHeap []*chunkGroupHeapEntry
+
+func (h chunkGroupHeap) Len() int { return len(h) }
+
+func (h chunkGroupHeap) Less(i, j int) bool { return h[i].less(h[j]) }
+
+func (h chunkGroupHeap) Swap(i, j int) { h[i], h[j] = h[j], h[i] }
+
+func (h *chunkGroupHeap) Push(x interface{}) {
+	*h = append(*h, x.(*chunkGroupHeapEntry))
+}
 
+func (h *chunkGroupHeap) Pop() interface{} {
+	old := *h
+	n := len(old)
+	result := old[n-1]
+	old[n-1] = nil // Release the reference, so the chunk group can be garbage collected
+	*h = old[:n-1]
 	return result
 }
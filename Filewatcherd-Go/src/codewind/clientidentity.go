@@ -0,0 +1,143 @@
+/*******************************************************************************
+* Copyright (c) 2020 IBM Corporation and others.
+* All rights reserved. This program and the accompanying materials
+* are made available under the terms of the Eclipse Public License v2.0
+* which accompanies this distribution, and is available at
+* http://www.eclipse.org/legal/epl-v20.html
+*
+* Contributors:
+*     IBM Corporation - initial API and implementation
+*******************************************************************************/
+
+package main
+
+import (
+	"codewind/utils"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+)
+
+/**
+ * The client UUID identifies this filewatcher to a server; it is persisted in the state directory, so that the
+ * server sees a restarted filewatcher as the same client (and can correlate its watch status reports).
+ *
+ * The state directory is the FILEWATCHER_STATE_DIR environment variable if set, otherwise
+ * $XDG_STATE_HOME/codewind-filewatcher (with the XDG default of ~/.local/state, or %LOCALAPPDATA% on Windows).
+ * Each server has its own UUID, in the file 'client-uuid' of a subdirectory of the state directory that is unique to
+ * the server's base URL.
+ *
+ * The persisted UUIDs are replaced with new UUIDs if the filewatcher is started with the --reset-client-uuid flag.
+ */
+
+const (
+	resetClientUUIDFlag = "--reset-client-uuid"
+
+	clientUUIDFileName = "client-uuid"
+
+	stateDirectoryName = "codewind-filewatcher"
+)
+
+/** Returns the directory that the filewatcher persists its state to, as described above. */
+func getStateDirectory() (string, error) {
+
+	if stateDir := strings.TrimSpace(os.Getenv("FILEWATCHER_STATE_DIR")); stateDir != "" {
+		return stateDir, nil
+	}
+
+	if xdgStateHome := strings.TrimSpace(os.Getenv("XDG_STATE_HOME")); xdgStateHome != "" {
+		return filepath.Join(xdgStateHome, stateDirectoryName), nil
+	}
+
+	if runtime.GOOS == "windows" {
+		if localAppData := strings.TrimSpace(os.Getenv("LOCALAPPDATA")); localAppData != "" {
+			return filepath.Join(localAppData, stateDirectoryName), nil
+		}
+	}
+
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return "", err
+	}
+
+	return filepath.Join(home, ".local", "state", stateDirectoryName), nil
+}
+
+/**
+ * Returns the persisted client UUID of the server, or (if there is none, it is invalid, or reset is true) generates
+ * and persists a new one. If the UUID cannot be persisted, a new (unpersisted) UUID is returned.
+ */
+func loadOrCreateClientUUID(baseURL string, reset bool) (string, error) {
+
+	newUUID := utils.GenerateUuid()
+	if newUUID == nil {
+		return "", errors.New("Unable to generate client UUID")
+	}
+
+	stateDir, err := getStateDirectory()
+	if err != nil {
+		utils.LogErrorErr("Unable to determine the state directory, so the client UUID will not be persisted", err)
+		return *newUUID, nil
+	}
+
+	uuidFile := filepath.Join(stateDir, serverDirectoryName(baseURL), clientUUIDFileName)
+
+	if !reset {
+		contents, err := ioutil.ReadFile(uuidFile)
+
+		if err == nil {
+			existingUUID := strings.TrimSpace(string(contents))
+			if utils.IsValidUuid(existingUUID) {
+				utils.LogInfo("Using persisted client UUID " + existingUUID + " from " + uuidFile)
+				return existingUUID, nil
+			}
+			utils.LogError("Ignoring invalid client UUID in " + uuidFile + ": " + existingUUID)
+
+		} else if !os.IsNotExist(err) {
+			utils.LogErrorErr("Unable to read client UUID from "+uuidFile, err)
+		}
+	} else {
+		utils.LogInfo("Resetting client UUID in " + uuidFile)
+	}
+
+	if err := writeClientUUID(uuidFile, *newUUID); err != nil {
+		utils.LogErrorErr("Unable to persist client UUID to "+uuidFile, err)
+	} else {
+		utils.LogInfo("Persisted new client UUID " + *newUUID + " to " + uuidFile)
+	}
+
+	return *newUUID, nil
+}
+
+/** Write the UUID to a temporary file, then rename it over the file, so the file is never partially written. */
+func writeClientUUID(uuidFile string, uuid string) error {
+
+	dir := filepath.Dir(uuidFile)
+
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return err
+	}
+
+	tempFile, err := ioutil.TempFile(dir, clientUUIDFileName+"-*.tmp")
+	if err != nil {
+		return err
+	}
+
+	_, err = tempFile.WriteString(uuid + "\n")
+	if closeErr := tempFile.Close(); err == nil {
+		err = closeErr
+	}
+
+	if err == nil {
+		err = os.Rename(tempFile.Name(), uuidFile)
+	}
+
+	if err != nil {
+		os.Remove(tempFile.Name())
+	}
+
+	return err
+}
@@ -13,25 +13,45 @@ package main
 
 import (
 	"codewind/utils"
+	"crypto/sha256"
+	"encoding/hex"
 	"os"
+	"path/filepath"
+	"strings"
 	"time"
 )
 
 /* This is the entrypoint for the application.
- * The application takes one optional argument, which is the URL of the Codewind server. */
+ * The application takes one optional argument, which is the URL of the Codewind server (http, https, or
+ * unix:///path/to/socket, if the server listens on a Unix domain socket), or a comma-separated list of URLs, to
+ * connect to multiple servers from the same process. The second optional argument is the path to the installer.
+ *
+ * If the --reset-client-uuid flag is specified (anywhere in the arguments), the persisted client UUID of each server
+ * is replaced with a new one; see clientidentity.go. */
 func main() {
 
 	// Default URL if no args
-	baseURL := "http://localhost:9090"
+	baseURLs := "http://localhost:9090"
 
 	var installerPath string
 
+	resetClientUUID := false
+
+	args := []string{}
+	for _, arg := range os.Args[1:] {
+		if arg == resetClientUUIDFlag {
+			resetClientUUID = true
+		} else {
+			args = append(args, arg)
+		}
+	}
+
 	// If one arg is specified, use it as a URL
-	if len(os.Args) >= 2 {
-		baseURL = os.Args[1]
+	if len(args) >= 1 {
+		baseURLs = args[0]
 
-		if len(os.Args) == 3 {
-			installerPath = os.Args[2]
+		if len(args) == 2 {
+			installerPath = args[1]
 		}
 	}
 
@@ -39,35 +59,128 @@ func main() {
 		installerPath = value
 	}
 
-	baseURL = utils.StripTrailingForwardSlash(baseURL)
+	servers := parseServerURLs(baseURLs)
 
-	httpPostOutputQueue, err := NewHttpPostOutputQueue(baseURL)
-	if err != nil {
-		utils.LogSevereErr("Unable to create HTTP POST output queue", err)
+	// Project directories that are watched on behalf of more than one server share the same fsnotify watcher
+	watcherPool := NewSharedWatcherPool()
+
+	connected := 0
+
+	for _, baseURL := range servers {
+		if err := startServerConnection(baseURL, installerPath, len(servers) > 1, resetClientUUID, watcherPool); err != nil {
+			utils.LogSevereErr("Unable to start connection to server "+utils.RedactURL(baseURL), err)
+		} else {
+			connected++
+		}
+	}
+
+	if connected == 0 {
+		utils.LogSevere("No server connections could be started.")
 		return
 	}
 
-	projectList := NewProjectList(httpPostOutputQueue, installerPath)
+	for {
+		time.Sleep(1000 * time.Millisecond)
+	}
+}
 
-	clientUUID := *utils.GenerateUuid()
+/**
+ * Start the components that communicate with a single server: each server has its own client UUID, watch list,
+ * WebSocket connection and POST queue, while the underlying fsnotify watchers are shared between servers.
+ */
+func startServerConnection(baseURL string, installerPath string, multipleServers bool, resetClientUUID bool, watcherPool *SharedWatcherPool) error {
 
-	watchService := NewWatchService(projectList, baseURL, clientUUID)
+	utils.LogInfo("Starting connection to server " + utils.RedactURL(baseURL))
 
-	projectList.SetWatchService(watchService)
+	clientUUID, err := loadOrCreateClientUUID(baseURL, resetClientUUID)
+	if err != nil {
+		return err
+	}
 
-	httpGetStatusThread, err := NewHttpGetStatusThread(baseURL, projectList)
+	postQueueSettings := NewDefaultHttpPostOutputQueueSettings()
+
+	// Each server has its own outbox, otherwise the chunk groups of one server would be sent to the others
+	if postQueueSettings.OutboxDirectory != "" {
+		rootDirectory := postQueueSettings.OutboxDirectory
+		postQueueSettings.OutboxDirectory = filepath.Join(rootDirectory, serverDirectoryName(baseURL))
 
+		// Chunk groups were previously written to the root directory when there was only one server, so they can only
+		// be attributed to a server when there is still only one
+		if !multipleServers {
+			if err := MigrateLegacyOutboxFiles(rootDirectory, postQueueSettings.OutboxDirectory); err != nil {
+				utils.LogSevereErr("Unable to move chunk groups from outbox directory "+rootDirectory, err)
+			}
+		}
+	}
+
+	httpPostOutputQueue, err := NewHttpPostOutputQueue(baseURL, clientUUID, postQueueSettings)
 	if err != nil {
-		utils.LogSevereErr("Unable to create HTTP GET status thread", err)
-		return
+		return err
 	}
 
-	StartWSConnectionManager(baseURL, projectList, httpGetStatusThread)
+	projectList := NewProjectList(httpPostOutputQueue, installerPath, NewDefaultBatchPolicy())
+
+	watchService := NewWatchService(projectList, baseURL, clientUUID, watcherPool)
 
-	debugTimer := NewDebugTimer(watchService, projectList, httpPostOutputQueue)
+	projectList.SetWatchService(watchService)
+
+	httpGetStatusThread, err := NewHttpGetStatusThread(baseURL, projectList)
+	if err != nil {
+		return err
+	}
+
+	debugTimer := NewDebugTimer(baseURL, watchService, projectList, httpPostOutputQueue)
 	debugTimer.Start()
 
-	for {
-		time.Sleep(1000 * time.Millisecond)
+	return StartWSConnectionManager(baseURL, projectList, httpGetStatusThread, debugTimer)
+}
+
+/**
+ * Returns the server URLs of the comma-separated list, without duplicates: each URL is normalized (see
+ * utils.ParseBaseURL), so that, for example, 'http://host:9090/' and 'HTTP://host:9090' are the same server. Invalid
+ * URLs are returned as is, and are reported when the connection to the server is started.
+ */
+func parseServerURLs(baseURLs string) []string {
+
+	result := []string{}
+	seen := map[string]bool{}
+
+	for _, baseURL := range strings.Split(baseURLs, ",") {
+
+		if baseURL = strings.TrimSpace(baseURL); baseURL == "" {
+			continue
+		}
+
+		if parsed, err := utils.ParseBaseURL(baseURL); err == nil {
+			baseURL = parsed.String()
+		} else {
+			baseURL = utils.StripTrailingForwardSlash(baseURL)
+		}
+
+		if seen[baseURL] {
+			utils.LogInfo("Ignoring duplicate server URL " + utils.RedactURL(baseURL))
+			continue
+		}
+
+		seen[baseURL] = true
+		result = append(result, baseURL)
 	}
+
+	return result
+}
+
+/**
+ * Returns a directory name that is unique to the server's base URL. Only the scheme, host and path of the URL are
+ * hashed: the userinfo and query (which may contain credentials) are not, so that changing the credentials does not
+ * change the directory. For a URL without userinfo or query, this is the hash of the (normalized) URL itself.
+ */
+func serverDirectoryName(baseURL string) string {
+
+	identity := baseURL
+	if parsed, err := utils.ParseBaseURL(baseURL); err == nil {
+		identity = parsed.Scheme + "://" + parsed.Host + parsed.EscapedPath()
+	}
+
+	hash := sha256.Sum256([]byte(identity))
+	return hex.EncodeToString(hash[:])[:16]
 }
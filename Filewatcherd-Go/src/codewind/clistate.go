@@ -22,6 +22,7 @@ import (
 	"path/filepath"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 )
 
@@ -44,6 +45,11 @@ type CLIState struct {
 	mockInstallerPath string
 
 	channel chan CLIStateChannelEntry
+
+	/** The result of the most recently completed cwctl command, or nil if none has completed; lock 'lock' before reading/writing this */
+	lastResult_synch_lock *RunProjectReturn
+
+	lock *sync.Mutex
 }
 
 // NewCLIState contains the state of the CLI project sync commmand for a single project (id+path)
@@ -60,6 +66,7 @@ func NewCLIState(projectIDParam string, installerPathParam string, projectPathPa
 		projectPath:       projectPathParam,
 		mockInstallerPath: strings.TrimSpace(os.Getenv("MOCK_CWCTL_INSTALLER_PATH")),
 		channel:           make(chan CLIStateChannelEntry),
+		lock:              &sync.Mutex{},
 	}
 
 	go result.readChannel()
@@ -80,14 +87,38 @@ func (state *CLIState) OnFileChangeEvent(projectCreationTimeInAbsoluteMsecsParam
 	}
 
 	// Inform channel that a new file change list was received (but don't actually send it)
-	state.channel <- CLIStateChannelEntry{projectCreationTimeInAbsoluteMsecsParam, nil, debugPtw}
+	state.channel <- CLIStateChannelEntry{projectCreationTimeInAbsoluteMsecsParam, nil, debugPtw, false}
 
 	return nil
 }
 
+// OnFullSyncRequest is like OnFileChangeEvent, except that the next run of the cwctl command will sync all of the
+// files of the project (timestamp 0), rather than only those changed since the last successful run.
+func (state *CLIState) OnFullSyncRequest(projectCreationTimeInAbsoluteMsecsParam int64, debugPtw *models.ProjectToWatch) error {
+
+	if strings.TrimSpace(state.projectPath) == "" {
+		msg := "Project path passed to CLIState is empty, so ignoring full sync request."
+		utils.LogSevere(msg)
+		return errors.New(msg)
+	}
+
+	state.channel <- CLIStateChannelEntry{projectCreationTimeInAbsoluteMsecsParam, nil, debugPtw, true}
+
+	return nil
+}
+
+// GetLastResult returns the result of the most recently completed cwctl command, or nil if none has completed yet.
+func (state *CLIState) GetLastResult() *RunProjectReturn {
+	state.lock.Lock()
+	defer state.lock.Unlock()
+
+	return state.lastResult_synch_lock
+}
+
 func (state *CLIState) readChannel() {
-	processWaiting := false // Once the current command completes, should we start another one
-	processActive := false  // Is there currently a cwctl command active.
+	processWaiting := false  // Once the current command completes, should we start another one
+	processActive := false   // Is there currently a cwctl command active.
+	fullSyncWaiting := false // Should the next command sync all files, rather than only those changed since lastTimestamp
 
 	var lastTimestamp int64 = 0
 
@@ -103,6 +134,10 @@ func (state *CLIState) readChannel() {
 
 			rpr := channelResult.runProjectReturn
 
+			state.lock.Lock()
+			state.lastResult_synch_lock = rpr
+			state.lock.Unlock()
+
 			if rpr.errorCode == 0 {
 				// Success, so update the timestamp to the process start time.
 				lastTimestamp = rpr.spawnTime
@@ -123,6 +158,10 @@ func (state *CLIState) readChannel() {
 				debugMostRecentPtw = channelResult.debugPtw
 			}
 
+			if channelResult.fullSync {
+				fullSyncWaiting = true
+			}
+
 			processWaiting = true
 		}
 
@@ -130,7 +169,15 @@ func (state *CLIState) readChannel() {
 			// Start a new process if there isn't one running, and we received an update event.
 			processWaiting = false
 			processActive = true
-			go state.runProjectCommand(lastTimestamp, debugMostRecentPtw)
+
+			timestamp := lastTimestamp
+			if fullSyncWaiting {
+				utils.LogInfo("Running full sync of project " + state.projectID)
+				timestamp = 0
+				fullSyncWaiting = false
+			}
+
+			go state.runProjectCommand(timestamp, debugMostRecentPtw)
 		}
 	}
 
@@ -141,6 +188,7 @@ type CLIStateChannelEntry struct {
 	projectCreationTimeInAbsoluteMsecsParam int64
 	runProjectReturn                        *RunProjectReturn
 	debugPtw                                *models.ProjectToWatch // Only used during automated testing
+	fullSync                                bool                   // Sync all files on the next run, see OnFullSyncRequest
 }
 
 func (state *CLIState) runProjectCommand(timestamp int64, debugPtw *models.ProjectToWatch) {
@@ -249,7 +297,7 @@ func (state *CLIState) runProjectCommand(timestamp int64, debugPtw *models.Proje
 			spawnTimeInMsecs,
 		}
 
-		state.channel <- CLIStateChannelEntry{0, &result, nil}
+		state.channel <- CLIStateChannelEntry{0, &result, nil, false}
 
 	} else {
 
@@ -262,7 +310,7 @@ func (state *CLIState) runProjectCommand(timestamp int64, debugPtw *models.Proje
 			spawnTimeInMsecs,
 		}
 
-		state.channel <- CLIStateChannelEntry{0, &result, nil}
+		state.channel <- CLIStateChannelEntry{0, &result, nil, false}
 
 	}
 }
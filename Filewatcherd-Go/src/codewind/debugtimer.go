@@ -27,13 +27,15 @@ import (
  * leaks, resources we aren't closing, etc).
  */
 type DebugTimer struct {
+	baseURL         string
 	watchService    *WatchService
 	projectList     *ProjectList
 	postOutputQueue *HttpPostOutputQueue
 }
 
-func NewDebugTimer(watchService *WatchService, projectList *ProjectList, postOutputQueue *HttpPostOutputQueue) *DebugTimer {
+func NewDebugTimer(baseURL string, watchService *WatchService, projectList *ProjectList, postOutputQueue *HttpPostOutputQueue) *DebugTimer {
 	result := &DebugTimer{
+		baseURL,
 		watchService,
 		projectList,
 		postOutputQueue,
@@ -61,20 +63,66 @@ func (debugTimer *DebugTimer) OutputDebug() {
 
 	result += "---------------------------------------------------------------------------------------\n\n"
 
+	result += debugTimer.GenerateDebugState()
+
+	result += "---------------------------------------------------------------------------------------\n"
+
+	for _, val := range strings.Split(result, "\n") {
+
+		utils.LogInfo("[status] " + val)
+	}
+
+	// Restart the timer
+	debugTimer.Start()
+}
+
+/** Returns the internal state of each of the components; this may be called at any time, from any goroutine. */
+func (debugTimer *DebugTimer) GenerateDebugState() string {
+
+	result := "Server: " + utils.RedactURL(debugTimer.baseURL) + "\n\n"
+
 	watchServiceResult := <-debugTimer.watchService.RequestDebugMessage()
 	result += "WatchService:\n" + strings.TrimSpace(watchServiceResult) + "\n\n"
 
+	result += "Watch Status Reporter:\n" + strings.TrimSpace(<-debugTimer.watchService.statusReporter.RequestDebugMessage()) + "\n\n"
+
+	result += "Shared Watchers:\n" + strings.TrimSpace(debugTimer.watchService.watcherPool.GetDebugState()) + "\n\n"
+
 	result += "Project List:\n" + strings.TrimSpace(<-debugTimer.projectList.RequestDebugMessage()) + "\n\n"
 
 	result += "HTTP Post Output Queue:\n" + strings.TrimSpace(<-debugTimer.postOutputQueue.RequestDebugMessage()) + "\n\n"
 
-	result += "---------------------------------------------------------------------------------------\n"
+	return result
+}
 
-	for _, val := range strings.Split(result, "\n") {
+/** Returns a health report, built from the state of each of the components; this may be called from any goroutine. */
+func (debugTimer *DebugTimer) CollectHealthReport() *wsHealthReportMessage {
 
-		utils.LogInfo("[status] " + val)
+	watcherHealth := <-debugTimer.watchService.RequestHealth()
+
+	projects := <-debugTimer.projectList.RequestHealth()
+
+	for _, project := range projects {
+		project.WatchStatus = projectWatchStatusNotWatched
+
+		if watcher, exists := watcherHealth[project.ProjectID]; exists {
+			if watcher.open {
+				project.WatchStatus = projectWatchStatusWatching
+			} else {
+				project.WatchStatus = projectWatchStatusWaiting
+			}
+			project.WatchedDirectories = watcher.watchedDirectories
+		}
 	}
 
-	// Restart the timer
-	debugTimer.Start()
+	errorCount, severeCount := utils.GetErrorCounts()
+
+	return &wsHealthReportMessage{
+		Type:        wsMessageTypeHealthReport,
+		Timestamp:   time.Now().UnixNano() / int64(time.Millisecond),
+		Projects:    projects,
+		PostQueue:   <-debugTimer.postOutputQueue.RequestHealth(),
+		ErrorCount:  errorCount,
+		SevereCount: severeCount,
+	}
 }
@@ -12,10 +12,7 @@
 package main
 
 import (
-	"bytes"
 	"codewind/utils"
-	"compress/zlib"
-	"encoding/base64"
 	"encoding/json"
 	"errors"
 	"sort"
@@ -45,23 +42,38 @@ import (
 // is reset and a new 1000 msec timer begins. Batch together events seen since
 // within a given timeframe, and send them as a single request.
 //
+// To ensure that a continuous stream of events cannot postpone a batch
+// forever, the batch is also sent once a maximum latency has elapsed since the
+// first event of the batch, or once the batch reaches a maximum size. See
+// BatchPolicy for details.
+//
 // This code receives file change events from the watch service, and forwards
 // batched groups of events to the HTTP POST output queue.
 type FileChangeEventBatchUtil struct {
-	filesChangesChan      chan []ChangedFileEntry
-	debugState_synch_lock string // Lock 'lock' before reading/writing this
-	projectList           *ProjectList
-	lock                  *sync.Mutex
+	filesChangesChan         chan []ChangedFileEntry
+	debugState_synch_lock    string      // Lock 'lock' before reading/writing this
+	policy_synch_lock        BatchPolicy // Lock 'lock' before reading/writing this
+	pendingEvents_synch_lock int         // Lock 'lock' before reading/writing this
+	projectList              *ProjectList
+	clock                    utils.Clock
+	lock                     *sync.Mutex
 }
 
 // NewFileChangeEventBatchUtil ...
-func NewFileChangeEventBatchUtil(projectID string, postOutputQueue *HttpPostOutputQueue, projectList *ProjectList) *FileChangeEventBatchUtil {
+func NewFileChangeEventBatchUtil(projectID string, policy BatchPolicy, postOutputQueue *HttpPostOutputQueue, projectList *ProjectList) *FileChangeEventBatchUtil {
+	return newFileChangeEventBatchUtilWithClock(projectID, policy, postOutputQueue, projectList, utils.SystemClock)
+}
+
+/** Create a batch util whose quiet period and maximum latency timers use the given clock, for example, for tests. */
+func newFileChangeEventBatchUtilWithClock(projectID string, policy BatchPolicy, postOutputQueue *HttpPostOutputQueue, projectList *ProjectList, clock utils.Clock) *FileChangeEventBatchUtil {
 
 	result := &FileChangeEventBatchUtil{
 		filesChangesChan:      make(chan []ChangedFileEntry),
 		debugState_synch_lock: "",
+		policy_synch_lock:     policy,
 		lock:                  &sync.Mutex{},
 		projectList:           projectList,
+		clock:                 clock,
 	}
 
 	go result.fileChangeListener(projectID, postOutputQueue)
@@ -74,6 +86,21 @@ func (e *FileChangeEventBatchUtil) AddChangedFiles(changedFileEntries []ChangedF
 	e.filesChangesChan <- changedFileEntries
 }
 
+// SetBatchPolicy replaces the batch policy; the new policy applies from the next received event.
+func (e *FileChangeEventBatchUtil) SetBatchPolicy(policy BatchPolicy) {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+
+	e.policy_synch_lock = policy
+}
+
+func (e *FileChangeEventBatchUtil) getBatchPolicy() BatchPolicy {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+
+	return e.policy_synch_lock
+}
+
 // RequestDebugMessage ...
 func (e *FileChangeEventBatchUtil) RequestDebugMessage() string {
 
@@ -83,72 +110,101 @@ func (e *FileChangeEventBatchUtil) RequestDebugMessage() string {
 	return e.debugState_synch_lock
 }
 
+// GetPendingEventCount returns the number of events received that have not yet been sent as a batch.
+func (e *FileChangeEventBatchUtil) GetPendingEventCount() int {
+
+	e.lock.Lock()
+	defer e.lock.Unlock()
+
+	return e.pendingEvents_synch_lock
+}
+
+func (e *FileChangeEventBatchUtil) setPendingEventCount(count int) {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+
+	e.pendingEvents_synch_lock = count
+}
+
 func (e *FileChangeEventBatchUtil) fileChangeListener(projectID string, postOutputQueue *HttpPostOutputQueue) {
 
-	utils.LogInfo("EventBatchUtil listener started for " + projectID)
+	policy := e.getBatchPolicy()
+
+	utils.LogInfo("EventBatchUtil listener started for " + projectID + " with " + policy.toDebugString())
 
 	eventsReceivedSinceLastBatch := []ChangedFileEntry{}
 
-	timerChan := make(chan *time.Timer)
+	debugTimeSinceLastFileChange := e.clock.Now()
 
-	debugTimeSinceLastFileChange := time.Now()
+	debugTimeSinceLastTimerReceived := e.clock.Now()
 
-	debugTimeSinceLastTimerReceived := time.Now()
+	// The time at which the first event of the current batch was received
+	var firstEventTime time.Time
 
-	var timer1 *time.Timer
+	// Receives once the current batch should be sent; non-nil only while there are pending events. A new channel
+	// replaces the old one on each event, so a stale timer can never send a batch early.
+	var flushTimerChan <-chan time.Time
 
 	for {
 
 		select {
-		case timerReceived := <-timerChan:
+		case <-flushTimerChan:
 
 			// First, update our debug stats
-			debugTimeSinceLastTimerReceived = time.Now()
-			e.updateDebugState(debugTimeSinceLastFileChange, debugTimeSinceLastTimerReceived)
+			debugTimeSinceLastTimerReceived = e.clock.Now()
+			e.updateDebugState(debugTimeSinceLastFileChange, debugTimeSinceLastTimerReceived, policy)
 
-			// Only process a timer elapsed event if the event is for the timer that is currently active (prevent race condition)
-			if timer1 != nil && timer1 == timerReceived {
-
-				if len(eventsReceivedSinceLastBatch) > 0 {
-					processAndSendEvents(eventsReceivedSinceLastBatch, projectID, postOutputQueue, e.projectList)
-				}
-				eventsReceivedSinceLastBatch = []ChangedFileEntry{}
-				timer1 = nil
+			if len(eventsReceivedSinceLastBatch) > 0 {
+				processAndSendEvents(eventsReceivedSinceLastBatch, projectID, policy, postOutputQueue, e.projectList)
 			}
+			eventsReceivedSinceLastBatch = []ChangedFileEntry{}
+			e.setPendingEventCount(0)
+			flushTimerChan = nil
 
 		case receivedFileChanges := <-e.filesChangesChan:
-			debugTimeSinceLastFileChange = time.Now()
-			e.updateDebugState(debugTimeSinceLastFileChange, debugTimeSinceLastTimerReceived)
+			if newPolicy := e.getBatchPolicy(); newPolicy != policy {
+				utils.LogInfo("EventBatchUtil batch policy updated for " + projectID + " to " + newPolicy.toDebugString())
+				policy = newPolicy
+			}
+
+			debugTimeSinceLastFileChange = e.clock.Now()
+			e.updateDebugState(debugTimeSinceLastFileChange, debugTimeSinceLastTimerReceived, policy)
+
+			if len(eventsReceivedSinceLastBatch) == 0 {
+				firstEventTime = debugTimeSinceLastFileChange
+			}
 
 			eventsReceivedSinceLastBatch = append(eventsReceivedSinceLastBatch, receivedFileChanges...)
-			if timer1 != nil {
-				timer1.Stop()
+			e.setPendingEventCount(len(eventsReceivedSinceLastBatch))
+
+			if policy.IsBatchFull(len(eventsReceivedSinceLastBatch)) {
+				utils.LogDebug("Maximum batch size reached for " + projectID + ", so sending " + strconv.Itoa(len(eventsReceivedSinceLastBatch)) + " events")
+				processAndSendEvents(eventsReceivedSinceLastBatch, projectID, policy, postOutputQueue, e.projectList)
+				eventsReceivedSinceLastBatch = []ChangedFileEntry{}
+				e.setPendingEventCount(0)
+				flushTimerChan = nil
+				continue
 			}
-			timer1 = time.NewTimer(1000 * time.Millisecond)
-			go func(t *time.Timer) {
-				<-t.C
-				// If timer is still active, send an elapsed time
-				// if t == timer1 {
-				timerChan <- t
-				// }
-			}(timer1)
+
+			flushTimerChan = e.clock.After(policy.NextFlushDelay(firstEventTime, debugTimeSinceLastFileChange))
 		}
 
 	} // end for
 
 }
 
-func (e *FileChangeEventBatchUtil) updateDebugState(debugTimeSinceLastFileChange time.Time, debugTimeSinceLastTimerReceived time.Time) {
+func (e *FileChangeEventBatchUtil) updateDebugState(debugTimeSinceLastFileChange time.Time, debugTimeSinceLastTimerReceived time.Time, policy BatchPolicy) {
 	result := "lastFileChangeSeen: " + utils.FormatTime(debugTimeSinceLastFileChange)
-	result += "   timeSinceLastTimer: " + utils.FormatTime(debugTimeSinceLastTimerReceived) + "\n"
+	result += "   timeSinceLastTimer: " + utils.FormatTime(debugTimeSinceLastTimerReceived)
+	result += "   " + policy.toDebugString() + "\n"
 
 	e.lock.Lock()
 	e.debugState_synch_lock = result
 	e.lock.Unlock()
 }
 
-/** Process the event list, split it into chunks, then pass it to the HTTP POST output queue */
-func processAndSendEvents(eventsToSend []ChangedFileEntry, projectID string, postOutputQueue *HttpPostOutputQueue, projectList *ProjectList) {
+/** Process the event list, then inform cwctl and/or pass it to the HTTP POST output queue, based on the delivery mode */
+func processAndSendEvents(eventsToSend []ChangedFileEntry, projectID string, policy BatchPolicy, postOutputQueue *HttpPostOutputQueue, projectList *ProjectList) {
 	sort.SliceStable(eventsToSend, func(i, j int) bool {
 
 		// Sort ascending by timestamp
@@ -156,9 +212,11 @@ func processAndSendEvents(eventsToSend []ChangedFileEntry, projectID string, pos
 
 	})
 
-	// Remove any contiguous create/delete events
-	eventsToSend = removeDuplicateEventsOfType(eventsToSend, "CREATE")
-	eventsToSend = removeDuplicateEventsOfType(eventsToSend, "DELETE")
+	// Reduce the events of each path to their net effect
+	eventsToSend = coalesceEvents(eventsToSend)
+
+	// Collapse large subtrees of created/deleted files into a single directory event, if enabled
+	eventsToSend = compactBatchEvents(eventsToSend, policy)
 
 	if len(eventsToSend) == 0 {
 		return
@@ -172,58 +230,67 @@ func processAndSendEvents(eventsToSend []ChangedFileEntry, projectID string, pos
 	utils.LogInfo(
 		"Batch change summary for " + projectID + "@ " + strconv.FormatInt(mostRecentTimestamp.timestamp, 10) + ": " + changeSummary)
 
-	// Inform CLI of changes
-	projectList.CLIFileChangeUpdate(projectID)
+	if policy.DeliveryMode.UsesCwctl() {
+		// Inform CLI of changes
+		projectList.CLIFileChangeUpdate(projectID)
+	}
 
-	// TODO: Remove this entire if block once CWCTL sync is mature.
-	if false {
-		// Use the old way of communicating file changes via POST packets.
+	if policy.DeliveryMode.UsesPost() {
+		// Communicate the file changes to the server via POST requests
+		queueEventsForPost(eventsToSend, projectID, mostRecentTimestamp.timestamp, postOutputQueue)
+	}
 
-		var fileListsToSend [][]changedFileEntryJSON
+}
 
-		for len(eventsToSend) > 0 {
+/** Split the event list into chunks, compress them, then pass them to the HTTP POST output queue */
+func queueEventsForPost(eventsToSend []ChangedFileEntry, projectID string, timestamp int64, postOutputQueue *HttpPostOutputQueue) {
 
-			var currList []changedFileEntryJSON
+	// The chunk size and encoding preferred by the server
+	format := postOutputQueue.GetPostFormat()
 
-			// Remove at most X paths from currList
-			for len(currList) < 625 && len(eventsToSend) > 0 {
-				cfe := eventsToSend[0]
-				eventsToSend = eventsToSend[1:]
-				currList = append(currList, *cfe.toJSON())
+	var fileListsToSend [][]changedFileEntryJSON
 
-			}
+	for len(eventsToSend) > 0 {
 
-			if len(currList) > 0 {
-				fileListsToSend = append(fileListsToSend, currList)
-			}
-		}
+		var currList []changedFileEntryJSON
 
-		var stringsToSend []string
+		// Remove at most X paths from currList
+		for len(currList) < format.ChunkSize && len(eventsToSend) > 0 {
+			cfe := eventsToSend[0]
+			eventsToSend = eventsToSend[1:]
+			currList = append(currList, *cfe.toJSON())
 
-		for _, jsonArray := range fileListsToSend {
-			jaString, err := json.Marshal(jsonArray)
+		}
 
-			if err != nil {
-				utils.LogSevere("Unable to marshal JSON")
-				continue
-			}
+		if len(currList) > 0 {
+			fileListsToSend = append(fileListsToSend, currList)
+		}
+	}
 
-			compressedStr, err := compressAndConvertString(jaString)
-			if err != nil {
-				// We shouldn't ever get an error from compressing or conversion
-				utils.LogSevere("Unable to compress JSON")
-				continue
-			}
+	var stringsToSend []string
+
+	for _, jsonArray := range fileListsToSend {
+		jaString, err := json.Marshal(jsonArray)
 
-			stringsToSend = append(stringsToSend, *compressedStr)
+		if err != nil {
+			utils.LogSevere("Unable to marshal JSON")
+			continue
 		}
 
-		// Pass the list of chunks to the HTTP Post output queue, for transmission to the server
-		utils.LogDebug("Strings to send " + strconv.Itoa(len(stringsToSend)))
-		if len(stringsToSend) > 0 {
-			postOutputQueue.AddToQueue(projectID, mostRecentTimestamp.timestamp, stringsToSend)
+		encodedStr, err := encodeChangeList(jaString, format.Encoding)
+		if err != nil {
+			// We shouldn't ever get an error from compressing or conversion
+			utils.LogSevereErr("Unable to encode JSON", err)
+			continue
 		}
 
+		stringsToSend = append(stringsToSend, encodedStr)
+	}
+
+	// Pass the list of chunks to the HTTP Post output queue, for transmission to the server
+	utils.LogDebug("Strings to send " + strconv.Itoa(len(stringsToSend)))
+	if len(stringsToSend) > 0 {
+		postOutputQueue.AddToQueue(projectID, timestamp, format.Encoding, stringsToSend)
 	}
 
 }
@@ -253,7 +320,11 @@ func generateChangeListSummaryForDebug(eventsToSend []ChangedFileEntry) string {
 			filename = "/" // Handle event on the root project directory as "/"
 		}
 
-		result += filename + " "
+		result += filename
+		if val.recursive {
+			result += "/**"
+		}
+		result += " "
 
 		// Only output the first 256 chars of changes, to reduce log verbosity
 		if len(result) > 256 {
@@ -270,56 +341,85 @@ func generateChangeListSummaryForDebug(eventsToSend []ChangedFileEntry) string {
 	return result
 }
 
-/** For any given path: If there are multiple entries of the same type in a row, then remove all but the first. */
-func removeDuplicateEventsOfType(entries []ChangedFileEntry, changeType string) []ChangedFileEntry {
-
-	if changeType == "MODIFY" {
-		utils.LogSevere("Unsupported event type: MODIFY")
-		return entries
+/**
+ * Reduce the sequence of events for each path to the net effect of that sequence, for example:
+ * - CREATE, MODIFY -> CREATE
+ * - CREATE, DELETE -> (nothing)
+ * - MODIFY, MODIFY, ... -> MODIFY
+ * - DELETE, CREATE -> MODIFY
+ *
+ * The net effect is determined by whether the path existed before the first event (it did not if the first event is
+ * a CREATE), and whether it exists after the last event (it does not if the last event is a DELETE). If a directory
+ * was deleted and recreated, or a file was replaced by a directory (or vice versa), then both a DELETE and a CREATE
+ * are kept.
+ *
+ * The parameter must be sorted ascending by timestamp; the result is sorted ascending by the timestamp of the last
+ * event seen for each path.
+ */
+func coalesceEvents(entries []ChangedFileEntry) []ChangedFileEntry {
+
+	/* path -> index into 'paths' */
+	pathIndex := make(map[string]int)
+
+	type pathEvents struct {
+		first ChangedFileEntry
+		last  ChangedFileEntry
+		count int
 	}
 
-	/* path -> value not used */
-	containsPath := make(map[string]bool)
+	paths := []*pathEvents{}
 
-	for x := 0; x < len(entries); x++ {
-		cfe := entries[x]
+	for _, cfe := range entries {
+		index, exists := pathIndex[cfe.path]
+		if !exists {
+			pathIndex[cfe.path] = len(paths)
+			paths = append(paths, &pathEvents{first: cfe, last: cfe, count: 1})
+		} else {
+			paths[index].last = cfe
+			paths[index].count++
+		}
+	}
 
-		path := cfe.path
+	result := make([]ChangedFileEntry, 0, len(paths))
 
-		if cfe.eventType == changeType {
-			_, exists := containsPath[path]
-			if exists {
-				utils.LogDebug("Removing duplicate event: " + cfe.toDebugString())
-				entries = append(entries[:x], entries[x+1:]...)
-				x--
-			} else {
-				containsPath[path] = true
-			}
+	for _, pe := range paths {
 
-		} else {
-			delete(containsPath, path)
+		if pe.count == 1 {
+			result = append(result, pe.first)
+			continue
 		}
 
-	}
+		existedBefore := pe.first.eventType != "CREATE"
+		existsAfter := pe.last.eventType != "DELETE"
 
-	return entries
-}
+		if !existedBefore && !existsAfter {
+			utils.LogDebug("Removing created-then-deleted events: " + pe.first.toDebugString())
 
-func compressAndConvertString(strBytes []byte) (*string, error) {
-	var b bytes.Buffer
-	w := zlib.NewWriter(&b)
-	_, err := w.Write(strBytes)
-	if err != nil {
-		return nil, err
-	}
-	err = w.Close()
-	if err != nil {
-		return nil, err
+		} else if !existedBefore && existsAfter {
+			result = append(result, ChangedFileEntry{path: pe.last.path, eventType: "CREATE", timestamp: pe.last.timestamp, directory: pe.last.directory})
+
+		} else if existedBefore && !existsAfter {
+			result = append(result, ChangedFileEntry{path: pe.last.path, eventType: "DELETE", timestamp: pe.last.timestamp, directory: pe.first.directory})
+
+		} else if pe.first.directory != pe.last.directory || (pe.last.directory && pe.last.eventType == "CREATE") {
+			// The path was replaced by something else, so the receiver must see both the removal and the creation
+			result = append(result, ChangedFileEntry{path: pe.last.path, eventType: "DELETE", timestamp: pe.last.timestamp, directory: pe.first.directory})
+			result = append(result, ChangedFileEntry{path: pe.last.path, eventType: "CREATE", timestamp: pe.last.timestamp, directory: pe.last.directory})
+
+		} else {
+			result = append(result, ChangedFileEntry{path: pe.last.path, eventType: "MODIFY", timestamp: pe.last.timestamp, directory: pe.last.directory})
+		}
+
+		if utils.IsLogDebug() {
+			utils.LogDebug("Coalesced " + strconv.Itoa(pe.count) + " events for path: " + pe.last.path)
+		}
 	}
 
-	toBase64 := base64.StdEncoding.EncodeToString(b.Bytes())
+	sort.SliceStable(result, func(i, j int) bool {
+		return result[i].timestamp < result[j].timestamp
+	})
 
-	return &toBase64, nil
+	return result
 }
 
 // ChangedFileEntry is a imple representation of a single change: the file/dir path that changed,
@@ -330,6 +430,7 @@ type ChangedFileEntry struct {
 	eventType string
 	timestamp int64
 	directory bool
+	recursive bool // true if this directory event also applies to everything under the directory
 }
 
 type changedFileEntryJSON struct {
@@ -337,6 +438,7 @@ type changedFileEntryJSON struct {
 	Timestamp int64  `json:"timestamp"`
 	Type      string `json:"type"`
 	Directory bool   `json:"directory"`
+	Recursive bool   `json:"recursive,omitempty"`
 }
 
 func (e *ChangedFileEntry) toJSON() *changedFileEntryJSON {
@@ -346,12 +448,13 @@ func (e *ChangedFileEntry) toJSON() *changedFileEntryJSON {
 		e.timestamp,
 		e.eventType,
 		e.directory,
+		e.recursive,
 	}
 }
 
 func (e *ChangedFileEntry) toDebugString() string {
 
-	return e.path + " " + strconv.FormatInt(e.timestamp, 10) + " " + e.eventType + " " + strconv.FormatBool(e.directory)
+	return e.path + " " + strconv.FormatInt(e.timestamp, 10) + " " + e.eventType + " " + strconv.FormatBool(e.directory) + " " + strconv.FormatBool(e.recursive)
 }
 
 // NewChangedFileEntry ...
@@ -366,6 +469,7 @@ func NewChangedFileEntry(path string, eventType string, timestamp int64, directo
 		eventType,
 		timestamp,
 		directory,
+		false,
 	}, nil
 
 }
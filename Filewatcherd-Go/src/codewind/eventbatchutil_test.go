@@ -0,0 +1,584 @@
+/*******************************************************************************
+* Copyright (c) 2020 IBM Corporation and others.
+* All rights reserved. This program and the accompanying materials
+* are made available under the terms of the Eclipse Public License v2.0
+* which accompanies this distribution, and is available at
+* http://www.eclipse.org/legal/epl-v20.html
+*
+* Contributors:
+*     IBM Corporation - initial API and implementation
+*******************************************************************************/
+
+package main
+
+import (
+	"codewind/models"
+	"os"
+	"sync"
+	"testing"
+	"time"
+)
+
+/** A utils.Clock whose time only moves when Advance is called. */
+type fakeClock struct {
+	lock    sync.Mutex
+	now     time.Time
+	waiters []*fakeClockWaiter
+
+	/** The deadline of each call to After, in order (up to the size of the buffer) */
+	afterCalls chan time.Time
+}
+
+type fakeClockWaiter struct {
+	deadline time.Time
+	channel  chan time.Time
+}
+
+func newFakeClock() *fakeClock {
+	return &fakeClock{
+		now:        time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC),
+		afterCalls: make(chan time.Time, 1000),
+	}
+}
+
+func (clock *fakeClock) Now() time.Time {
+	clock.lock.Lock()
+	defer clock.lock.Unlock()
+
+	return clock.now
+}
+
+func (clock *fakeClock) Sleep(d time.Duration) {
+	clock.Advance(d)
+}
+
+func (clock *fakeClock) After(d time.Duration) <-chan time.Time {
+	clock.lock.Lock()
+	defer clock.lock.Unlock()
+
+	waiter := &fakeClockWaiter{clock.now.Add(d), make(chan time.Time, 1)}
+	clock.waiters = append(clock.waiters, waiter)
+	clock.fireExpiredWaiters()
+
+	// Tests read each deadline with nextAfterCall; benchmarks never read them, so drop them once the buffer is full
+	select {
+	case clock.afterCalls <- waiter.deadline:
+	default:
+	}
+
+	return waiter.channel
+}
+
+/** Move the time forward, firing any waiters whose deadline has been reached. */
+func (clock *fakeClock) Advance(d time.Duration) {
+	clock.lock.Lock()
+	defer clock.lock.Unlock()
+
+	clock.now = clock.now.Add(d)
+	clock.fireExpiredWaiters()
+}
+
+func (clock *fakeClock) fireExpiredWaiters() {
+
+	remaining := []*fakeClockWaiter{}
+	for _, waiter := range clock.waiters {
+		if waiter.deadline.After(clock.now) {
+			remaining = append(remaining, waiter)
+		} else {
+			waiter.channel <- clock.now
+		}
+	}
+	clock.waiters = remaining
+}
+
+/** Wait for the next call to After, and return its deadline. */
+func (clock *fakeClock) nextAfterCall(t *testing.T) time.Time {
+	t.Helper()
+
+	select {
+	case deadline := <-clock.afterCalls:
+		return deadline
+	case <-time.After(5 * time.Second):
+		t.Fatal("Timed out waiting for a timer to be started")
+		return time.Time{}
+	}
+}
+
+/** A batch util using a fake clock, whose batches are observed as cwctl requests on the project list channel (and as POST requests, with a post output queue). */
+type batchUtilTestHarness struct {
+	clock       *fakeClock
+	projectList *ProjectList
+	batchUtil   *FileChangeEventBatchUtil
+	start       time.Time
+}
+
+func newBatchUtilTestHarness(policy BatchPolicy, postOutputQueue *HttpPostOutputQueue) *batchUtilTestHarness {
+
+	if policy.DeliveryMode == "" {
+		policy.DeliveryMode = DeliveryModeCwctl
+	}
+
+	clock := newFakeClock()
+	projectList := &ProjectList{projectOperationChannel: make(chan *projectListChannelMessage, 100)}
+
+	return &batchUtilTestHarness{
+		clock:       clock,
+		projectList: projectList,
+		batchUtil:   newFileChangeEventBatchUtilWithClock("test-project", policy, postOutputQueue, projectList, clock),
+		start:       clock.Now(),
+	}
+}
+
+/** Add a single event, and return the deadline of the batch timer that it (re)started. */
+func (h *batchUtilTestHarness) addEvent(t *testing.T, path string) time.Time {
+	t.Helper()
+
+	entry, err := NewChangedFileEntry(path, "MODIFY", h.clock.Now().UnixNano()/1000000, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	h.batchUtil.AddChangedFiles([]ChangedFileEntry{*entry})
+
+	return h.clock.nextAfterCall(t)
+}
+
+func (h *batchUtilTestHarness) expectBatchSent(t *testing.T) {
+	t.Helper()
+
+	select {
+	case msg := <-h.projectList.projectOperationChannel:
+		if msg.msgType != cliFileChangeUpdate || msg.cliFileChangeUpdateMessage != "test-project" {
+			t.Fatalf("Unexpected project list message: %+v", msg)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Timed out waiting for the batch to be sent")
+	}
+}
+
+func (h *batchUtilTestHarness) expectNoBatchSent(t *testing.T) {
+	t.Helper()
+
+	select {
+	case msg := <-h.projectList.projectOperationChannel:
+		t.Fatalf("Unexpected batch sent: %+v", msg)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+func TestBatchIsSentAfterQuietPeriod(t *testing.T) {
+
+	h := newBatchUtilTestHarness(BatchPolicy{QuietPeriod: time.Second}, nil)
+
+	if deadline := h.addEvent(t, "/a"); !deadline.Equal(h.start.Add(time.Second)) {
+		t.Fatalf("Unexpected deadline: %v", deadline.Sub(h.start))
+	}
+
+	h.clock.Advance(999 * time.Millisecond)
+	h.expectNoBatchSent(t)
+
+	h.clock.Advance(time.Millisecond)
+	h.expectBatchSent(t)
+}
+
+func TestQuietPeriodIsResetByEachEvent(t *testing.T) {
+
+	h := newBatchUtilTestHarness(BatchPolicy{QuietPeriod: time.Second}, nil)
+
+	h.addEvent(t, "/a")
+
+	h.clock.Advance(500 * time.Millisecond)
+	if deadline := h.addEvent(t, "/b"); !deadline.Equal(h.start.Add(1500 * time.Millisecond)) {
+		t.Fatalf("Unexpected deadline: %v", deadline.Sub(h.start))
+	}
+
+	// The timer of the first event has expired, but must not send the batch
+	h.clock.Advance(600 * time.Millisecond)
+	h.expectNoBatchSent(t)
+
+	h.clock.Advance(400 * time.Millisecond)
+	h.expectBatchSent(t)
+}
+
+func TestMaxLatencyLimitsAContinuousStreamOfEvents(t *testing.T) {
+
+	h := newBatchUtilTestHarness(BatchPolicy{QuietPeriod: time.Second, MaxLatency: 2 * time.Second}, nil)
+
+	h.addEvent(t, "/a")
+
+	h.clock.Advance(900 * time.Millisecond)
+	if deadline := h.addEvent(t, "/a"); !deadline.Equal(h.start.Add(1900 * time.Millisecond)) {
+		t.Fatalf("Unexpected deadline: %v", deadline.Sub(h.start))
+	}
+
+	// The quiet period would end at 2.7s, so the deadline is capped at 2s after the first event
+	h.clock.Advance(800 * time.Millisecond)
+	if deadline := h.addEvent(t, "/a"); !deadline.Equal(h.start.Add(2 * time.Second)) {
+		t.Fatalf("Unexpected deadline: %v", deadline.Sub(h.start))
+	}
+
+	h.clock.Advance(300 * time.Millisecond)
+	h.expectBatchSent(t)
+
+	// The next batch starts a new maximum latency window
+	deadline := h.addEvent(t, "/a")
+	if !deadline.Equal(h.clock.Now().Add(time.Second)) {
+		t.Fatalf("Unexpected deadline: %v", deadline.Sub(h.clock.Now()))
+	}
+}
+
+func TestNoMaxLatencyWaitsForQuietPeriod(t *testing.T) {
+
+	h := newBatchUtilTestHarness(BatchPolicy{QuietPeriod: time.Second, MaxLatency: 0}, nil)
+
+	for i := 0; i < 20; i++ {
+		deadline := h.addEvent(t, "/a")
+		if !deadline.Equal(h.clock.Now().Add(time.Second)) {
+			t.Fatalf("Unexpected deadline on event %d: %v", i, deadline.Sub(h.clock.Now()))
+		}
+		h.clock.Advance(900 * time.Millisecond)
+	}
+
+	h.expectNoBatchSent(t)
+
+	h.clock.Advance(100 * time.Millisecond)
+	h.expectBatchSent(t)
+}
+
+func TestMaxBatchSizeSendsImmediately(t *testing.T) {
+
+	h := newBatchUtilTestHarness(BatchPolicy{QuietPeriod: time.Second, MaxBatchSize: 3}, nil)
+
+	h.addEvent(t, "/a")
+	h.addEvent(t, "/b")
+
+	entry, err := NewChangedFileEntry("/c", "CREATE", h.clock.Now().UnixNano()/1000000, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	h.batchUtil.AddChangedFiles([]ChangedFileEntry{*entry})
+
+	h.expectBatchSent(t)
+
+	// The timer of the earlier events must not send an (empty) batch
+	h.clock.Advance(time.Hour)
+	h.expectNoBatchSent(t)
+
+	if count := h.batchUtil.GetPendingEventCount(); count != 0 {
+		t.Fatalf("Unexpected pending event count: %d", count)
+	}
+}
+
+func TestBatchPolicyMaxLatencyOverrides(t *testing.T) {
+
+	zero := int64(0)
+	fiveSeconds := int64(5000)
+	negative := int64(-1)
+
+	tests := []struct {
+		name     string
+		global   time.Duration
+		override *int64
+		expected time.Duration
+	}{
+		{"no override", 10 * time.Second, nil, 10 * time.Second},
+		{"override", 10 * time.Second, &fiveSeconds, 5 * time.Second},
+		{"override to zero disables", 10 * time.Second, &zero, 0},
+		{"override enables", 0, &fiveSeconds, 5 * time.Second},
+		{"negative override is ignored", 10 * time.Second, &negative, 10 * time.Second},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+
+			policy := BatchPolicy{QuietPeriod: time.Second, MaxLatency: test.global}
+			project := &models.ProjectToWatch{ProjectID: "test-project", BatchMaxLatencyMsecs: test.override}
+
+			if result := policy.WithProjectOverrides(project).MaxLatency; result != test.expected {
+				t.Fatalf("Expected %v, got %v", test.expected, result)
+			}
+
+			if clone := project.Clone(); (clone.BatchMaxLatencyMsecs == nil) != (test.override == nil) ||
+				(clone.BatchMaxLatencyMsecs != nil && *clone.BatchMaxLatencyMsecs != *test.override) {
+				t.Fatalf("Clone did not preserve the maximum latency override")
+			}
+		})
+	}
+}
+
+func TestDefaultBatchPolicyHasFiniteMaxLatency(t *testing.T) {
+
+	if value, ok := os.LookupEnv("FILEWATCHER_BATCH_MAX_LATENCY_MS"); ok {
+		defer os.Setenv("FILEWATCHER_BATCH_MAX_LATENCY_MS", value)
+	} else {
+		defer os.Unsetenv("FILEWATCHER_BATCH_MAX_LATENCY_MS")
+	}
+
+	os.Unsetenv("FILEWATCHER_BATCH_MAX_LATENCY_MS")
+	if maxLatency := NewDefaultBatchPolicy().MaxLatency; maxLatency != 10*time.Second {
+		t.Fatalf("Expected a maximum latency of 10s by default, got %v", maxLatency)
+	}
+
+	// The maximum latency may only be disabled per project
+	os.Setenv("FILEWATCHER_BATCH_MAX_LATENCY_MS", "0")
+	if maxLatency := NewDefaultBatchPolicy().MaxLatency; maxLatency != 10*time.Second {
+		t.Fatalf("Expected the global maximum latency to remain 10s, got %v", maxLatency)
+	}
+
+	os.Setenv("FILEWATCHER_BATCH_MAX_LATENCY_MS", "2500")
+	if maxLatency := NewDefaultBatchPolicy().MaxLatency; maxLatency != 2500*time.Millisecond {
+		t.Fatalf("Expected a maximum latency of 2.5s, got %v", maxLatency)
+	}
+}
+
+/** An event type and file type, as received from the watcher, for the coalescing property tests. */
+type coalesceTestEvent struct {
+	eventType string
+	directory bool
+}
+
+var coalesceTestAlphabet = []coalesceTestEvent{
+	{"CREATE", false}, {"MODIFY", false}, {"DELETE", false},
+	{"CREATE", true}, {"MODIFY", true}, {"DELETE", true},
+}
+
+/** The state of a single path, in the reference model */
+type coalesceTestPathState struct {
+	exists    bool
+	directory bool
+}
+
+/** Applies the event to the state, returning false if the event is not possible in that state. */
+func (state *coalesceTestPathState) apply(event coalesceTestEvent) bool {
+
+	switch event.eventType {
+	case "CREATE":
+		if state.exists {
+			return false
+		}
+		state.exists = true
+		state.directory = event.directory
+	case "MODIFY":
+		// The watcher only reports modifications of files
+		if !state.exists || state.directory || event.directory {
+			return false
+		}
+	case "DELETE":
+		if !state.exists || state.directory != event.directory {
+			return false
+		}
+		state.exists = false
+	}
+
+	return true
+}
+
+/**
+ * The reference model: returns the events that a receiver, which last saw the path in its initial state, needs in
+ * order to reach the final state. A file that still exists must be seen as modified; a directory that was deleted
+ * must be seen as deleted (as its contents were deleted with it), as must a path that changed between file and
+ * directory.
+ */
+func expectedNetEffect(initial coalesceTestPathState, events []coalesceTestEvent) []coalesceTestEvent {
+
+	if len(events) == 1 {
+		return events
+	}
+
+	final := initial
+	deleted := false
+	for _, event := range events {
+		final.apply(event)
+		deleted = deleted || event.eventType == "DELETE"
+	}
+
+	switch {
+	case !initial.exists && !final.exists:
+		return nil
+	case !initial.exists:
+		return []coalesceTestEvent{{"CREATE", final.directory}}
+	case !final.exists:
+		return []coalesceTestEvent{{"DELETE", initial.directory}}
+	case initial.directory != final.directory || (final.directory && deleted):
+		return []coalesceTestEvent{{"DELETE", initial.directory}, {"CREATE", final.directory}}
+	default:
+		return []coalesceTestEvent{{"MODIFY", final.directory}}
+	}
+}
+
+/** Calls the function with every valid sequence of events, from every initial state, up to the given length. */
+func forEachValidEventSequence(maxLength int, fn func(initial coalesceTestPathState, events []coalesceTestEvent)) {
+
+	var generate func(initial coalesceTestPathState, current coalesceTestPathState, events []coalesceTestEvent)
+	generate = func(initial coalesceTestPathState, current coalesceTestPathState, events []coalesceTestEvent) {
+
+		if len(events) > 0 {
+			fn(initial, events)
+		}
+		if len(events) == maxLength {
+			return
+		}
+
+		for _, event := range coalesceTestAlphabet {
+			next := current
+			if next.apply(event) {
+				generate(initial, next, append(events[:len(events):len(events)], event))
+			}
+		}
+	}
+
+	for _, initial := range []coalesceTestPathState{{false, false}, {true, false}, {true, true}} {
+		generate(initial, initial, nil)
+	}
+}
+
+func toChangedFileEntries(path string, events []coalesceTestEvent, firstTimestamp int64) []ChangedFileEntry {
+
+	result := []ChangedFileEntry{}
+	for index, event := range events {
+		result = append(result, ChangedFileEntry{path: path, eventType: event.eventType, timestamp: firstTimestamp + int64(index), directory: event.directory})
+	}
+
+	return result
+}
+
+func TestCoalesceEventsMatchesNetEffectModel(t *testing.T) {
+
+	const maxLength = 8
+
+	sequences := 0
+
+	forEachValidEventSequence(maxLength, func(initial coalesceTestPathState, events []coalesceTestEvent) {
+
+		sequences++
+
+		result := coalesceEvents(toChangedFileEntries("/a", events, 1))
+		expected := expectedNetEffect(initial, events)
+
+		if len(result) != len(expected) {
+			t.Fatalf("Initial state %+v, events %v: expected %v, got %+v", initial, events, expected, result)
+		}
+
+		replayed := initial
+		for index, entry := range result {
+
+			if entry.eventType != expected[index].eventType || entry.directory != expected[index].directory {
+				t.Fatalf("Initial state %+v, events %v: expected %v, got %+v", initial, events, expected, result)
+			}
+
+			// The net effect has the timestamp of the last event
+			if entry.path != "/a" || entry.timestamp != int64(len(events)) || entry.recursive {
+				t.Fatalf("Initial state %+v, events %v: unexpected entry %+v", initial, events, entry)
+			}
+
+			// The receiver must be able to apply the result to the initial state
+			if !replayed.apply(coalesceTestEvent{entry.eventType, entry.directory}) {
+				t.Fatalf("Initial state %+v, events %v: result %+v cannot be applied", initial, events, result)
+			}
+		}
+
+		final := initial
+		for _, event := range events {
+			final.apply(event)
+		}
+
+		if replayed.exists != final.exists || (final.exists && replayed.directory != final.directory) {
+			t.Fatalf("Initial state %+v, events %v: result %+v leads to %+v rather than %+v", initial, events, result, replayed, final)
+		}
+	})
+
+	if sequences == 0 {
+		t.Fatal("No sequences were generated")
+	}
+}
+
+func TestCoalesceEventsOfInterleavedPaths(t *testing.T) {
+
+	type pathSequence struct {
+		initial coalesceTestPathState
+		events  []coalesceTestEvent
+	}
+
+	sequences := []pathSequence{}
+	forEachValidEventSequence(3, func(initial coalesceTestPathState, events []coalesceTestEvent) {
+		sequences = append(sequences, pathSequence{initial, events})
+	})
+
+	for _, first := range sequences {
+		for _, second := range sequences {
+
+			// Interleave the two sequences, alternating between the paths
+			entries := []ChangedFileEntry{}
+			timestamp := int64(1)
+			lastTimestamps := map[string]int64{}
+			for index := 0; index < len(first.events) || index < len(second.events); index++ {
+				if index < len(first.events) {
+					entries = append(entries, toChangedFileEntries("/a", first.events[index:index+1], timestamp)...)
+					lastTimestamps["/a"] = timestamp
+					timestamp++
+				}
+				if index < len(second.events) {
+					entries = append(entries, toChangedFileEntries("/b", second.events[index:index+1], timestamp)...)
+					lastTimestamps["/b"] = timestamp
+					timestamp++
+				}
+			}
+
+			result := coalesceEvents(entries)
+
+			// Each path has its own net effect, regardless of the events of the other path
+			counts := map[string]int{}
+			for index, entry := range result {
+				counts[entry.path]++
+
+				if entry.timestamp != lastTimestamps[entry.path] {
+					t.Fatalf("Unexpected timestamp for %+v, expected %d", entry, lastTimestamps[entry.path])
+				}
+
+				if index > 0 && result[index-1].timestamp > entry.timestamp {
+					t.Fatalf("Result is not sorted by timestamp: %+v", result)
+				}
+			}
+
+			if counts["/a"] != len(expectedNetEffect(first.initial, first.events)) ||
+				counts["/b"] != len(expectedNetEffect(second.initial, second.events)) {
+				t.Fatalf("Events %v and %v: unexpected result %+v", first.events, second.events, result)
+			}
+		}
+	}
+}
+
+func TestCoalesceEventsOfArbitrarySequences(t *testing.T) {
+
+	// The watcher may report sequences that are not possible (for example, when events race with a directory walk),
+	// so every sequence must still be reduced to at most a DELETE and a CREATE, with the timestamp of the last event.
+	const maxLength = 5
+
+	var generate func(events []coalesceTestEvent)
+	generate = func(events []coalesceTestEvent) {
+
+		if len(events) > 0 {
+			result := coalesceEvents(toChangedFileEntries("/a", events, 1))
+
+			if len(result) > 2 || (len(result) == 2 && (result[0].eventType != "DELETE" || result[1].eventType != "CREATE")) {
+				t.Fatalf("Events %v: unexpected result %+v", events, result)
+			}
+
+			for _, entry := range result {
+				if entry.timestamp != int64(len(events)) {
+					t.Fatalf("Events %v: unexpected timestamp in %+v", events, result)
+				}
+			}
+		}
+
+		if len(events) == maxLength {
+			return
+		}
+
+		for _, event := range coalesceTestAlphabet {
+			generate(append(events[:len(events):len(events)], event))
+		}
+	}
+
+	generate(nil)
+}
@@ -0,0 +1,146 @@
+/*******************************************************************************
+* Copyright (c) 2020 IBM Corporation and others.
+* All rights reserved. This program and the accompanying materials
+* are made available under the terms of the Eclipse Public License v2.0
+* which accompanies this distribution, and is available at
+* http://www.eclipse.org/legal/epl-v20.html
+*
+* Contributors:
+*     IBM Corporation - initial API and implementation
+*******************************************************************************/
+
+package main
+
+import (
+	"codewind/utils"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+/**
+ * Compact the (coalesced, sorted) events of a batch with compactDirectoryEvents, if compaction is enabled by the
+ * policy and the batch has at least the policy's minimum number of events; otherwise the events are returned as is.
+ */
+func compactBatchEvents(entries []ChangedFileEntry, policy BatchPolicy) []ChangedFileEntry {
+
+	if policy.CompactionMinSubtreeSize <= 0 || len(entries) < policy.CompactionMinBatchSize {
+		return entries
+	}
+
+	return compactDirectoryEvents(entries, policy.CompactionMinSubtreeSize)
+}
+
+/**
+ * When a large directory tree is created or deleted (for example, by unzipping an archive, or running
+ * 'npm install'), the watch service reports a CREATE/DELETE for every file and directory in that tree.
+ *
+ * This function collapses each such subtree into a single CREATE/DELETE event on the directory itself, with the
+ * 'recursive' flag set. A directory is only compacted if:
+ * - The batch contains a CREATE (or DELETE) event for the directory itself.
+ * - Every event in the batch under that directory is of the same type as the directory event.
+ * - There are at least 'minSubtreeSize' events under that directory.
+ *
+ * Only the top-most directory of a compactable subtree is kept. The compacted event takes the most recent timestamp
+ * of the events it replaces. The parameter must be coalesced (at most one event per path, except for a
+ * DELETE+CREATE pair), and sorted ascending by timestamp; the result is likewise sorted.
+ */
+func compactDirectoryEvents(entries []ChangedFileEntry, minSubtreeSize int) []ChangedFileEntry {
+
+	if minSubtreeSize <= 0 || len(entries) <= minSubtreeSize {
+		return entries
+	}
+
+	// Indices into 'entries', sorted by path; all of the paths under a directory are thus contiguous.
+	byPath := make([]int, len(entries))
+	for x := range byPath {
+		byPath[x] = x
+	}
+	sort.SliceStable(byPath, func(i, j int) bool {
+		return entries[byPath[i]].path < entries[byPath[j]].path
+	})
+
+	/* index into 'entries' -> true, if the entry was absorbed into a recursive directory event */
+	absorbed := make(map[int]bool)
+
+	/* index into 'entries' -> the compacted directory event that replaces it */
+	compacted := make(map[int]ChangedFileEntry)
+
+	for pos, index := range byPath {
+
+		dir := entries[index]
+
+		if absorbed[index] || !dir.directory || (dir.eventType != "CREATE" && dir.eventType != "DELETE") {
+			continue
+		}
+
+		prefix := dir.path
+		if !strings.HasSuffix(prefix, "/") {
+			prefix += "/"
+		}
+
+		// Find the range of paths under the directory
+		start := pos + 1 + sort.Search(len(byPath)-pos-1, func(i int) bool {
+			return entries[byPath[pos+1+i]].path >= prefix
+		})
+
+		end := start
+		matches := true
+		mostRecentTimestamp := dir.timestamp
+
+		for ; end < len(byPath) && strings.HasPrefix(entries[byPath[end]].path, prefix); end++ {
+			child := entries[byPath[end]]
+			if child.eventType != dir.eventType {
+				matches = false
+				break
+			}
+			if child.timestamp > mostRecentTimestamp {
+				mostRecentTimestamp = child.timestamp
+			}
+		}
+
+		if !matches || end-start < minSubtreeSize {
+			continue
+		}
+
+		for x := start; x < end; x++ {
+			absorbed[byPath[x]] = true
+		}
+
+		compacted[index] = ChangedFileEntry{
+			path:      dir.path,
+			eventType: dir.eventType,
+			timestamp: mostRecentTimestamp,
+			directory: true,
+			recursive: true,
+		}
+
+		utils.LogDebug("Compacted " + strconv.Itoa(end-start) + " " + dir.eventType + " events under directory " + dir.path)
+	}
+
+	if len(compacted) == 0 {
+		return entries
+	}
+
+	result := make([]ChangedFileEntry, 0, len(entries)-len(absorbed))
+
+	for index, entry := range entries {
+		if absorbed[index] {
+			continue
+		}
+
+		if replacement, exists := compacted[index]; exists {
+			result = append(result, replacement)
+		} else {
+			result = append(result, entry)
+		}
+	}
+
+	sort.SliceStable(result, func(i, j int) bool {
+		return result[i].timestamp < result[j].timestamp
+	})
+
+	utils.LogDebug("Directory compaction reduced " + strconv.Itoa(len(entries)) + " events to " + strconv.Itoa(len(result)))
+
+	return result
+}
@@ -0,0 +1,195 @@
+/*******************************************************************************
+* Copyright (c) 2020 IBM Corporation and others.
+* All rights reserved. This program and the accompanying materials
+* are made available under the terms of the Eclipse Public License v2.0
+* which accompanies this distribution, and is available at
+* http://www.eclipse.org/legal/epl-v20.html
+*
+* Contributors:
+*     IBM Corporation - initial API and implementation
+*******************************************************************************/
+
+package main
+
+import (
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+/**
+ * Returns the entries described by the given strings, each of the form "<event type> <path> <timestamp> [dir]";
+ * the entries must be given in ascending timestamp order.
+ */
+func compactionTestEntries(t *testing.T, descriptions ...string) []ChangedFileEntry {
+	t.Helper()
+
+	result := []ChangedFileEntry{}
+
+	for _, description := range descriptions {
+		fields := strings.Fields(description)
+
+		timestamp, err := strconv.ParseInt(fields[2], 10, 64)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		result = append(result, ChangedFileEntry{
+			path:      fields[1],
+			eventType: fields[0],
+			timestamp: timestamp,
+			directory: len(fields) > 3 && fields[3] == "dir",
+		})
+	}
+
+	return result
+}
+
+/** Returns a description of each entry, as accepted by compactionTestEntries, with " recursive" for recursive entries. */
+func describeCompactionTestEntries(entries []ChangedFileEntry) []string {
+
+	result := []string{}
+
+	for _, entry := range entries {
+		description := entry.eventType + " " + entry.path + " " + strconv.FormatInt(entry.timestamp, 10)
+		if entry.directory {
+			description += " dir"
+		}
+		if entry.recursive {
+			description += " recursive"
+		}
+		result = append(result, description)
+	}
+
+	return result
+}
+
+func TestCompactDirectoryEvents(t *testing.T) {
+
+	tests := []struct {
+		name           string
+		minSubtreeSize int
+		entries        []string
+		expected       []string
+	}{
+		{
+			name:           "single subtree",
+			minSubtreeSize: 2,
+			entries:        []string{"CREATE /a 1 dir", "CREATE /a/1 2", "CREATE /a/2 3"},
+			expected:       []string{"CREATE /a 3 dir recursive"},
+		},
+		{
+			name:           "sibling subtrees",
+			minSubtreeSize: 2,
+			entries: []string{"CREATE /a 1 dir", "CREATE /b 2 dir", "CREATE /a/1 3", "CREATE /b/1 4", "CREATE /a/2 5",
+				"CREATE /b/2 6", "MODIFY /c 7"},
+			expected: []string{"CREATE /a 5 dir recursive", "CREATE /b 6 dir recursive", "MODIFY /c 7"},
+		},
+		{
+			name:           "only the top-most directory is kept",
+			minSubtreeSize: 2,
+			entries:        []string{"DELETE /a/b/1 1", "DELETE /a/b/2 2", "DELETE /a/b 3 dir", "DELETE /a 4 dir"},
+			expected:       []string{"DELETE /a 4 dir recursive"},
+		},
+		{
+			name:           "mixed event types under one prefix",
+			minSubtreeSize: 2,
+			entries:        []string{"CREATE /a 1 dir", "CREATE /a/1 2", "MODIFY /a/2 3", "CREATE /a/3 4"},
+			expected:       []string{"CREATE /a 1 dir", "CREATE /a/1 2", "MODIFY /a/2 3", "CREATE /a/3 4"},
+		},
+		{
+			name:           "mixed event types under a parent do not prevent compaction of a child",
+			minSubtreeSize: 2,
+			entries: []string{"CREATE /a 1 dir", "CREATE /a/b 2 dir", "CREATE /a/b/1 3", "CREATE /a/b/2 4",
+				"DELETE /a/c 5"},
+			expected: []string{"CREATE /a 1 dir", "CREATE /a/b 4 dir recursive", "DELETE /a/c 5"},
+		},
+		{
+			name:           "prefix but not parent",
+			minSubtreeSize: 2,
+			entries: []string{"CREATE /a/b 1 dir", "CREATE /a/b/1 2", "MODIFY /a/bc 3", "CREATE /a/b/2 4",
+				"CREATE /a/bc.txt 5"},
+			expected: []string{"MODIFY /a/bc 3", "CREATE /a/b 4 dir recursive", "CREATE /a/bc.txt 5"},
+		},
+		{
+			name:           "prefix but not parent is not absorbed",
+			minSubtreeSize: 1,
+			entries:        []string{"CREATE /a/b 1 dir", "CREATE /a/b/1 2", "CREATE /a/bc 3", "CREATE /a/bc/1 4"},
+			expected:       []string{"CREATE /a/b 2 dir recursive", "CREATE /a/bc 3", "CREATE /a/bc/1 4"},
+		},
+		{
+			name:           "subtree below the minimum size",
+			minSubtreeSize: 3,
+			entries:        []string{"CREATE /a 1 dir", "CREATE /a/1 2", "CREATE /a/2 3", "CREATE /b 4"},
+			expected:       []string{"CREATE /a 1 dir", "CREATE /a/1 2", "CREATE /a/2 3", "CREATE /b 4"},
+		},
+		{
+			name:           "subtree at the minimum size",
+			minSubtreeSize: 3,
+			entries:        []string{"CREATE /a 1 dir", "CREATE /a/1 2", "CREATE /a/2 3", "CREATE /a/3 4"},
+			expected:       []string{"CREATE /a 4 dir recursive"},
+		},
+		{
+			name:           "no event for the directory itself",
+			minSubtreeSize: 2,
+			entries:        []string{"CREATE /a/1 1", "CREATE /a/2 2", "CREATE /a/3 3"},
+			expected:       []string{"CREATE /a/1 1", "CREATE /a/2 2", "CREATE /a/3 3"},
+		},
+		{
+			name:           "modified directory is not compacted",
+			minSubtreeSize: 2,
+			entries:        []string{"MODIFY /a 1 dir", "MODIFY /a/1 2", "MODIFY /a/2 3"},
+			expected:       []string{"MODIFY /a 1 dir", "MODIFY /a/1 2", "MODIFY /a/2 3"},
+		},
+		{
+			name:           "batch no larger than the minimum subtree size",
+			minSubtreeSize: 3,
+			entries:        []string{"CREATE /a 1 dir", "CREATE /a/1 2", "CREATE /a/2 3"},
+			expected:       []string{"CREATE /a 1 dir", "CREATE /a/1 2", "CREATE /a/2 3"},
+		},
+		{
+			name:           "disabled",
+			minSubtreeSize: 0,
+			entries:        []string{"CREATE /a 1 dir", "CREATE /a/1 2", "CREATE /a/2 3"},
+			expected:       []string{"CREATE /a 1 dir", "CREATE /a/1 2", "CREATE /a/2 3"},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			result := compactDirectoryEvents(compactionTestEntries(t, test.entries...), test.minSubtreeSize)
+
+			if actual := describeCompactionTestEntries(result); !reflect.DeepEqual(actual, test.expected) {
+				t.Fatalf("Unexpected result:\n  %s\nexpected:\n  %s", strings.Join(actual, "\n  "), strings.Join(test.expected, "\n  "))
+			}
+		})
+	}
+}
+
+func TestCompactBatchEventsAppliesPolicyThresholds(t *testing.T) {
+
+	entries := []string{"CREATE /a 1 dir", "CREATE /a/1 2", "CREATE /a/2 3", "CREATE /a/3 4"}
+	compacted := []string{"CREATE /a 4 dir recursive"}
+
+	tests := []struct {
+		name     string
+		policy   BatchPolicy
+		expected []string
+	}{
+		{"batch below the minimum batch size", BatchPolicy{CompactionMinSubtreeSize: 2, CompactionMinBatchSize: 5}, entries},
+		{"batch at the minimum batch size", BatchPolicy{CompactionMinSubtreeSize: 2, CompactionMinBatchSize: 4}, compacted},
+		{"no minimum batch size", BatchPolicy{CompactionMinSubtreeSize: 2}, compacted},
+		{"compaction disabled", BatchPolicy{CompactionMinBatchSize: 1}, entries},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			result := compactBatchEvents(compactionTestEntries(t, entries...), test.policy)
+
+			if actual := describeCompactionTestEntries(result); !reflect.DeepEqual(actual, test.expected) {
+				t.Fatalf("Unexpected result: %v, expected %v", actual, test.expected)
+			}
+		})
+	}
+}
@@ -12,13 +12,10 @@
 package main
 
 import (
-	"bytes"
 	"codewind/models"
 	"codewind/utils"
-	"crypto/tls"
 	"io/ioutil"
 	"math/rand"
-	"net/http"
 	"os"
 	"strconv"
 	"strings"
@@ -41,6 +38,18 @@ import (
 type WatchService struct {
 	watchServiceChannel chan *WatchServiceChannelMessage
 	clientUUID          string
+
+	/** Watch events are accumulated for up to this long, before they are passed to the project list as a single list */
+	eventDeliveryWindow time.Duration
+
+	/** Accumulated watch events are passed to the project list immediately once there are at least this many */
+	eventDeliveryMaxEntries int
+
+	/** Reports the success/failure of each project's initial watch to the server */
+	statusReporter *WatchStatusReporter
+
+	/** The fsnotify watchers, which are shared with the watch services of other server connections */
+	watcherPool *SharedWatcherPool
 }
 
 /** Only one of the fields of this struct should be non-nil per instance */
@@ -48,12 +57,23 @@ type WatchServiceChannelMessage struct {
 	addOrRemove         *AddRemoveRootPathChannelMessage
 	directoryWaitResult *WatchDirectoryWaitResultMessage
 	debugMessage        *FsNotifyDebugMessage
+	healthMessage       *FsNotifyHealthMessage
 }
 
 type FsNotifyDebugMessage struct {
 	responseChannel chan string
 }
 
+type FsNotifyHealthMessage struct {
+	responseChannel chan map[string] /* project id -> */ *watcherHealth
+}
+
+/** The state of a single project's watcher, as reported in health reports */
+type watcherHealth struct {
+	open               bool
+	watchedDirectories int
+}
+
 type AddRemoveRootPathChannelMessage struct {
 	isAdd   bool
 	path    string
@@ -67,11 +87,15 @@ type WatchDirectoryWaitResultMessage struct {
 	success bool
 }
 
-func NewWatchService(projectList *ProjectList, baseUrl string, clientUUID string) *WatchService {
+func NewWatchService(projectList *ProjectList, baseUrl string, clientUUID string, watcherPool *SharedWatcherPool) *WatchService {
 
 	result := &WatchService{
 		make(chan *WatchServiceChannelMessage),
 		clientUUID,
+		time.Duration(utils.GetEnvInt64("FILEWATCHER_EVENT_DELIVERY_WINDOW_MS", 50)) * time.Millisecond,
+		int(utils.GetEnvInt64("FILEWATCHER_EVENT_DELIVERY_MAX_ENTRIES", 1000)),
+		NewWatchStatusReporter(baseUrl, clientUUID),
+		watcherPool,
 	}
 
 	go watchServiceEventLoop(result, projectList, baseUrl)
@@ -130,6 +154,19 @@ func (service *WatchService) RequestDebugMessage() chan string {
 	return responseChannel
 }
 
+/** Returns the state of the watcher of each project, for health reports */
+func (service *WatchService) RequestHealth() chan map[string]*watcherHealth {
+	responseChannel := make(chan map[string]*watcherHealth)
+
+	msgPackage := &WatchServiceChannelMessage{
+		healthMessage: &FsNotifyHealthMessage{responseChannel},
+	}
+
+	service.watchServiceChannel <- msgPackage
+
+	return responseChannel
+}
+
 func watchServiceEventLoop(publicObject *WatchService, projectList *ProjectList, baseURL string) {
 
 	/* key: project ID */
@@ -148,7 +185,7 @@ func watchServiceEventLoop(publicObject *WatchService, projectList *ProjectList,
 				if addOrRemoveRootPathMsg.isAdd {
 					addRootPathInternal_step1(addOrRemoveRootPathMsg, watchedProjects, projectList, baseURL, publicObject)
 				} else {
-					removeRootPathInternal(addOrRemoveRootPathMsg, watchedProjects)
+					removeRootPathInternal(addOrRemoveRootPathMsg, watchedProjects, publicObject)
 				}
 			}
 
@@ -193,6 +230,21 @@ func watchServiceEventLoop(publicObject *WatchService, projectList *ProjectList,
 
 				responseChannel <- result
 			}
+
+			if watchServiceMessage.healthMessage != nil {
+				result := make(map[string]*watcherHealth)
+
+				for projectID, val := range watchedProjects {
+					val.lock.Lock()
+					result[projectID] = &watcherHealth{
+						open:               val.open_synch_lock && !val.closed_synch_lock,
+						watchedDirectories: val.watchedDirectoryCount_synch_lock,
+					}
+					val.lock.Unlock()
+				}
+
+				watchServiceMessage.healthMessage.responseChannel <- result
+			}
 		}
 
 	}
@@ -222,9 +274,11 @@ func addRootPathInternal_step1(addMsg *AddRemoveRootPathChannelMessage, watchedP
 		false,
 		false,
 		"",
+		0,
 		&sync.Mutex{},
 		make(map[string]bool),
 		make(map[string]bool),
+		make(map[string]bool),
 	}
 
 	watchedProjects[project.ProjectID] = watcher
@@ -314,7 +368,7 @@ func waitForWatchedPathSuccess(path string, projectToWatch *models.ProjectToWatc
 /** Close an old watcher, either because the project is no longer being watched, or the filters have been updated. */
 func closeWatcherIfNeeded(existing *CodewindWatcher) {
 
-	var watcherToClose *fsnotify.Watcher
+	var watcherToClose *sharedWatcherHandle
 
 	existing.lock.Lock()
 	if !existing.closed_synch_lock {
@@ -337,10 +391,13 @@ func closeWatcherIfNeeded(existing *CodewindWatcher) {
 	}
 }
 
-func removeRootPathInternal(removeMsg *AddRemoveRootPathChannelMessage, watchedProjects map[string]*CodewindWatcher) {
+func removeRootPathInternal(removeMsg *AddRemoveRootPathChannelMessage, watchedProjects map[string]*CodewindWatcher, service *WatchService) {
 
 	projectID := removeMsg.project.ProjectID
 
+	// The server no longer needs the status of the previous watch
+	service.statusReporter.CancelReports(projectID)
+
 	existing, exists := watchedProjects[projectID]
 	if exists {
 		utils.LogInfo("Removing project " + projectID + " with root path " + removeMsg.path)
@@ -354,8 +411,8 @@ func removeRootPathInternal(removeMsg *AddRemoveRootPathChannelMessage, watchedP
 
 /** Only immutable objects (id, rootPath), or lockable objects, should be accessed across threads */
 type CodewindWatcher struct {
-	fsnotifyWatcher *fsnotify.Watcher /* reference to notify api */
-	rootPath        string            /* root directory of the path*/
+	fsnotifyWatcher *sharedWatcherHandle /* reference to the (shared) notify api */
+	rootPath        string               /* root directory of the path*/
 	id              string
 
 	/* whether the watcher is closed, and therefore events can be ignored, lock on  */
@@ -367,6 +424,9 @@ type CodewindWatcher struct {
 	/* every X minutes, the state of the watcher is stored in this string, for thread-safe use by the debug thread. */
 	latest_debug_state_lock string
 
+	/* the number of directories currently watched (the size of watchedDirMap), for thread-safe use by the health report */
+	watchedDirectoryCount_synch_lock int
+
 	/** Acquire this before reading/writing any of the above _lock variables. */
 	lock *sync.Mutex
 
@@ -375,12 +435,33 @@ type CodewindWatcher struct {
 
 	/** The last time we saw this existing, was it a file or a dir; used to handle directory deletion case*/
 	isDirMap map[string] /*path -> is directory */ bool
+
+	/** The files whose latest CREATE/MODIFY was filtered out by the size/type/content ignore rules */
+	filteredOutFileMap map[string] /*path -> */ bool
+}
+
+/** Copy the size of watchedDirMap into a lockable field; call this from the goroutine that modified watchedDirMap. */
+func (cWatcher *CodewindWatcher) updateWatchedDirectoryCount() {
+	count := len(cWatcher.watchedDirMap)
+
+	cWatcher.lock.Lock()
+	cWatcher.watchedDirectoryCount_synch_lock = count
+	cWatcher.lock.Unlock()
 }
 
 /** Do an initial directory scan to add the new project directory, and kick off the goroutine to handle watcher events.  */
 func startWatcher(cWatcher *CodewindWatcher, path string, projectList *ProjectList, service *WatchService, project *models.ProjectToWatch) error {
 
-	watcher, err := fsnotify.NewWatcher()
+	// The size/type/content ignore rules of the project are applied by the watcher goroutine (through the handle of
+	// the shared watcher), as they require reading from the file system; the remaining (path-based) filters are
+	// applied by the project list.
+	attributeFilter, err := utils.NewPathFilter(project)
+	if err != nil {
+		utils.LogSevereErr("Could not create file attribute filter for "+project.ProjectID, err)
+		attributeFilter = nil
+	}
+
+	watcher, err := service.watcherPool.Subscribe(path, attributeFilter)
 
 	if err != nil {
 		return err
@@ -398,8 +479,36 @@ func startWatcher(cWatcher *CodewindWatcher, path string, projectList *ProjectLi
 
 		debugUpdateTimer := time.NewTicker(10 * time.Minute)
 
+		// Watch events that have not yet been passed to the project list; these are delivered as a single list
+		// once the delivery window has elapsed (or the list is large enough), rather than one at a time.
+		pendingEntries := make([]*models.WatchEventEntry, 0)
+
+		// Non-nil only while there are pending entries
+		var deliveryTimerChan <-chan time.Time
+
+		deliverPendingEntries := func() {
+			deliveryTimerChan = nil
+			if len(pendingEntries) == 0 {
+				return
+			}
+
+			cWatcher.lock.Lock()
+			isClosed := cWatcher.closed_synch_lock
+			cWatcher.lock.Unlock()
+
+			if isClosed {
+				utils.LogDebug("Ignoring " + strconv.Itoa(len(pendingEntries)) + " pending events on closed watcher: " + cWatcher.rootPath)
+			} else {
+				projectList.ReceiveNewWatchEventEntries(pendingEntries, project)
+			}
+			pendingEntries = make([]*models.WatchEventEntry, 0)
+		}
+
 		for {
 			select {
+			case <-deliveryTimerChan:
+				deliverPendingEntries()
+
 			case event, ok := <-watcher.Events:
 
 				if utils.IsLogDebug() {
@@ -476,6 +585,11 @@ func startWatcher(cWatcher *CodewindWatcher, path string, projectList *ProjectLi
 								newEvent, err := newWatchEventEntry("CREATE", val, false)
 								cWatcher.isDirMap[val] = false
 
+								if err == nil && watcher.isFilteredOutByFileAttributes(val) {
+									cWatcher.filteredOutFileMap[val] = true
+									continue
+								}
+
 								if err == nil {
 									watchEventEntries = append(watchEventEntries, newEvent)
 								} else {
@@ -502,6 +616,7 @@ func startWatcher(cWatcher *CodewindWatcher, path string, projectList *ProjectLi
 						utils.LogDebug("Removing directory watch: " + event.Name)
 						watcher.Remove(event.Name)
 						delete(cWatcher.watchedDirMap, event.Name)
+						cWatcher.updateWatchedDirectoryCount()
 						changeType = "DELETE"
 
 						// If the directory being removed is the project directory itself, then stop the watcher
@@ -530,10 +645,12 @@ func startWatcher(cWatcher *CodewindWatcher, path string, projectList *ProjectLi
 				}
 
 				if len(watchEventEntries) > 0 {
-					for _, val := range watchEventEntries {
-						utils.LogDebug("WatchEventEntry (dir): " + val.EventType + " " + val.Path + " " + strconv.FormatBool(val.IsDir))
-						projectList.ReceiveNewWatchEventEntries(val, project)
+					if utils.IsLogDebug() {
+						for _, val := range watchEventEntries {
+							utils.LogDebug("WatchEventEntry (dir): " + val.EventType + " " + val.Path + " " + strconv.FormatBool(val.IsDir))
+						}
 					}
+					pendingEntries = append(pendingEntries, watchEventEntries...)
 				}
 
 				if changeType != "" {
@@ -544,11 +661,32 @@ func startWatcher(cWatcher *CodewindWatcher, path string, projectList *ProjectLi
 					}
 					if err != nil {
 						utils.LogSevereErr("Unexpected file path conversion error", err)
+					} else if !isDir && watcher.isFilteredOutByFileAttributes(event.Name) {
+						// Filtered out by the project's size/type/content ignore rules. A MODIFY that causes a file to be
+						// filtered out (for example, by growing past the size limit) is reported as a DELETE, so that the
+						// server does not keep the earlier version of the file; later MODIFYs of the file are ignored.
+						if changeType == "MODIFY" && !cWatcher.filteredOutFileMap[event.Name] {
+							newEvent.EventType = "DELETE"
+							utils.LogDebug("WatchEventEntry: DELETE (filtered out on MODIFY) " + event.Name + " " + cWatcher.id)
+							pendingEntries = append(pendingEntries, newEvent)
+						}
+						if changeType == "DELETE" {
+							delete(cWatcher.filteredOutFileMap, event.Name)
+						} else {
+							cWatcher.filteredOutFileMap[event.Name] = true
+						}
 					} else {
+						delete(cWatcher.filteredOutFileMap, event.Name)
 						utils.LogDebug("WatchEventEntry: " + changeType + " " + event.Name + " " + strconv.FormatBool(isDir) + " " + cWatcher.id)
-						projectList.ReceiveNewWatchEventEntries(newEvent, project)
+						pendingEntries = append(pendingEntries, newEvent)
 					}
 				}
+
+				if len(pendingEntries) >= service.eventDeliveryMaxEntries || service.eventDeliveryWindow <= 0 {
+					deliverPendingEntries()
+				} else if len(pendingEntries) > 0 && deliveryTimerChan == nil {
+					deliveryTimerChan = time.After(service.eventDeliveryWindow)
+				}
 			case err, ok := <-watcher.Errors:
 
 				cWatcher.lock.Lock()
@@ -645,6 +783,7 @@ func walkPathAndAddInternal(path string, cWatcher *CodewindWatcher, newFilesFoun
 		strList = append(strList, path)
 
 		cWatcher.watchedDirMap[path] = true
+		cWatcher.updateWatchedDirectoryCount()
 		err := cWatcher.fsnotifyWatcher.Add(path)
 		utils.LogDebug("Added watch: " + path)
 		if err != nil {
@@ -690,73 +829,13 @@ func newWatchEventEntry(eventType string, path string, isDir bool) (*models.Watc
 	}, nil
 }
 
-/** Start a new goroutine to communicate to the server the success/failure of the initial watch. */
+/** Inform the CLI on watch success (if needed), and queue a report to the server of the success/failure of the initial watch. */
 func informWatchSuccessStatus(ptw *models.ProjectToWatch, success bool, baseURL string, service *WatchService, projectList *ProjectList) {
 
-	go func() {
-
-		if success {
-			// Inform the CLI on watch success, if needed
-			projectList.CLIFileChangeUpdate(ptw.ProjectID)
-		}
-
-		successVal := "true"
-
-		backoffUtil := utils.NewExponentialBackoff()
-
-		if !success {
-			successVal = "false"
-		}
-
-		url := baseURL + "/api/v1/projects/" + ptw.ProjectID + "/file-changes/" + ptw.ProjectWatchStateID + "/status?clientUuid=" + service.clientUUID
-
-		passed := false
-
-		for !passed {
-			utils.LogDebug("Sending PUT request to " + url)
-
-			tr := &http.Transport{
-				TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
-			}
-
-			client := &http.Client{Transport: tr}
-
-			buffer := bytes.NewBufferString("{\"success\" : " + successVal + " }")
-			req, err := http.NewRequest(http.MethodPut, url, buffer)
-
-			req.Header.Set("Content-Type", "application/json")
-
-			if err != nil {
-				utils.LogErrorErr("Error from PUT request ", err)
-				backoffUtil.SleepAfterFail()
-				backoffUtil.FailIncrease()
-				passed = false
-				continue
-			}
-
-			resp, err := client.Do(req)
-			if err != nil {
-				utils.LogErrorErr("Error from PUT request ", err)
-				backoffUtil.SleepAfterFail()
-				backoffUtil.FailIncrease()
-				passed = false
-				continue
-			}
-
-			if resp.StatusCode != 200 {
-				utils.LogError("Status code request from PUT was not 200 - " + strconv.Itoa(resp.StatusCode))
-				backoffUtil.SleepAfterFail()
-				backoffUtil.FailIncrease()
-				passed = false
-				continue
-			}
-
-			passed = true
-
-		}
-
-		utils.LogInfo("Successfully informed server of watch state for " + ptw.ProjectID + ", watch-state-id: " + ptw.ProjectWatchStateID + ", success: " + successVal)
-
-	}()
+	if success {
+		// Inform the CLI on watch success, if needed
+		go projectList.CLIFileChangeUpdate(ptw.ProjectID)
+	}
 
+	service.statusReporter.ReportStatus(ptw.ProjectID, ptw.ProjectWatchStateID, success)
 }
@@ -1,7 +1,11 @@
 module codewind
 
-go 1.12
+go 1.22
 
 require github.com/fsnotify/fsnotify v1.4.7
 
 require github.com/gorilla/websocket v1.4.0
+
+require github.com/klauspost/compress v1.18.0
+
+require golang.org/x/sys v0.30.0 // indirect
@@ -14,11 +14,12 @@ package main
 import (
 	"codewind/models"
 	"codewind/utils"
-	"crypto/tls"
 	"encoding/json"
 	"errors"
 	"io/ioutil"
 	"net/http"
+	"reflect"
+	"sort"
 	"strconv"
 	"strings"
 	"time"
@@ -38,10 +39,27 @@ import (
  * class with the data from the GET request (containing any project watch
  * updates received) as output.
  *
+ * GET requests are conditional: the ETag and Last-Modified headers of the last
+ * successful response are sent back to the server (If-None-Match and
+ * If-Modified-Since), and if the server responds with 304 Not Modified, the
+ * project list is not updated. Rather than logging each full response, a summary
+ * of the projects added/removed/changed since the last response is logged.
  */
 type HttpGetStatusThread struct {
 	refreshStatusChan chan interface{}
 	baseURL           string
+
+	/** Used by every GET request, so that connections to the server are reused */
+	client *http.Client
+}
+
+/** The most recent successful watchlist response; only used by the GET status thread. */
+type watchlistCache struct {
+	etag         string
+	lastModified string
+
+	/** The projects of the most recent response, used to summarize the changes in the next response */
+	projects map[string] /* project id -> */ models.ProjectToWatch
 }
 
 /**
@@ -60,7 +78,7 @@ func NewHttpGetStatusThread(baseURL string, projectList *ProjectList) (*HttpGetS
 	baseURL = utils.StripTrailingForwardSlash(baseURL)
 
 	if !utils.IsValidURLBase(baseURL) {
-		return nil, errors.New("URL is invalid: " + baseURL)
+		return nil, errors.New("URL is invalid: " + utils.RedactURL(baseURL))
 	}
 
 	reconnectNeeded := make(chan interface{})
@@ -68,6 +86,7 @@ func NewHttpGetStatusThread(baseURL string, projectList *ProjectList) (*HttpGetS
 	result := &HttpGetStatusThread{
 		reconnectNeeded,
 		baseURL,
+		utils.NewHTTPClient(baseURL),
 	}
 
 	go runGetStatusThread(result, projectList)
@@ -91,7 +110,9 @@ func NewHttpGetStatusThread(baseURL string, projectList *ProjectList) (*HttpGetS
 func runGetStatusThread(data *HttpGetStatusThread, projectList *ProjectList) {
 	utils.LogInfo("Http GET status thread started.")
 
-	backoff := utils.NewExponentialBackoff()
+	backoff := utils.NewDefaultReconnectBackoff()
+
+	cache := &watchlistCache{}
 
 	for {
 		// Wait for at least one request
@@ -101,13 +122,12 @@ func runGetStatusThread(data *HttpGetStatusThread, projectList *ProjectList) {
 		success := false
 		for !success {
 
-			err := doGetRequest(data.baseURL, backoff.GetFailureDelay(), projectList)
+			err := doGetRequest(data.client, data.baseURL, projectList, cache)
 			if err != nil {
 				utils.LogErrorErr("Error from GET request", err)
 				backoff.SleepAfterFail()
-				backoff.FailIncrease()
 			} else {
-				backoff.SuccessReset()
+				backoff.Reset()
 				success = true
 			}
 		}
@@ -127,13 +147,9 @@ func runGetStatusThread(data *HttpGetStatusThread, projectList *ProjectList) {
 	} // end for
 }
 
-func doGetRequest(baseURL string, failureDelay int, projectList *ProjectList) error {
+func doGetRequest(client *http.Client, baseURL string, projectList *ProjectList, cache *watchlistCache) error {
 
-	// Wait before issuing a request, due to a previous failed request
-	if failureDelay > 0 {
-		time.Sleep(time.Duration(failureDelay) * time.Millisecond)
-	}
-	result, err := sendGet(baseURL)
+	result, err := sendGet(client, baseURL, cache)
 
 	if err != nil {
 		return err
@@ -147,21 +163,28 @@ func doGetRequest(baseURL string, failureDelay int, projectList *ProjectList) er
 
 }
 
-func sendGet(baseURL string) (*models.WatchlistEntries, error) {
+/** Returns the latest watchlist, or nil if it has not changed since the cached response. */
+func sendGet(client *http.Client, baseURL string, cache *watchlistCache) (*models.WatchlistEntries, error) {
 
-	url := baseURL + "/api/v1/projects/watchlist"
+	url := utils.JoinURL(baseURL, "/api/v1/projects/watchlist", nil)
 
-	utils.LogInfo("Initiating GET request to " + url)
+	utils.LogInfo("Initiating GET request to " + utils.RedactURL(url))
 
-	tr := &http.Transport{
-		TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
+	req, err := http.NewRequest(http.MethodGet, url, nil)
+	if err != nil {
+		return nil, err
 	}
 
-	client := &http.Client{Transport: tr}
+	if cache.etag != "" {
+		req.Header.Set("If-None-Match", cache.etag)
+	}
+	if cache.lastModified != "" {
+		req.Header.Set("If-Modified-Since", cache.lastModified)
+	}
 
-	resp, err := client.Get(url)
+	resp, err := client.Do(req)
 	if err != nil || resp == nil {
-		errMsg := "Get request failed for " + url + " , with no response code."
+		errMsg := "Get request failed for " + utils.RedactURL(url) + " , with no response code."
 		if err != nil {
 			utils.LogErrorErr(errMsg, err)
 		} else {
@@ -173,8 +196,13 @@ func sendGet(baseURL string) (*models.WatchlistEntries, error) {
 
 	defer resp.Body.Close()
 
+	if resp.StatusCode == http.StatusNotModified {
+		utils.LogInfo("GET request completed, for " + utils.RedactURL(url) + ". Watchlist has not changed.")
+		return nil, nil
+	}
+
 	if resp.StatusCode != 200 {
-		errMsg := "Get response failed for " + url + ", response code: " + strconv.Itoa(resp.StatusCode)
+		errMsg := "Get response failed for " + utils.RedactURL(url) + ", response code: " + strconv.Itoa(resp.StatusCode)
 		utils.LogError(errMsg)
 		return nil, errors.New(errMsg)
 	}
@@ -182,7 +210,7 @@ func sendGet(baseURL string) (*models.WatchlistEntries, error) {
 	body, err := ioutil.ReadAll(resp.Body)
 
 	if err != nil || body == nil {
-		utils.LogError("Get response failed for " + url + ", unable to read body")
+		utils.LogError("Get response failed for " + utils.RedactURL(url) + ", unable to read body")
 		return nil, err
 	}
 
@@ -191,14 +219,62 @@ func sendGet(baseURL string) (*models.WatchlistEntries, error) {
 	bodyStr = strings.ReplaceAll(bodyStr, "\r", "")
 	bodyStr = strings.ReplaceAll(bodyStr, "\n", "")
 
-	utils.LogInfo("GET request completed, for " + url + ". Response: " + bodyStr)
+	utils.LogDebug("GET request completed, for " + utils.RedactURL(url) + ". Response: " + bodyStr)
 
 	var entries models.WatchlistEntryList
 	err = json.Unmarshal(body, &entries)
 	if err != nil {
-		utils.LogError("Get response failed for" + url + ", unable to unmarshal body.")
+		utils.LogError("Get response failed for " + utils.RedactURL(url) + ", unable to unmarshal body.")
 		return nil, err
 	}
 
+	utils.LogInfo("GET request completed, for " + utils.RedactURL(url) + ". " + summarizeWatchlistChanges(cache.projects, entries.Projects))
+
+	cache.etag = resp.Header.Get("ETag")
+	cache.lastModified = resp.Header.Get("Last-Modified")
+	cache.projects = make(map[string]models.ProjectToWatch)
+	for _, project := range entries.Projects {
+		cache.projects[project.ProjectID] = project
+	}
+
 	return &entries.Projects, nil
 }
+
+/** Returns a one-line summary of the projects that were added, removed or changed between the two watchlists. */
+func summarizeWatchlistChanges(previous map[string]models.ProjectToWatch, latest models.WatchlistEntries) string {
+
+	added := []string{}
+	changed := []string{}
+	removed := []string{}
+
+	latestIDs := make(map[string]bool)
+
+	for _, project := range latest {
+		latestIDs[project.ProjectID] = true
+
+		previousProject, exists := previous[project.ProjectID]
+		if !exists {
+			added = append(added, project.ProjectID)
+		} else if !reflect.DeepEqual(previousProject, project) {
+			changed = append(changed, project.ProjectID)
+		}
+	}
+
+	for projectID := range previous {
+		if !latestIDs[projectID] {
+			removed = append(removed, projectID)
+		}
+	}
+
+	result := "Projects: " + strconv.Itoa(len(latest))
+
+	if len(added)+len(changed)+len(removed) == 0 {
+		return result + ", no changes."
+	}
+
+	sort.Strings(added)
+	sort.Strings(changed)
+	sort.Strings(removed)
+
+	return result + ", added: [" + strings.Join(added, ", ") + "], changed: [" + strings.Join(changed, ", ") + "], removed: [" + strings.Join(removed, ", ") + "]"
+}
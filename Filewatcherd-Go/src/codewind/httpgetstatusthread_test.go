@@ -0,0 +1,193 @@
+/*******************************************************************************
+* Copyright (c) 2020 IBM Corporation and others.
+* All rights reserved. This program and the accompanying materials
+* are made available under the terms of the Eclipse Public License v2.0
+* which accompanies this distribution, and is available at
+* http://www.eclipse.org/legal/epl-v20.html
+*
+* Contributors:
+*     IBM Corporation - initial API and implementation
+*******************************************************************************/
+
+package main
+
+import (
+	"codewind/models"
+	"codewind/utils"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+/** The conditional headers of a watchlist GET request received by the test server */
+type receivedWatchlistRequest struct {
+	ifNoneMatch     string
+	ifModifiedSince string
+}
+
+/** A response of the watchlist test server */
+type watchlistTestResponse struct {
+	projects     models.WatchlistEntries
+	etag         string
+	lastModified string
+}
+
+/**
+ * Returns a server that responds to each watchlist GET request with the next response of the list: a response
+ * with a nil watchlist is a 304 Not Modified, otherwise the watchlist is sent with the response's ETag and
+ * Last-Modified headers.
+ */
+func newWatchlistTestServer(t *testing.T, responses ...watchlistTestResponse) (*httptest.Server, chan *receivedWatchlistRequest) {
+
+	received := make(chan *receivedWatchlistRequest, len(responses))
+	remaining := make(chan watchlistTestResponse, len(responses))
+	for _, response := range responses {
+		remaining <- response
+	}
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet || r.URL.Path != "/api/v1/projects/watchlist" {
+			t.Errorf("Unexpected request: %s %s", r.Method, r.URL.Path)
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+
+		received <- &receivedWatchlistRequest{r.Header.Get("If-None-Match"), r.Header.Get("If-Modified-Since")}
+
+		var response watchlistTestResponse
+		select {
+		case response = <-remaining:
+		default:
+			t.Errorf("Unexpected additional watchlist request")
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+
+		if response.projects == nil {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+
+		w.Header().Set("ETag", response.etag)
+		w.Header().Set("Last-Modified", response.lastModified)
+		json.NewEncoder(w).Encode(models.WatchlistEntryList{Projects: response.projects})
+	}))
+
+	t.Cleanup(server.Close)
+
+	return server, received
+}
+
+func TestWatchlistRequestsAreConditional(t *testing.T) {
+
+	projects := models.WatchlistEntries{{ProjectID: "project-1", PathToMonitor: "/p1"}}
+
+	server, received := newWatchlistTestServer(t,
+		watchlistTestResponse{projects, `"v1"`, "Wed, 01 Jan 2020 00:00:00 GMT"},
+		watchlistTestResponse{nil, "", ""},
+		watchlistTestResponse{projects, `"v2"`, "Thu, 02 Jan 2020 00:00:00 GMT"},
+	)
+
+	projectList := &ProjectList{projectOperationChannel: make(chan *projectListChannelMessage, 10)}
+	client := utils.NewHTTPClient(server.URL)
+	cache := &watchlistCache{}
+
+	expectUpdate := func(expected bool) {
+		t.Helper()
+		select {
+		case msg := <-projectList.projectOperationChannel:
+			if !expected {
+				t.Fatalf("Unexpected project list update: %+v", msg)
+			}
+			if msg.msgType != updateProjectListFromGetRequestMsg || len(*msg.updateProjectListFromGetRequestMessage) != 1 {
+				t.Fatalf("Unexpected project list message: %+v", msg)
+			}
+		default:
+			if expected {
+				t.Fatal("The project list was not updated")
+			}
+		}
+	}
+
+	// The first request is unconditional
+	if err := doGetRequest(client, server.URL, projectList, cache); err != nil {
+		t.Fatal(err)
+	}
+	if request := <-received; request.ifNoneMatch != "" || request.ifModifiedSince != "" {
+		t.Fatalf("Unexpected conditional headers on the first request: %+v", request)
+	}
+	expectUpdate(true)
+
+	// The validators of the first response are sent back, and the 304 response leaves the project list untouched
+	if err := doGetRequest(client, server.URL, projectList, cache); err != nil {
+		t.Fatal(err)
+	}
+	if request := <-received; request.ifNoneMatch != `"v1"` || request.ifModifiedSince != "Wed, 01 Jan 2020 00:00:00 GMT" {
+		t.Fatalf("Unexpected conditional headers: %+v", request)
+	}
+	expectUpdate(false)
+
+	if cache.etag != `"v1"` || len(cache.projects) != 1 {
+		t.Fatalf("The cache was changed by a 304 response: %+v", cache)
+	}
+
+	// The validators of the cached response are still sent after a 304, and are replaced by those of a new response
+	if err := doGetRequest(client, server.URL, projectList, cache); err != nil {
+		t.Fatal(err)
+	}
+	if request := <-received; request.ifNoneMatch != `"v1"` || request.ifModifiedSince != "Wed, 01 Jan 2020 00:00:00 GMT" {
+		t.Fatalf("Unexpected conditional headers: %+v", request)
+	}
+	expectUpdate(true)
+
+	if cache.etag != `"v2"` || cache.lastModified != "Thu, 02 Jan 2020 00:00:00 GMT" {
+		t.Fatalf("The cache was not updated by a new response: %+v", cache)
+	}
+}
+
+func TestSummarizeWatchlistChanges(t *testing.T) {
+
+	project := func(projectID string, path string) models.ProjectToWatch {
+		return models.ProjectToWatch{ProjectID: projectID, PathToMonitor: path}
+	}
+
+	previous := map[string]models.ProjectToWatch{
+		"a": project("a", "/a"),
+		"b": project("b", "/b"),
+		"c": project("c", "/c"),
+	}
+
+	tests := []struct {
+		name     string
+		previous map[string]models.ProjectToWatch
+		latest   models.WatchlistEntries
+		expected string
+	}{
+		{"first response", nil, models.WatchlistEntries{project("b", "/b"), project("a", "/a")},
+			"Projects: 2, added: [a, b], changed: [], removed: []"},
+		{"no changes", previous, models.WatchlistEntries{project("c", "/c"), project("a", "/a"), project("b", "/b")},
+			"Projects: 3, no changes."},
+		{"added", previous, models.WatchlistEntries{project("a", "/a"), project("b", "/b"), project("c", "/c"), project("e", "/e"), project("d", "/d")},
+			"Projects: 5, added: [d, e], changed: [], removed: []"},
+		{"changed", previous, models.WatchlistEntries{project("a", "/a"), project("b", "/moved"), project("c", "/c")},
+			"Projects: 3, added: [], changed: [b], removed: []"},
+		{"changed ignore rules", previous, models.WatchlistEntries{project("a", "/a"), project("b", "/b"),
+			{ProjectID: "c", PathToMonitor: "/c", IgnoredPaths: []string{"/node_modules"}}},
+			"Projects: 3, added: [], changed: [c], removed: []"},
+		{"removed", previous, models.WatchlistEntries{project("b", "/b")},
+			"Projects: 1, added: [], changed: [], removed: [a, c]"},
+		{"all removed", previous, models.WatchlistEntries{},
+			"Projects: 0, added: [], changed: [], removed: [a, b, c]"},
+		{"added, changed and removed", previous, models.WatchlistEntries{project("d", "/d"), project("a", "/moved"), project("c", "/c")},
+			"Projects: 3, added: [d], changed: [a], removed: [b]"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if actual := summarizeWatchlistChanges(test.previous, test.latest); actual != test.expected {
+				t.Fatalf("summarizeWatchlistChanges() = %q, expected %q", actual, test.expected)
+			}
+		})
+	}
+}
@@ -15,10 +15,11 @@ import (
 	"bytes"
 	"errors"
 	"net/http"
+	neturl "net/url"
 	"strconv"
+	"sync"
 
 	"codewind/utils"
-	"crypto/tls"
 	"time"
 )
 
@@ -32,11 +33,40 @@ import (
  * individual HTTP POST requests.
  */
 type HttpPostOutputQueue struct {
-	url                 string
-	workInputChannel    chan *PostQueueChannelMessage
-	requestDebugChannel chan chan string
+	url                  string
+	clientUUID           string
+	workInputChannel     chan *PostQueueChannelMessage
+	requestDebugChannel  chan chan string
+	requestHealthChannel chan chan *postQueueHealthJSON
+	outbox               *PostQueueOutbox // nil if the outbox is not enabled
+	settings             HttpPostOutputQueueSettings
+	rateLimiter          *utils.TokenBucket // nil if requests are not rate limited; only used by the work manager
+
+	/** Used by the workers and the capabilities request, so that connections to the server are reused; thread safe */
+	client *http.Client
+
+	/** The chunk size and encoding negotiated with the server; synchronize on format_synch_lock when accessing */
+	format            PostQueueFormat
+	format_synch_lock sync.Mutex
+
+	/** Whether the capabilities request is in progress, has succeeded, or has failed; synchronize on format_synch_lock */
+	capabilitiesState postCapabilitiesState
 }
 
+type postCapabilitiesState int
+
+const (
+	capabilitiesRequesting postCapabilitiesState = iota + 1
+	capabilitiesReceived
+	capabilitiesFailed
+)
+
+const (
+	// The number of attempts to retrieve the server's capabilities, before the current format is used until the next
+	// successful POST request
+	maxCapabilitiesAttempts = 5
+)
+
 type PostQueueChannelMessage struct {
 	chunkGroup *PostQueueChunkGroup
 }
@@ -44,60 +74,177 @@ type PostQueueChannelMessage struct {
 type PostQueueWorkResultChannel struct {
 	chunk   *PostQueueChunk
 	success bool
+	err     error // non-nil on failure
 }
 
-func NewHttpPostOutputQueue(url string) (*HttpPostOutputQueue, error) {
+/** The requests currently being sent by the work manager's goroutines */
+type postQueueWorkerUsage struct {
+	activeWorkers int
+	inFlightBytes int64
+}
+
+// NewHttpPostOutputQueue creates the queue and starts its work manager. If the settings' outbox directory is non-empty,
+// chunk groups are persisted to that directory until they are sent, and any chunk groups persisted by a previous run
+// are resent.
+func NewHttpPostOutputQueue(url string, clientUUID string, settings HttpPostOutputQueueSettings) (*HttpPostOutputQueue, error) {
 
 	url = utils.StripTrailingForwardSlash(url)
 
 	if !utils.IsValidURLBase(url) {
-		return nil, errors.New("URL is invalid: " + url)
+		return nil, errors.New("URL is invalid: " + utils.RedactURL(url))
 	}
 
 	workChannel := make(chan *PostQueueChannelMessage)
 
 	result := &HttpPostOutputQueue{
-		url:                 url,
-		workInputChannel:    workChannel,
-		requestDebugChannel: make(chan chan string),
+		url:                  url,
+		clientUUID:           clientUUID,
+		workInputChannel:     workChannel,
+		requestDebugChannel:  make(chan chan string),
+		requestHealthChannel: make(chan chan *postQueueHealthJSON),
+		settings:             settings,
+		format:               newDefaultPostQueueFormat(),
+		capabilitiesState:    capabilitiesRequesting,
+		client:               utils.NewHTTPClient(url),
+	}
+
+	if settings.RateLimitPerSecond > 0 {
+		result.rateLimiter = utils.NewTokenBucket(float64(settings.RateLimitPerSecond), settings.RateLimitBurst)
+	}
+
+	utils.LogInfo("HTTP POST output queue settings: " + settings.toDebugString())
+
+	initialChunkGroups := []*PostQueueChunkGroup{}
+
+	if settings.OutboxDirectory != "" {
+		outbox, err := NewPostQueueOutbox(settings.OutboxDirectory)
+		if err != nil {
+			return nil, err
+		}
+		result.outbox = outbox
+		initialChunkGroups = outbox.ReadChunkGroups()
 	}
 
 	// Start the work manager goroutine
-	go result.workManager()
+	go result.workManager(initialChunkGroups)
+
+	go result.requestCapabilities()
 
 	return result, nil
 }
 
-func (queue *HttpPostOutputQueue) AddToQueue(projectIDParam string, timestamp int64, base64Compressed []string) {
+// GetPostFormat returns the chunk size and encoding that should be used for new change lists.
+func (queue *HttpPostOutputQueue) GetPostFormat() PostQueueFormat {
+	queue.format_synch_lock.Lock()
+	defer queue.format_synch_lock.Unlock()
+
+	return queue.format
+}
+
+func (queue *HttpPostOutputQueue) setPostFormat(format PostQueueFormat, source string) {
+	queue.format_synch_lock.Lock()
+	defer queue.format_synch_lock.Unlock()
 
-	chunkGroup := &PostQueueChunkGroup{
-		chunkMap:          make(map[int]*PostQueueChunk, 0),
-		chunkStatus:       make(map[int]ChunkStatus, 0),
-		timestamp:         timestamp,
-		expireTimeInNanos: time.Now().Add(time.Hour * 24).UnixNano(),
+	if queue.format != format {
+		utils.LogInfo("HTTP POST format updated from " + source + ": " + format.String())
+		queue.format = format
 	}
+}
+
+func (queue *HttpPostOutputQueue) setCapabilitiesState(state postCapabilitiesState) {
+	queue.format_synch_lock.Lock()
+	defer queue.format_synch_lock.Unlock()
+
+	queue.capabilitiesState = state
+}
+
+/**
+ * Request the server's preferred chunk size and encoding from the capabilities endpoint. If the server does not
+ * provide the endpoint, the original format (zlib, 625 entries) is used, unless the server specifies a format in the
+ * headers of a POST response.
+ *
+ * If the server cannot be reached after X attempts, the current format (the original format, unless a POST response
+ * has specified otherwise) is used, and the capabilities are requested again after the next successful POST request
+ * (see renegotiateCapabilitiesIfNeeded).
+ */
+func (queue *HttpPostOutputQueue) requestCapabilities() {
+
+	url := utils.JoinURL(queue.url, postCapabilitiesPath, nil)
 
-	for index, base64String := range base64Compressed {
+	backoffUtil := utils.NewExponentialBackoff()
 
-		chunk := &PostQueueChunk{
-			chunkID:          index + 1,
-			chunkTotal:       len(base64Compressed),
-			base64Compressed: base64String,
-			projectID:        projectIDParam,
-			timestamp:        timestamp,
-			parent:           chunkGroup,
+	for attempt := 1; ; attempt++ {
+
+		resp, err := queue.client.Get(url)
+		if err != nil {
+			if attempt >= maxCapabilitiesAttempts {
+				utils.LogErrorErr("Unable to retrieve capabilities from "+utils.RedactURL(url)+" after "+strconv.Itoa(attempt)+" attempts, so using: "+queue.GetPostFormat().String()+"; capabilities will be requested again after the next successful request", err)
+				queue.setCapabilitiesState(capabilitiesFailed)
+				return
+			}
+
+			utils.LogInfo("Unable to retrieve capabilities from " + utils.RedactURL(url) + " (attempt " + strconv.Itoa(attempt) + " of " + strconv.Itoa(maxCapabilitiesAttempts) + "): " + err.Error())
+			backoffUtil.SleepAfterFail()
+			backoffUtil.FailIncrease()
+			continue
 		}
 
-		chunkGroup.chunkMap[chunk.chunkID] = chunk
-		chunkGroup.chunkStatus[chunk.chunkID] = AVAILABLE_TO_SEND
+		queue.setCapabilitiesState(capabilitiesReceived)
 
+		if resp.StatusCode != 200 {
+			resp.Body.Close()
+			utils.LogInfo("Server does not provide capabilities (response code " + strconv.Itoa(resp.StatusCode) + "), using: " + queue.GetPostFormat().String())
+			return
+		}
+
+		format, err := negotiatePostFormatFromCapabilities(queue.GetPostFormat(), resp.Body)
+		resp.Body.Close()
+
+		if err != nil {
+			utils.LogErrorErr("Unable to parse capabilities from "+utils.RedactURL(url), err)
+			return
+		}
+
+		queue.setPostFormat(format, "capabilities")
+		return
+	}
+}
+
+/** If the capabilities could not be retrieved earlier, request them again, as the server is now reachable. */
+func (queue *HttpPostOutputQueue) renegotiateCapabilitiesIfNeeded() {
+	queue.format_synch_lock.Lock()
+	defer queue.format_synch_lock.Unlock()
+
+	if queue.capabilitiesState != capabilitiesFailed {
+		return
+	}
+
+	queue.capabilitiesState = capabilitiesRequesting
+	go queue.requestCapabilities()
+}
+
+// AddToQueue queues the given chunks of a change list, each of which has been encoded with the given encoding.
+func (queue *HttpPostOutputQueue) AddToQueue(projectIDParam string, timestamp int64, encoding PostEncoding, payloads []string) {
+
+	chunks := make(map[int]string)
+	for index, payload := range payloads {
+		chunks[index+1] = payload
+	}
+
+	chunkGroup := newPostQueueChunkGroup(projectIDParam, timestamp, time.Now().Add(time.Hour*24).UnixNano(), encoding, len(payloads), chunks)
+
+	// Persist the chunk group before it is queued, so that it is not lost if we are stopped before it is sent.
+	if queue.outbox != nil {
+		if err := queue.outbox.WriteChunkGroup(chunkGroup); err != nil {
+			utils.LogSevereErr("Unable to write chunk group to outbox", err)
+		}
 	}
 
 	queue.workInputChannel <- &PostQueueChannelMessage{
 		chunkGroup,
 	}
 
-	utils.LogDebug("Added file changes to queue: " + strconv.Itoa(len(base64Compressed)) + " " + projectIDParam)
+	utils.LogDebug("Added file changes to queue: " + strconv.Itoa(len(payloads)) + " " + projectIDParam)
 
 }
 
@@ -109,20 +256,46 @@ func (queue *HttpPostOutputQueue) RequestDebugMessage() chan string {
 	return result
 }
 
-func (queue *HttpPostOutputQueue) workManager() {
+/** Returns the current depth of the queue, and the state of its workers, for health reports */
+func (queue *HttpPostOutputQueue) RequestHealth() chan *postQueueHealthJSON {
+	result := make(chan *postQueueHealthJSON)
+
+	queue.requestHealthChannel <- result
+
+	return result
+}
 
-	utils.LogInfo("HttpPostOutputQueue thread has started for " + queue.url)
+func (queue *HttpPostOutputQueue) workManager(initialChunkGroups []*PostQueueChunkGroup) {
 
-	const MaxWorkers int = 3
+	utils.LogInfo("HttpPostOutputQueue thread has started for " + utils.RedactURL(queue.url))
 
 	priorityList := NewChunkGroupPriorityList()
 
+	// Replay any chunk groups from the outbox
+	for _, chunkGroup := range initialChunkGroups {
+		priorityList.AddToList(chunkGroup)
+	}
+
 	workCompleteChannel := make(chan *PostQueueWorkResultChannel)
 
-	// The number of threads currently handling HTTP request
-	activeWorkers := 0
+	// The number of threads currently handling HTTP request, and the total size of their chunks
+	usage := &postQueueWorkerUsage{}
+
+	// The backoff and circuit breaker state of each project
+	projectStates := make(map[string] /* project id -> */ *postQueueProjectState)
+
+	// The most recently dead-lettered chunk groups, for debug output
+	deadLetters := []deadLetterEntry{}
+	deadLetterTotal := 0
+
+	// Periodically check for work that can now be sent, for example, after a project's circuit breaker has reopened.
+	retryTicker := time.NewTicker(1 * time.Second)
 
-	backoff := utils.NewExponentialBackoff()
+	// Fires when the rate limiter will next allow a request, or when a project's backoff delay will next elapse, if
+	// work is waiting on either (otherwise nil)
+	var rateLimitTimer <-chan time.Time
+
+	rateLimitTimer = queue.queueMoreWorkIfNeeded(priorityList, usage, projectStates, workCompleteChannel)
 
 	for {
 
@@ -133,27 +306,74 @@ func (queue *HttpPostOutputQueue) workManager() {
 			priorityList.AddToList(newWork.chunkGroup)
 			utils.LogDebug("Added new work to HttpPostOutputQueue")
 
-			activeWorkers = queue.queueMoreWorkIfNeeded(priorityList, activeWorkers, MaxWorkers, &backoff, workCompleteChannel)
+			rateLimitTimer = queue.queueMoreWorkIfNeeded(priorityList, usage, projectStates, workCompleteChannel)
+
+		case <-retryTicker.C:
+			pruneProjectStates(projectStates, priorityList)
+
+			if priorityList.Len() > 0 {
+				rateLimitTimer = queue.queueMoreWorkIfNeeded(priorityList, usage, projectStates, workCompleteChannel)
+			}
+
+		case <-rateLimitTimer:
+			rateLimitTimer = queue.queueMoreWorkIfNeeded(priorityList, usage, projectStates, workCompleteChannel)
 
 		case completedWork := <-workCompleteChannel:
-			activeWorkers--
-			if completedWork.success == true {
-				backoff.SuccessReset()
+			usage.activeWorkers--
+			usage.inFlightBytes -= int64(len(completedWork.chunk.payload))
+
+			projectState := getPostQueueProjectState(projectStates, completedWork.chunk.projectID)
+			projectState.inFlight--
+
+			if completedWork.chunk.parent.deadLettered {
+				utils.LogDebug("Ignoring result of a chunk from a dead-lettered chunk group")
+
+			} else if completedWork.success == true {
+				projectState.onSuccess()
+				queue.renegotiateCapabilitiesIfNeeded()
 
 				completedWork.chunk.parent.InformChunkSent(completedWork.chunk)
 
-			} else {
-				utils.LogDebug("Existing work failed, so requeueing to HttpPostOutputQueue")
-				backoff.FailIncrease()
+				// Compact the outbox, now that the server has acknowledged the chunk
+				if queue.outbox != nil {
+					if err := queue.outbox.WriteChunkGroup(completedWork.chunk.parent); err != nil {
+						utils.LogSevereErr("Unable to update chunk group in outbox", err)
+					}
+				}
 
+			} else {
 				completedWork.chunk.parent.InformChunkFailedToSend(completedWork.chunk)
 
+				if projectState.onFailure(completedWork.err, time.Now()) {
+					entry := queue.deadLetterChunkGroup(priorityList, completedWork.chunk.parent, completedWork.err.Error())
+
+					deadLetterTotal++
+					if len(deadLetters) < maxDeadLetterEntries {
+						deadLetters = append(deadLetters, entry)
+					} else {
+						// Discard the oldest entry in place, so that the backing array does not grow
+						copy(deadLetters, deadLetters[1:])
+						deadLetters[len(deadLetters)-1] = entry
+					}
+				} else {
+					utils.LogDebug("Existing work failed, so requeueing to HttpPostOutputQueue")
+				}
 			}
 
-			activeWorkers = queue.queueMoreWorkIfNeeded(priorityList, activeWorkers, MaxWorkers, &backoff, workCompleteChannel)
+			rateLimitTimer = queue.queueMoreWorkIfNeeded(priorityList, usage, projectStates, workCompleteChannel)
 
 		case debugResponseChannel := <-queue.requestDebugChannel:
-			result := "- active-workers: " + strconv.Itoa(activeWorkers)
+			result := "- " + queue.settings.toDebugString() + "  " + queue.GetPostFormat().String() + "\n"
+
+			result += "- active-workers: " + strconv.Itoa(usage.activeWorkers) + "  in-flight-bytes: " + strconv.FormatInt(usage.inFlightBytes, 10)
+
+			if queue.rateLimiter != nil {
+				result += "  rate-limit-tokens: " + strconv.FormatFloat(queue.rateLimiter.AvailableTokens(time.Now()), 'f', 1, 64)
+			}
+
+			if queue.outbox != nil {
+				result += "  outbox: " + queue.outbox.directory
+			}
 
 			chunkGroupList := priorityList.GetList()
 
@@ -162,61 +382,205 @@ func (queue *HttpPostOutputQueue) workManager() {
 				result += "\n"
 				result += "- HTTP Post Chunk Group List:\n"
 				for _, val := range chunkGroupList {
+					result += "  - projectID: " + val.projectID + "  timestamp: " + strconv.FormatInt(val.timestamp, 10) + "\n"
+				}
+			}
 
-					projectID := ""
-					if len(val.chunkMap) > 0 {
-						pqc, exists := val.chunkMap[0]
-						if exists && pqc != nil {
-							projectID = pqc.projectID
-						}
-					}
-					result += "  - projectID: " + projectID + "  timestamp: " + strconv.FormatInt(val.timestamp, 10) + "\n"
+			projectStateResult := ""
+			for _, projectState := range projectStates {
+				if projectState.consecutiveFailures > 0 || projectState.inFlight > 0 {
+					projectStateResult += projectState.toDebugString() + "\n"
+				}
+			}
+			if projectStateResult != "" {
+				result += "\n- HTTP Post Project States:\n" + projectStateResult
+			}
 
+			if deadLetterTotal > 0 {
+				result += "\n- Dead-lettered chunk groups (total: " + strconv.Itoa(deadLetterTotal) + "):\n"
+				for _, entry := range deadLetters {
+					result += entry.toDebugString() + "\n"
 				}
 			}
+
 			debugResponseChannel <- result
+
+		case healthResponseChannel := <-queue.requestHealthChannel:
+			result := &postQueueHealthJSON{
+				ChunkGroups:   len(priorityList.GetList()),
+				ActiveWorkers: usage.activeWorkers,
+				InFlightBytes: usage.inFlightBytes,
+				DeadLettered:  deadLetterTotal,
+			}
+
+			for _, projectState := range projectStates {
+				if projectState.consecutiveFailures > 0 {
+					result.FailingProjects++
+				}
+			}
+
+			healthResponseChannel <- result
 		}
 	}
 }
 
-/** Start a new goroutine to send POST requests, if there is more work available and we are not at max workers. */
-func (queue *HttpPostOutputQueue) queueMoreWorkIfNeeded(priorityList *ChunkGroupPriorityList, currActiveWorkers int, MaxWorkers int, backoff *utils.ExponentialBackoff, workCompleteChannel chan *PostQueueWorkResultChannel) int {
+/**
+ * Start a new goroutine to send POST requests, if there is more work available and we are not at max workers (or
+ * max in-flight bytes). Projects whose backoff delay has not yet elapsed (after a failed request) are skipped. If
+ * work is only waiting on the rate limiter, or on a project's backoff delay, returns a channel that fires when the
+ * work may next be sent; otherwise returns nil.
+ */
+func (queue *HttpPostOutputQueue) queueMoreWorkIfNeeded(priorityList *ChunkGroupPriorityList, usage *postQueueWorkerUsage, projectStates map[string]*postQueueProjectState, workCompleteChannel chan *PostQueueWorkResultChannel) <-chan time.Time {
+
+	now := time.Now()
 
 	// While there is both more work available, and at least one free worker to do the work
-	for priorityList.Len() > 0 && currActiveWorkers < MaxWorkers {
+	for priorityList.Len() > 0 && usage.activeWorkers < queue.settings.MaxWorkers {
+
+		if queue.rateLimiter != nil {
+			if delay := queue.rateLimiter.DelayUntilAvailable(now); delay > 0 {
+				return time.After(delay)
+			}
+		}
+
+		scheduled := false
+
+		// The earliest time at which a project that is waiting on its backoff delay may send
+		var nextAttempt time.Time
+
+		// Take the next available chunk from the oldest chunk group of each project, in round-robin order
+		for _, projectID := range priorityList.ProjectsInScheduleOrder() {
+
+			projectState := getPostQueueProjectState(projectStates, projectID)
+			if !projectState.canSchedule(now) {
+				if now.Before(projectState.nextAttempt) && (nextAttempt.IsZero() || projectState.nextAttempt.Before(nextAttempt)) {
+					nextAttempt = projectState.nextAttempt
+				}
+				continue
+			}
+
+			chunkGroup := queue.peekNextIncompleteChunkGroup(priorityList, projectID)
+			if chunkGroup == nil {
+				continue
+			}
+
+			// If there is at least one chunk waiting to send, and it would not exceed the in-flight byte limit, send it
+			chunk := chunkGroup.PeekNextChunkAvailableToSend()
+			if chunk != nil {
+				chunkSize := int64(len(chunk.payload))
+				if queue.settings.MaxInFlightBytes > 0 && usage.activeWorkers > 0 && usage.inFlightBytes+chunkSize > queue.settings.MaxInFlightBytes {
+					continue
+				}
+
+				chunkGroup.AcquireNextChunkAvailableToSend()
+				if queue.rateLimiter != nil {
+					queue.rateLimiter.TryTake(now)
+				}
+
+				go queue.doRequest(chunk, workCompleteChannel)
+				projectState.inFlight++
+				usage.activeWorkers++
+				usage.inFlightBytes += chunkSize
+				priorityList.MarkScheduled(projectID)
+				scheduled = true
+				break
+			}
+		}
+
+		if !scheduled {
+			if !nextAttempt.IsZero() {
+				return time.After(nextAttempt.Sub(now))
+			}
+			break
+		}
+	}
+
+	return nil
+}
+
+/** Remove any complete or expired chunk groups from the front of the project's lane, then return the group at the front (or nil). */
+func (queue *HttpPostOutputQueue) peekNextIncompleteChunkGroup(priorityList *ChunkGroupPriorityList, projectID string) *PostQueueChunkGroup {
+
+	for {
+		chunkGroup := priorityList.Peek(projectID)
+		if chunkGroup == nil {
+			return nil
+		}
 
-		// Remove the chunk group at the front of the list if we have sent all its packets
-		chunkGroup := priorityList.Peek()
 		if chunkGroup.IsGroupComplete() {
-			priorityList.Pop()
+			priorityList.Pop(projectID)
 			continue
+
 		} else if time.Now().UnixNano() > chunkGroup.expireTimeInNanos {
-			priorityList.Pop()
+			priorityList.Pop(projectID)
+			if queue.outbox != nil {
+				if err := queue.outbox.RemoveChunkGroup(chunkGroup); err != nil {
+					utils.LogSevereErr("Unable to remove expired chunk group from outbox", err)
+				}
+			}
 			utils.LogSevere("Chunk group expired. This implies we could not connect to server for many hours.  timestamp: " + strconv.FormatInt(chunkGroup.expireTimeInNanos, 10))
 			continue
 		}
 
-		// If there is at least one chunk waiting to send, send it
-		chunk := chunkGroup.AcquireNextChunkAvailableToSend()
-		if chunk != nil {
-			go queue.doRequest(chunk, workCompleteChannel, backoff.GetFailureDelay())
-			currActiveWorkers++
-		} else {
-			break
-		}
+		return chunkGroup
+	}
+}
 
+/** Return the state of the project, creating it if needed. */
+func getPostQueueProjectState(projectStates map[string]*postQueueProjectState, projectID string) *postQueueProjectState {
+
+	projectState, exists := projectStates[projectID]
+	if !exists {
+		projectState = newPostQueueProjectState(projectID)
+		projectStates[projectID] = projectState
 	}
 
-	return currActiveWorkers
+	return projectState
 }
 
-/** Call 'sendPost' then communicate the result back on the repsonse channel. */
-func (queue *HttpPostOutputQueue) doRequest(work *PostQueueChunk, workCompleteChannel chan *PostQueueWorkResultChannel, failureDelay int) {
+/**
+ * Remove the state of projects that have no chunk groups waiting and no requests in progress, for example, projects
+ * that have been deleted, so that the map does not grow without bound. The backoff and circuit breaker state of a
+ * project that is still failing is kept while it has chunk groups waiting.
+ */
+func pruneProjectStates(projectStates map[string]*postQueueProjectState, priorityList *ChunkGroupPriorityList) {
 
-	// Wait before issuing a request, due to a previous failed request
-	if failureDelay > 0 {
-		time.Sleep(time.Duration(failureDelay) * time.Millisecond)
+	for projectID, projectState := range projectStates {
+		if projectState.inFlight == 0 && priorityList.Peek(projectID) == nil {
+			delete(projectStates, projectID)
+		}
 	}
+}
+
+/** Remove a chunk group that the server has permanently rejected from the queue, and report it. */
+func (queue *HttpPostOutputQueue) deadLetterChunkGroup(priorityList *ChunkGroupPriorityList, chunkGroup *PostQueueChunkGroup, reason string) deadLetterEntry {
+
+	chunkGroup.deadLettered = true
+
+	// Only the oldest chunk group of a project is ever sent, so it will be at the front of the project's lane
+	if priorityList.Peek(chunkGroup.projectID) == chunkGroup {
+		priorityList.Pop(chunkGroup.projectID)
+	} else {
+		utils.LogSevere("Dead-lettered chunk group was not at the front of its project's queue: " + chunkGroup.projectID)
+	}
+
+	if queue.outbox != nil {
+		if err := queue.outbox.MoveToDeadLetter(chunkGroup); err != nil {
+			utils.LogSevereErr("Unable to move chunk group to outbox dead letter directory", err)
+		}
+	}
+
+	utils.LogSevere("Chunk group was permanently rejected by the server, so it will not be resent. projectID: " + chunkGroup.projectID + "  timestamp: " + strconv.FormatInt(chunkGroup.timestamp, 10) + "  reason: " + reason)
+
+	return deadLetterEntry{chunkGroup.projectID, chunkGroup.timestamp, reason, time.Now()}
+}
+
+/**
+ * Call 'sendPost' then communicate the result back on the repsonse channel. The backoff delay after a failed request
+ * is applied by the work manager (see queueMoreWorkIfNeeded), so workers never sleep.
+ */
+func (queue *HttpPostOutputQueue) doRequest(work *PostQueueChunk, workCompleteChannel chan *PostQueueWorkResultChannel) {
+
 	err := queue.sendPost(work)
 
 	utils.LogDebug("sendPost complete")
@@ -224,43 +588,70 @@ func (queue *HttpPostOutputQueue) doRequest(work *PostQueueChunk, workCompleteCh
 	if err != nil {
 		utils.LogErrorErr("Error occurred on send: ", err)
 
-		workCompleteChannel <- &PostQueueWorkResultChannel{work, false}
+		workCompleteChannel <- &PostQueueWorkResultChannel{work, false, err}
 
 	} else {
 
-		workCompleteChannel <- &PostQueueWorkResultChannel{work, true}
+		workCompleteChannel <- &PostQueueWorkResultChannel{work, true, nil}
 	}
 
 	utils.LogDebug("Work signaled on workCompleteChannel in HTTP post queue")
 }
 
+/**
+ * Returns the idempotency key of the chunk, which is the same on every attempt to send it (including after a restart,
+ * when the outbox is enabled, as long as the client UUID is unchanged).
+ */
+func (queue *HttpPostOutputQueue) getIdempotencyKey(chunk *PostQueueChunk) string {
+	return utils.GenerateIdempotencyKey(queue.clientUUID, chunk.projectID, strconv.FormatInt(chunk.timestamp, 10), strconv.Itoa(chunk.chunkID))
+}
+
 /** Construct and send the HTTP POST request, and return an error on either failure or !200 */
 func (queue *HttpPostOutputQueue) sendPost(chunk *PostQueueChunk) error {
 
-	buffer := bytes.NewBufferString("{\"msg\" : \"" + chunk.base64Compressed + "\"}")
+	body, err := newPostRequestBody(chunk.payload, chunk.parent.encoding)
+	if err != nil {
+		return err
+	}
+
+	buffer := bytes.NewBuffer(body)
 
-	url := queue.url + "/api/v1/projects/" + chunk.projectID + "/file-changes?timestamp=" + strconv.FormatInt(chunk.timestamp, 10) + "&chunk=" + strconv.FormatInt((int64)(chunk.chunkID), 10) + "&chunk_total=" + strconv.FormatInt((int64)(chunk.chunkTotal), 10)
+	query := neturl.Values{}
+	query.Set("timestamp", strconv.FormatInt(chunk.timestamp, 10))
+	query.Set("chunk", strconv.FormatInt((int64)(chunk.chunkID), 10))
+	query.Set("chunk_total", strconv.FormatInt((int64)(chunk.chunkTotal), 10))
 
-	utils.LogInfo("Sending POST request to " + url + " with payload size " + strconv.Itoa(buffer.Len()))
+	url := utils.JoinURL(queue.url, "/api/v1/projects/"+chunk.projectID+"/file-changes", query)
 
-	tr := &http.Transport{
-		TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
+	utils.LogInfo("Sending POST request to " + utils.RedactURL(url) + " with payload size " + strconv.Itoa(buffer.Len()))
+
+	req, err := http.NewRequest(http.MethodPost, url, buffer)
+	if err != nil {
+		return err
 	}
 
-	client := &http.Client{Transport: tr}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(utils.IdempotencyKeyHeader, queue.getIdempotencyKey(chunk))
 
-	resp, err := client.Post(url, "application/json", buffer)
+	resp, err := queue.client.Do(req)
 	if err != nil {
 		return err
 	}
 
 	if resp == nil {
 		return errors.New("Response was nil")
-	} else if resp.StatusCode != 200 {
-		return errors.New("Response code was != 200")
 	}
 
 	defer resp.Body.Close()
 
+	// The server may update its preferred format on any response
+	if format, present := negotiatePostFormatFromHeaders(queue.GetPostFormat(), resp.Header); present {
+		queue.setPostFormat(format, "response headers")
+	}
+
+	if resp.StatusCode != 200 {
+		return &PostResponseError{resp.StatusCode}
+	}
+
 	return nil
 }
@@ -0,0 +1,664 @@
+/*******************************************************************************
+* Copyright (c) 2020 IBM Corporation and others.
+* All rights reserved. This program and the accompanying materials
+* are made available under the terms of the Eclipse Public License v2.0
+* which accompanies this distribution, and is available at
+* http://www.eclipse.org/legal/epl-v20.html
+*
+* Contributors:
+*     IBM Corporation - initial API and implementation
+*******************************************************************************/
+
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"compress/zlib"
+	"encoding/base64"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+/** A file-changes POST request received by the postTestServer */
+type receivedPostRequest struct {
+	projectID      string
+	timestamp      int64
+	chunk          int
+	chunkTotal     int
+	idempotencyKey string
+	changes        []changedFileEntryJSON
+
+	/** The address of the connection that the request was received on */
+	remoteAddr string
+}
+
+/**
+ * A server that records the file-changes POST requests it receives. The capabilities endpoint responds with the
+ * given capabilities (or 404 if nil), and each POST is answered by the status function (200 if nil).
+ */
+type postTestServer struct {
+	*httptest.Server
+
+	lock     sync.Mutex
+	requests []*receivedPostRequest
+
+	/** Receives each request as it is recorded */
+	received chan *receivedPostRequest
+
+	capabilities *postCapabilitiesJSON
+	status       func(request *receivedPostRequest) int
+
+	/** While true, capabilities requests are answered by closing the connection; synchronize on lock */
+	failCapabilities bool
+
+	/** The number of capabilities requests received; synchronize on lock */
+	capabilitiesRequests int
+}
+
+func newPostTestServer(t *testing.T, capabilities *postCapabilitiesJSON, status func(request *receivedPostRequest) int) *postTestServer {
+
+	server := &postTestServer{
+		received:     make(chan *receivedPostRequest, 1000),
+		capabilities: capabilities,
+		status:       status,
+	}
+
+	server.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+
+		if r.URL.Path == postCapabilitiesPath {
+			server.lock.Lock()
+			server.capabilitiesRequests++
+			fail := server.failCapabilities
+			server.lock.Unlock()
+
+			if fail {
+				// Simulate an unreachable server
+				conn, _, err := w.(http.Hijacker).Hijack()
+				if err == nil {
+					conn.Close()
+				}
+				return
+			}
+
+			if server.capabilities == nil {
+				w.WriteHeader(http.StatusNotFound)
+				return
+			}
+			json.NewEncoder(w).Encode(server.capabilities)
+			return
+		}
+
+		if r.Method != http.MethodPost || !strings.HasSuffix(r.URL.Path, "/file-changes") {
+			t.Errorf("Unexpected request: %s %s", r.Method, r.URL.Path)
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+
+		request, err := parsePostTestRequest(r)
+		if err != nil {
+			t.Errorf("Unable to parse POST request: %v", err)
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		request.remoteAddr = r.RemoteAddr
+
+		statusCode := http.StatusOK
+		if server.status != nil {
+			statusCode = server.status(request)
+		}
+
+		server.lock.Lock()
+		server.requests = append(server.requests, request)
+		server.lock.Unlock()
+
+		server.received <- request
+
+		w.WriteHeader(statusCode)
+	}))
+
+	t.Cleanup(server.Close)
+
+	return server
+}
+
+func parsePostTestRequest(r *http.Request) (*receivedPostRequest, error) {
+
+	query := r.URL.Query()
+
+	result := &receivedPostRequest{
+		projectID:      strings.TrimSuffix(strings.TrimPrefix(r.URL.Path, "/api/v1/projects/"), "/file-changes"),
+		idempotencyKey: r.Header.Get("Idempotency-Key"),
+	}
+
+	var err error
+	if result.timestamp, err = strconv.ParseInt(query.Get("timestamp"), 10, 64); err != nil {
+		return nil, err
+	}
+	if result.chunk, err = strconv.Atoi(query.Get("chunk")); err != nil {
+		return nil, err
+	}
+	if result.chunkTotal, err = strconv.Atoi(query.Get("chunk_total")); err != nil {
+		return nil, err
+	}
+
+	var body postRequestBodyJSON
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		return nil, err
+	}
+
+	changeListJSON, err := decodeChangeListForTest(body)
+	if err != nil {
+		return nil, err
+	}
+
+	return result, json.Unmarshal(changeListJSON, &result.changes)
+}
+
+/** Reverse encodeChangeList, as the server would. */
+func decodeChangeListForTest(body postRequestBodyJSON) ([]byte, error) {
+
+	if body.Encoding == PostEncodingJSON {
+		return body.Changes, nil
+	}
+
+	compressed, err := base64.StdEncoding.DecodeString(body.Msg)
+	if err != nil {
+		return nil, err
+	}
+
+	var reader io.Reader
+	switch body.Encoding {
+	case "", PostEncodingZlib:
+		reader, err = zlib.NewReader(bytes.NewReader(compressed))
+	case PostEncodingGzip:
+		reader, err = gzip.NewReader(bytes.NewReader(compressed))
+	case PostEncodingZstd:
+		reader, err = zstd.NewReader(bytes.NewReader(compressed))
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return ioutil.ReadAll(reader)
+}
+
+/** Wait for the next request received by the server. */
+func (server *postTestServer) nextRequest(t *testing.T) *receivedPostRequest {
+	t.Helper()
+
+	select {
+	case request := <-server.received:
+		return request
+	case <-time.After(10 * time.Second):
+		t.Fatal("Timed out waiting for a POST request")
+		return nil
+	}
+}
+
+func (server *postTestServer) expectNoRequest(t *testing.T) {
+	t.Helper()
+
+	select {
+	case request := <-server.received:
+		t.Fatalf("Unexpected POST request: %+v", request)
+	case <-time.After(200 * time.Millisecond):
+	}
+}
+
+func (server *postTestServer) setFailCapabilities(fail bool) {
+	server.lock.Lock()
+	defer server.lock.Unlock()
+
+	server.failCapabilities = fail
+}
+
+func (server *postTestServer) getCapabilitiesRequests() int {
+	server.lock.Lock()
+	defer server.lock.Unlock()
+
+	return server.capabilitiesRequests
+}
+
+func newTestPostOutputQueue(t *testing.T, server *postTestServer, maxWorkers int) *HttpPostOutputQueue {
+
+	queue, err := NewHttpPostOutputQueue(server.URL, "test-client-uuid", HttpPostOutputQueueSettings{MaxWorkers: maxWorkers, RateLimitBurst: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return queue
+}
+
+/** Wait for the queue to receive the server's capabilities. */
+func waitForPostFormat(t *testing.T, queue *HttpPostOutputQueue, expected PostQueueFormat) {
+	t.Helper()
+
+	deadline := time.Now().Add(10 * time.Second)
+	for queue.GetPostFormat() != expected {
+		if time.Now().After(deadline) {
+			t.Fatalf("Timed out waiting for format %v, current format is %v", expected, queue.GetPostFormat())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+/** Send a batch of CREATE events for the given paths, with the given delivery mode, through a batch util. */
+func sendBatchForTest(t *testing.T, queue *HttpPostOutputQueue, mode DeliveryMode, paths []string) *batchUtilTestHarness {
+
+	h := newBatchUtilTestHarness(BatchPolicy{QuietPeriod: time.Second, DeliveryMode: mode}, queue)
+
+	entries := []ChangedFileEntry{}
+	for index, path := range paths {
+		entry, err := NewChangedFileEntry(path, "CREATE", h.clock.Now().UnixNano()/1000000+int64(index), false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		entries = append(entries, *entry)
+	}
+
+	h.batchUtil.AddChangedFiles(entries)
+	h.clock.nextAfterCall(t)
+	h.clock.Advance(time.Second)
+
+	return h
+}
+
+/** Receive the chunks of a single chunk group, and return the paths in chunk order. */
+func receiveChunkGroupPaths(t *testing.T, server *postTestServer, chunkTotal int) []string {
+	t.Helper()
+
+	requests := []*receivedPostRequest{}
+	for len(requests) < chunkTotal {
+		requests = append(requests, server.nextRequest(t))
+	}
+
+	sort.Slice(requests, func(i, j int) bool { return requests[i].chunk < requests[j].chunk })
+
+	paths := []string{}
+	for index, request := range requests {
+		if request.projectID != "test-project" || request.chunk != index+1 || request.chunkTotal != chunkTotal || request.timestamp != requests[0].timestamp {
+			t.Fatalf("Unexpected request: %+v", request)
+		}
+
+		for _, change := range request.changes {
+			if change.Type != "CREATE" {
+				t.Fatalf("Unexpected change: %+v", change)
+			}
+			paths = append(paths, change.Path)
+		}
+	}
+
+	return paths
+}
+
+func TestDeliveryModePostSendsChangesToServer(t *testing.T) {
+
+	server := newPostTestServer(t, nil, nil)
+	queue := newTestPostOutputQueue(t, server, 3)
+
+	h := sendBatchForTest(t, queue, DeliveryModePost, []string{"/a", "/b"})
+
+	if paths := receiveChunkGroupPaths(t, server, 1); strings.Join(paths, ",") != "/a,/b" {
+		t.Fatalf("Unexpected paths: %v", paths)
+	}
+
+	// cwctl must not be run
+	h.expectNoBatchSent(t)
+	server.expectNoRequest(t)
+}
+
+func TestDeliveryModeBothRunsCwctlAndSendsChunks(t *testing.T) {
+
+	server := newPostTestServer(t, &postCapabilitiesJSON{ChunkSize: 2, Encodings: []string{"json"}}, nil)
+	queue := newTestPostOutputQueue(t, server, 3)
+	waitForPostFormat(t, queue, PostQueueFormat{2, PostEncodingJSON})
+
+	h := sendBatchForTest(t, queue, DeliveryModeBoth, []string{"/a", "/b", "/c", "/d", "/e"})
+
+	h.expectBatchSent(t)
+
+	if paths := receiveChunkGroupPaths(t, server, 3); strings.Join(paths, ",") != "/a,/b,/c,/d,/e" {
+		t.Fatalf("Unexpected paths: %v", paths)
+	}
+
+	server.expectNoRequest(t)
+}
+
+func TestPostRequestsReuseConnections(t *testing.T) {
+
+	server := newPostTestServer(t, &postCapabilitiesJSON{ChunkSize: 1, Encodings: []string{"json"}}, nil)
+	queue := newTestPostOutputQueue(t, server, 1)
+	waitForPostFormat(t, queue, PostQueueFormat{1, PostEncodingJSON})
+
+	sendBatchForTest(t, queue, DeliveryModePost, []string{"/a", "/b", "/c", "/d"})
+
+	// With a single worker, each request is sent once the previous one has completed, on the same connection
+	remoteAddrs := map[string]bool{}
+	for index := 0; index < 4; index++ {
+		remoteAddrs[server.nextRequest(t).remoteAddr] = true
+	}
+	if len(remoteAddrs) != 1 {
+		t.Fatalf("Expected the requests to be sent on a single connection, but they were sent from: %v", remoteAddrs)
+	}
+}
+
+func TestZstdEncodedChangesAreDecodedByServer(t *testing.T) {
+
+	server := newPostTestServer(t, &postCapabilitiesJSON{ChunkSize: 10, Encodings: []string{"zstd"}}, nil)
+	queue := newTestPostOutputQueue(t, server, 3)
+	waitForPostFormat(t, queue, PostQueueFormat{10, PostEncodingZstd})
+
+	sendBatchForTest(t, queue, DeliveryModePost, []string{"/a", "/b", "/c"})
+
+	if paths := receiveChunkGroupPaths(t, server, 1); strings.Join(paths, ",") != "/a,/b,/c" {
+		t.Fatalf("Unexpected paths: %v", paths)
+	}
+}
+
+func TestCapabilitiesAreRenegotiatedAfterSuccessfulPost(t *testing.T) {
+
+	server := newPostTestServer(t, &postCapabilitiesJSON{ChunkSize: 2, Encodings: []string{"json"}}, nil)
+	server.setFailCapabilities(true)
+
+	queue := newTestPostOutputQueue(t, server, 3)
+
+	// Wait for the attempts to be exhausted
+	deadline := time.Now().Add(20 * time.Second)
+	for {
+		queue.format_synch_lock.Lock()
+		state := queue.capabilitiesState
+		queue.format_synch_lock.Unlock()
+
+		if state == capabilitiesFailed {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("Timed out waiting for the capabilities request to fail")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	if requests := server.getCapabilitiesRequests(); requests != maxCapabilitiesAttempts {
+		t.Fatalf("Unexpected number of capabilities requests: %d", requests)
+	}
+
+	// The default format is used in the meantime
+	if format := queue.GetPostFormat(); format != newDefaultPostQueueFormat() {
+		t.Fatalf("Unexpected format: %v", format)
+	}
+
+	server.setFailCapabilities(false)
+
+	sendBatchForTest(t, queue, DeliveryModePost, []string{"/a", "/b", "/c"})
+
+	// Sent with the default format, which holds every change in a single chunk
+	if paths := receiveChunkGroupPaths(t, server, 1); strings.Join(paths, ",") != "/a,/b,/c" {
+		t.Fatalf("Unexpected paths: %v", paths)
+	}
+
+	// The successful POST causes the capabilities to be requested again
+	waitForPostFormat(t, queue, PostQueueFormat{2, PostEncodingJSON})
+
+	sendBatchForTest(t, queue, DeliveryModePost, []string{"/d", "/e", "/f"})
+
+	if paths := receiveChunkGroupPaths(t, server, 2); strings.Join(paths, ",") != "/d,/e,/f" {
+		t.Fatalf("Unexpected paths: %v", paths)
+	}
+}
+
+func TestDeliveryModeCwctlDoesNotSendChanges(t *testing.T) {
+
+	server := newPostTestServer(t, nil, nil)
+	queue := newTestPostOutputQueue(t, server, 3)
+
+	h := sendBatchForTest(t, queue, DeliveryModeCwctl, []string{"/a"})
+
+	h.expectBatchSent(t)
+	server.expectNoRequest(t)
+}
+
+func TestChunkGroupsOfAProjectAreSentInTimestampOrder(t *testing.T) {
+
+	// The first request is held until the newer chunk group has been queued before the older one
+	release := make(chan struct{})
+	var once sync.Once
+
+	// Timestamp -> number of chunks acknowledged by the server
+	acknowledged := map[int64]int{}
+	var lock sync.Mutex
+
+	server := newPostTestServer(t, nil, func(request *receivedPostRequest) int {
+		if request.projectID == "blocking-project" {
+			once.Do(func() { <-release })
+			return http.StatusOK
+		}
+
+		lock.Lock()
+		defer lock.Unlock()
+
+		// No chunk of a chunk group may be sent before every chunk of the older groups has been acknowledged
+		if request.timestamp == 20 && acknowledged[19] != 3 {
+			t.Errorf("Chunk %d of timestamp 20 was sent before the chunks of timestamp 19 were acknowledged", request.chunk)
+		}
+		acknowledged[request.timestamp]++
+
+		return http.StatusOK
+	})
+
+	// A single worker, so that nothing else is sent while the first request is held
+	queue := newTestPostOutputQueue(t, server, 1)
+
+	queue.AddToQueue("blocking-project", 1, PostEncodingJSON, []string{`[{"path":"/x"}]`})
+
+	// Wait for the work manager to start the blocking request
+	deadline := time.Now().Add(10 * time.Second)
+	for (<-queue.RequestHealth()).ActiveWorkers == 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("Timed out waiting for the first request")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	queue.AddToQueue("test-project", 20, PostEncodingJSON, []string{`[{"path":"/20-1"}]`, `[{"path":"/20-2"}]`})
+	queue.AddToQueue("test-project", 19, PostEncodingJSON, []string{`[{"path":"/19-1"}]`, `[{"path":"/19-2"}]`, `[{"path":"/19-3"}]`})
+
+	close(release)
+
+	order := []string{}
+	for len(order) < 6 {
+		request := server.nextRequest(t)
+		order = append(order, request.changes[0].Path)
+	}
+
+	if order[0] != "/x" {
+		t.Fatalf("Unexpected first request: %v", order)
+	}
+
+	lock.Lock()
+	defer lock.Unlock()
+
+	if acknowledged[19] != 3 || acknowledged[20] != 2 {
+		t.Fatalf("Unexpected requests: %v", order)
+	}
+
+	for index, path := range order[1:] {
+		if (index < 3) != strings.HasPrefix(path, "/19-") {
+			t.Fatalf("Chunk groups were not sent in timestamp order: %v", order)
+		}
+	}
+}
+
+func TestChunkGroupPriorityListOrdersEachProjectByTimestamp(t *testing.T) {
+
+	list := NewChunkGroupPriorityList()
+
+	for _, group := range []struct {
+		projectID string
+		timestamp int64
+	}{{"a", 30}, {"b", 5}, {"a", 10}, {"a", 20}, {"b", 1}, {"a", 10}} {
+		list.AddToList(newPostQueueChunkGroup(group.projectID, group.timestamp, 0, PostEncodingJSON, 1, map[int]string{1: "[]"}))
+	}
+
+	if list.Len() != 6 {
+		t.Fatalf("Unexpected length: %d", list.Len())
+	}
+
+	// The projects are scheduled round-robin, in the order their lanes were created
+	if order := strings.Join(list.ProjectsInScheduleOrder(), ","); order != "a,b" {
+		t.Fatalf("Unexpected schedule order: %s", order)
+	}
+	list.MarkScheduled("a")
+	if order := strings.Join(list.ProjectsInScheduleOrder(), ","); order != "b,a" {
+		t.Fatalf("Unexpected schedule order: %s", order)
+	}
+
+	popAll := func(projectID string) []int64 {
+		result := []int64{}
+		for list.Peek(projectID) != nil {
+			result = append(result, list.Pop(projectID).timestamp)
+		}
+		return result
+	}
+
+	if timestamps := popAll("a"); len(timestamps) != 4 || timestamps[0] != 10 || timestamps[1] != 10 || timestamps[2] != 20 || timestamps[3] != 30 {
+		t.Fatalf("Unexpected order of project a: %v", timestamps)
+	}
+
+	// Once a project's lane is empty, it is no longer scheduled
+	if order := strings.Join(list.ProjectsInScheduleOrder(), ","); order != "b" {
+		t.Fatalf("Unexpected schedule order: %s", order)
+	}
+
+	if timestamps := popAll("b"); len(timestamps) != 2 || timestamps[0] != 1 || timestamps[1] != 5 {
+		t.Fatalf("Unexpected order of project b: %v", timestamps)
+	}
+
+	if list.Len() != 0 {
+		t.Fatalf("Unexpected length: %d", list.Len())
+	}
+}
+
+func TestFailingProjectDoesNotOccupyWorkersDuringBackoff(t *testing.T) {
+
+	var lock sync.Mutex
+	failuresRemaining := 2
+
+	server := newPostTestServer(t, nil, func(request *receivedPostRequest) int {
+		lock.Lock()
+		defer lock.Unlock()
+
+		if request.projectID == "failing-project" && failuresRemaining > 0 {
+			failuresRemaining--
+			return http.StatusInternalServerError
+		}
+		return http.StatusOK
+	})
+
+	// With a single worker, a worker that slept during the backoff delay would block the other project
+	queue := newTestPostOutputQueue(t, server, 1)
+
+	queue.AddToQueue("failing-project", 1, PostEncodingJSON, []string{`[{"path":"/a"}]`})
+
+	first := server.nextRequest(t)
+	firstTime := time.Now()
+	if first.projectID != "failing-project" {
+		t.Fatalf("Unexpected request: %+v", first)
+	}
+
+	queue.AddToQueue("other-project", 1, PostEncodingJSON, []string{`[{"path":"/b"}]`})
+
+	if request := server.nextRequest(t); request.projectID != "other-project" {
+		t.Fatalf("Expected the other project to be sent during the backoff delay, got: %+v", request)
+	}
+
+	// The failing project is retried once its backoff delay (200ms, then 300ms) has elapsed
+	second := server.nextRequest(t)
+	secondTime := time.Now()
+	third := server.nextRequest(t)
+	thirdTime := time.Now()
+
+	if second.projectID != "failing-project" || third.projectID != "failing-project" {
+		t.Fatalf("Unexpected requests: %+v %+v", second, third)
+	}
+
+	if secondTime.Sub(firstTime) < 150*time.Millisecond || thirdTime.Sub(secondTime) < 250*time.Millisecond {
+		t.Fatalf("Retries were not delayed by the backoff: %v %v", secondTime.Sub(firstTime), thirdTime.Sub(secondTime))
+	}
+
+	server.expectNoRequest(t)
+}
+
+func TestPruneProjectStates(t *testing.T) {
+
+	priorityList := NewChunkGroupPriorityList()
+	priorityList.AddToList(newPostQueueChunkGroup("waiting", 1, 0, PostEncodingJSON, 1, map[int]string{1: "[]"}))
+
+	projectStates := map[string]*postQueueProjectState{}
+	for _, projectID := range []string{"waiting", "in-flight", "deleted", "recovered"} {
+		getPostQueueProjectState(projectStates, projectID)
+	}
+
+	projectStates["waiting"].onFailure(&PostResponseError{500}, time.Now())
+	projectStates["in-flight"].inFlight = 1
+	projectStates["deleted"].onFailure(&PostResponseError{404}, time.Now())
+
+	pruneProjectStates(projectStates, priorityList)
+
+	if len(projectStates) != 2 || projectStates["waiting"] == nil || projectStates["in-flight"] == nil {
+		t.Fatalf("Unexpected project states after pruning: %v", projectStates)
+	}
+}
+
+func TestRetriedChunkHasSameIdempotencyKey(t *testing.T) {
+
+	var lock sync.Mutex
+	failuresRemaining := 1
+
+	server := newPostTestServer(t, nil, func(request *receivedPostRequest) int {
+		lock.Lock()
+		defer lock.Unlock()
+
+		if failuresRemaining > 0 {
+			failuresRemaining--
+			return http.StatusInternalServerError
+		}
+		return http.StatusOK
+	})
+
+	queue := newTestPostOutputQueue(t, server, 1)
+
+	queue.AddToQueue("test-project", 1, PostEncodingJSON, []string{`[{"path":"/a"}]`, `[{"path":"/b"}]`})
+
+	// The first chunk fails and is retried, after which the second chunk is sent
+	keysByChunk := map[int][]string{}
+	for index := 0; index < 3; index++ {
+		request := server.nextRequest(t)
+		keysByChunk[request.chunk] = append(keysByChunk[request.chunk], request.idempotencyKey)
+	}
+
+	if len(keysByChunk[1]) != 2 || len(keysByChunk[2]) != 1 {
+		t.Fatalf("Unexpected requests: %v", keysByChunk)
+	}
+
+	if keysByChunk[1][0] == "" || keysByChunk[1][0] != keysByChunk[1][1] {
+		t.Fatalf("Retry of a chunk did not have the same idempotency key: %v", keysByChunk[1])
+	}
+
+	if keysByChunk[1][0] == keysByChunk[2][0] {
+		t.Fatalf("Different chunks had the same idempotency key: %v", keysByChunk)
+	}
+
+	server.expectNoRequest(t)
+}
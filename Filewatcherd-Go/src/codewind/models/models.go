@@ -22,6 +22,30 @@ type ProjectToWatch struct {
 	Type                string         `json:"type"`
 	ProjectCreationTime int64          `json:"projectCreationTime"`
 	RefPaths            []RefPathEntry `json:"refPaths"`
+
+	// Optional: ignore files whose size (in bytes) is greater than this value; 0 disables the check
+	IgnoredFileSizeLimit int64 `json:"ignoredFileSizeLimit"`
+	// Optional: ignore sockets, named pipes (FIFOs), and device files
+	IgnoreNonRegularFiles bool `json:"ignoreNonRegularFiles"`
+	// Optional: ignore files that are detected as binary, either by extension or by their leading bytes
+	IgnoreBinaryFiles bool `json:"ignoreBinaryFiles"`
+	// Optional: file extensions (eg ".jar") that identify binary files; if empty, a default list is used
+	BinaryFileExtensions []string `json:"binaryFileExtensions"`
+
+	// Optional: per-project overrides of the global batch policy; 0 to use the global value
+	BatchQuietPeriodMsecs int64 `json:"batchQuietPeriodMsecs"`
+	BatchMaxSize          int   `json:"batchMaxSize"`
+
+	// Optional: per-project override of the global batch maximum latency; nil (absent) to use the global value, or 0
+	// to disable the maximum latency for this project
+	BatchMaxLatencyMsecs *int64 `json:"batchMaxLatencyMsecs,omitempty"`
+
+	// Optional: per-project overrides of the global directory compaction thresholds; 0 to use the global value
+	CompactionMinSubtreeSize int `json:"compactionMinSubtreeSize"`
+	CompactionMinBatchSize   int `json:"compactionMinBatchSize"`
+
+	// Optional: how file changes are communicated to the server: "cwctl", "post" or "both"; empty to use the global value
+	DeliveryMode string `json:"deliveryMode"`
 }
 
 // RefPathEntry ...
@@ -66,6 +90,20 @@ func (entry *ProjectToWatch) Clone() *ProjectToWatch {
 		}
 	}
 
+	var newBinaryFileExtensions []string
+	if entry.BinaryFileExtensions != nil {
+		newBinaryFileExtensions = make([]string, 0)
+		for _, val := range entry.BinaryFileExtensions {
+			newBinaryFileExtensions = append(newBinaryFileExtensions, val)
+		}
+	}
+
+	var newBatchMaxLatencyMsecs *int64
+	if entry.BatchMaxLatencyMsecs != nil {
+		value := *entry.BatchMaxLatencyMsecs
+		newBatchMaxLatencyMsecs = &value
+	}
+
 	return &ProjectToWatch{
 		newIgnoredFilenames,
 		newIgnoredPaths,
@@ -76,6 +114,16 @@ func (entry *ProjectToWatch) Clone() *ProjectToWatch {
 		entry.Type,
 		entry.ProjectCreationTime,
 		newRefPaths,
+		entry.IgnoredFileSizeLimit,
+		entry.IgnoreNonRegularFiles,
+		entry.IgnoreBinaryFiles,
+		newBinaryFileExtensions,
+		entry.BatchQuietPeriodMsecs,
+		entry.BatchMaxSize,
+		newBatchMaxLatencyMsecs,
+		entry.CompactionMinSubtreeSize,
+		entry.CompactionMinBatchSize,
+		entry.DeliveryMode,
 	}
 }
 
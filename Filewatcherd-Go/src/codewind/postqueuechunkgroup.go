@@ -33,19 +33,29 @@ const (
  * - WAITING_FOR_ACK: Chunks in this state are in the process of being sent by one of the workers.
  * - COMPLETE: Chunks in this state have been sent and acknowledged by the server.
  *
- * The primary goal of chunk groups is to ensure that chunks will never be sent
- * to the server out of ascending-timestamp order: eg we will never send the
- * server a chunk of 'timestamp 20', then a chunk of 'timestamp 19'. The
- * 'timestamp 20' chunks will wait for all of the 'timestamp 19' chunks to be
- * sent.
+ * The primary goal of chunk groups is to ensure that chunks of a project will
+ * never be sent to the server out of ascending-timestamp order: eg we will never
+ * send the server a chunk of 'timestamp 20', then a chunk of 'timestamp 19'. The
+ * 'timestamp 20' chunks will wait for all of the 'timestamp 19' chunks of the
+ * same project to be sent.
  *
  * This class is thread safe.
  */
 type PostQueueChunkGroup struct {
 	chunkMap          map[int] /*chunk id -> */ *PostQueueChunk
 	chunkStatus       map[int] /*chunk id -> */ ChunkStatus
+	projectID         string
 	timestamp         int64
 	expireTimeInNanos int64
+
+	/** The encoding of the payload of each of the chunks */
+	encoding PostEncoding
+
+	/** The file that persists this chunk group in the outbox directory; empty if the outbox is not enabled */
+	outboxFile string
+
+	/** True if the chunk group was removed from the queue because the server permanently rejected it */
+	deadLettered bool
 }
 
 /**
@@ -59,11 +69,42 @@ type PostQueueChunk struct {
 	/** The ID of a chunk will be 1 <= id <= chunkTotal */
 	chunkID int
 	/** The total # of chunks that will e sent for this project id and timestamp. */
-	chunkTotal       int
-	base64Compressed string
-	projectID        string
-	timestamp        int64
-	parent           *PostQueueChunkGroup
+	chunkTotal int
+	/** The change list of the chunk, encoded with the chunk group's encoding */
+	payload   string
+	projectID string
+	timestamp int64
+	parent    *PostQueueChunkGroup
+}
+
+/** Create a chunk group containing the given chunks (chunk id -> encoded payload), all available to send. */
+func newPostQueueChunkGroup(projectID string, timestamp int64, expireTimeInNanos int64, encoding PostEncoding, chunkTotal int, chunks map[int]string) *PostQueueChunkGroup {
+
+	chunkGroup := &PostQueueChunkGroup{
+		chunkMap:          make(map[int]*PostQueueChunk, 0),
+		chunkStatus:       make(map[int]ChunkStatus, 0),
+		projectID:         projectID,
+		timestamp:         timestamp,
+		expireTimeInNanos: expireTimeInNanos,
+		encoding:          encoding,
+	}
+
+	for chunkID, payload := range chunks {
+
+		chunk := &PostQueueChunk{
+			chunkID:    chunkID,
+			chunkTotal: chunkTotal,
+			payload:    payload,
+			projectID:  projectID,
+			timestamp:  timestamp,
+			parent:     chunkGroup,
+		}
+
+		chunkGroup.chunkMap[chunk.chunkID] = chunk
+		chunkGroup.chunkStatus[chunk.chunkID] = AVAILABLE_TO_SEND
+	}
+
+	return chunkGroup
 }
 
 func (pqcg *PostQueueChunkGroup) IsGroupComplete() bool {
@@ -79,15 +120,18 @@ func (pqcg *PostQueueChunkGroup) IsGroupComplete() bool {
 	return true
 }
 
-func (pqcg *PostQueueChunkGroup) AcquireNextChunkAvailableToSend() *PostQueueChunk {
+/**
+ * Returns the available chunk with the lowest chunk ID (without changing its status), or nil if there are none; the
+ * same chunk is returned by the next call to AcquireNextChunkAvailableToSend().
+ */
+func (pqcg *PostQueueChunkGroup) PeekNextChunkAvailableToSend() *PostQueueChunk {
 
 	match := -1
 
 	for key, val := range pqcg.chunkStatus {
 
-		if val == AVAILABLE_TO_SEND {
+		if val == AVAILABLE_TO_SEND && (match == -1 || key < match) {
 			match = key
-			break
 		}
 	}
 
@@ -95,11 +139,21 @@ func (pqcg *PostQueueChunkGroup) AcquireNextChunkAvailableToSend() *PostQueueChu
 		return nil
 	}
 
-	pqcg.chunkStatus[match] = WAITING_FOR_ACK
-
 	return pqcg.chunkMap[match]
 }
 
+func (pqcg *PostQueueChunkGroup) AcquireNextChunkAvailableToSend() *PostQueueChunk {
+
+	match := pqcg.PeekNextChunkAvailableToSend()
+	if match == nil {
+		return nil
+	}
+
+	pqcg.chunkStatus[match.chunkID] = WAITING_FOR_ACK
+
+	return match
+}
+
 func (pqcg *PostQueueChunkGroup) InformChunkSent(chunk *PostQueueChunk) {
 
 	currStatus := pqcg.chunkStatus[chunk.chunkID]
@@ -0,0 +1,207 @@
+/*******************************************************************************
+* Copyright (c) 2020 IBM Corporation and others.
+* All rights reserved. This program and the accompanying materials
+* are made available under the terms of the Eclipse Public License v2.0
+* which accompanies this distribution, and is available at
+* http://www.eclipse.org/legal/epl-v20.html
+*
+* Contributors:
+*     IBM Corporation - initial API and implementation
+*******************************************************************************/
+
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"compress/zlib"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// PostEncoding is the format of the change list in the body of an HTTP POST request.
+type PostEncoding string
+
+const (
+	// PostEncodingZlib is a zlib-compressed, base64-encoded change list; this is the original format, and is used when
+	// the server does not advertise its capabilities.
+	PostEncodingZlib PostEncoding = "zlib"
+
+	// PostEncodingGzip is a gzip-compressed, base64-encoded change list
+	PostEncodingGzip PostEncoding = "gzip"
+
+	// PostEncodingZstd is a zstd-compressed, base64-encoded change list
+	PostEncodingZstd PostEncoding = "zstd"
+
+	// PostEncodingJSON is the uncompressed change list, as a JSON array in the request body
+	PostEncodingJSON PostEncoding = "json"
+)
+
+const (
+	// The maximum number of change entries in a chunk, if the server does not specify one
+	defaultPostChunkSize = 625
+
+	// The maximum chunk size that the server may request
+	maxPostChunkSize = 100000
+
+	// The server's capabilities, returned by a GET request to this path (relative to the base URL)
+	postCapabilitiesPath = "/api/v1/filewatcher/capabilities"
+
+	// Response headers by which the server may update its chunk size and encoding preferences at any time
+	postChunkSizeHeader = "X-Filewatcher-Chunk-Size"
+	postEncodingsHeader = "X-Filewatcher-Accept-Encoding"
+)
+
+// PostQueueFormat is the chunk size and encoding that are used to send change lists to the server.
+type PostQueueFormat struct {
+	ChunkSize int
+	Encoding  PostEncoding
+}
+
+// The response body of the capabilities endpoint.
+type postCapabilitiesJSON struct {
+	ChunkSize int      `json:"chunkSize"`
+	Encodings []string `json:"encodings"` // In descending order of server preference
+}
+
+// The body of a POST request: 'msg' contains the encoded change list, or, for the JSON encoding, 'changes' contains
+// the change list itself. 'encoding' is omitted for zlib, so that the body is unchanged for older servers.
+type postRequestBodyJSON struct {
+	Msg      string          `json:"msg,omitempty"`
+	Changes  json.RawMessage `json:"changes,omitempty"`
+	Encoding PostEncoding    `json:"encoding,omitempty"`
+}
+
+func newDefaultPostQueueFormat() PostQueueFormat {
+	return PostQueueFormat{defaultPostChunkSize, PostEncodingZlib}
+}
+
+func (format PostQueueFormat) String() string {
+	return "chunk-size: " + strconv.Itoa(format.ChunkSize) + "  encoding: " + string(format.Encoding)
+}
+
+func isSupportedPostEncoding(encoding PostEncoding) bool {
+	return encoding == PostEncodingZlib || encoding == PostEncodingGzip || encoding == PostEncodingZstd || encoding == PostEncodingJSON
+}
+
+/**
+ * Returns the format to use given the server's preferences: chunkSize is ignored if <= 0, and the first supported
+ * encoding in 'encodings' is used. Values that are not specified (or not supported) are taken from 'current'.
+ */
+func negotiatePostFormat(current PostQueueFormat, chunkSize int, encodings []string) PostQueueFormat {
+
+	result := current
+
+	if chunkSize > maxPostChunkSize {
+		chunkSize = maxPostChunkSize
+	}
+	if chunkSize > 0 {
+		result.ChunkSize = chunkSize
+	}
+
+	for _, encodingStr := range encodings {
+		encoding := PostEncoding(strings.ToLower(strings.TrimSpace(encodingStr)))
+		if isSupportedPostEncoding(encoding) {
+			result.Encoding = encoding
+			break
+		}
+	}
+
+	return result
+}
+
+/** Returns the format requested by the response headers (if any), and whether any such headers were present. */
+func negotiatePostFormatFromHeaders(current PostQueueFormat, header http.Header) (PostQueueFormat, bool) {
+
+	chunkSizeStr := strings.TrimSpace(header.Get(postChunkSizeHeader))
+	encodingsStr := strings.TrimSpace(header.Get(postEncodingsHeader))
+
+	if chunkSizeStr == "" && encodingsStr == "" {
+		return current, false
+	}
+
+	chunkSize := 0
+	if chunkSizeStr != "" {
+		if value, err := strconv.Atoi(chunkSizeStr); err == nil {
+			chunkSize = value
+		}
+	}
+
+	var encodings []string
+	if encodingsStr != "" {
+		encodings = strings.Split(encodingsStr, ",")
+	}
+
+	return negotiatePostFormat(current, chunkSize, encodings), true
+}
+
+/** Parse the body of a capabilities response into a format. */
+func negotiatePostFormatFromCapabilities(current PostQueueFormat, body io.Reader) (PostQueueFormat, error) {
+
+	var capabilities postCapabilitiesJSON
+	if err := json.NewDecoder(body).Decode(&capabilities); err != nil {
+		return current, err
+	}
+
+	return negotiatePostFormat(current, capabilities.ChunkSize, capabilities.Encodings), nil
+}
+
+/** Convert the JSON change list into a chunk payload, with the given encoding. */
+func encodeChangeList(changeListJSON []byte, encoding PostEncoding) (string, error) {
+
+	if encoding == PostEncodingJSON {
+		return string(changeListJSON), nil
+	}
+
+	var b bytes.Buffer
+	var w io.WriteCloser
+
+	if encoding == PostEncodingZlib {
+		w = zlib.NewWriter(&b)
+	} else if encoding == PostEncodingGzip {
+		w = gzip.NewWriter(&b)
+	} else if encoding == PostEncodingZstd {
+		encoder, err := zstd.NewWriter(&b)
+		if err != nil {
+			return "", err
+		}
+		w = encoder
+	} else {
+		return "", errors.New("Unsupported encoding: " + string(encoding))
+	}
+
+	if _, err := w.Write(changeListJSON); err != nil {
+		return "", err
+	}
+
+	if err := w.Close(); err != nil {
+		return "", err
+	}
+
+	return base64.StdEncoding.EncodeToString(b.Bytes()), nil
+}
+
+/** Construct the body of the POST request for a chunk payload. */
+func newPostRequestBody(payload string, encoding PostEncoding) ([]byte, error) {
+
+	body := postRequestBodyJSON{}
+
+	if encoding == PostEncodingJSON {
+		body.Changes = json.RawMessage(payload)
+		body.Encoding = encoding
+	} else {
+		body.Msg = payload
+		if encoding != PostEncodingZlib {
+			body.Encoding = encoding
+		}
+	}
+
+	return json.Marshal(body)
+}
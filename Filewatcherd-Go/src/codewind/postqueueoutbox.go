@@ -0,0 +1,339 @@
+/*******************************************************************************
+* Copyright (c) 2020 IBM Corporation and others.
+* All rights reserved. This program and the accompanying materials
+* are made available under the terms of the Eclipse Public License v2.0
+* which accompanies this distribution, and is available at
+* http://www.eclipse.org/legal/epl-v20.html
+*
+* Contributors:
+*     IBM Corporation - initial API and implementation
+*******************************************************************************/
+
+package main
+
+import (
+	"codewind/utils"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// PostQueueOutbox is an optional write-ahead log of the chunk groups in the HTTP POST output queue, so that pending
+// file change notifications are not lost if the filewatcher is stopped (or crashes) while the server is unreachable.
+//
+//   - Each chunk group is written to its own file in the outbox directory before it is added to the queue.
+//   - When the server acknowledges a chunk, the group's file is rewritten without that chunk; once all of the chunks of
+//     a group have been acknowledged (or the group has expired), the file is deleted.
+//   - On startup, any existing files are read and the chunk groups are replayed, in ascending timestamp order.
+//
+// Files are always written to a temporary file and then renamed, so a crash during a write will never leave a
+// partially written outbox file (at worst, an orphaned temporary file, which is deleted on the next startup). The
+// directory is flushed to disk after each rename and delete, so that a change to the outbox is not lost (and a
+// deleted file does not reappear) after a power failure.
+//
+// This class is not thread safe: after startup, it should only be called from the HTTP POST output queue's work
+// manager goroutine (AddToQueue writes new groups before passing them to that goroutine, which is safe as each
+// group has its own file).
+type PostQueueOutbox struct {
+	directory string
+}
+
+const (
+	outboxFileSuffix     = ".chunkgroup.json"
+	outboxTempFilePrefix = ".tmp-"
+)
+
+// The on-disk format of a single chunk group.
+type outboxChunkGroupJSON struct {
+	ProjectID         string         `json:"projectID"`
+	Timestamp         int64          `json:"timestamp"`
+	ExpireTimeInNanos int64          `json:"expireTimeInNanos"`
+	Encoding          PostEncoding   `json:"encoding,omitempty"` // Empty for files written before encodings were negotiated (zlib)
+	ChunkTotal        int            `json:"chunkTotal"`
+	Chunks            map[int]string `json:"chunks"` // chunk id -> encoded payload, of chunks not yet acknowledged
+}
+
+// NewPostQueueOutbox creates the outbox directory, if needed, and removes any temporary files left by a previous crash.
+func NewPostQueueOutbox(directory string) (*PostQueueOutbox, error) {
+
+	if strings.TrimSpace(directory) == "" {
+		return nil, errors.New("Outbox directory is empty")
+	}
+
+	err := os.MkdirAll(directory, 0700)
+	if err != nil {
+		return nil, err
+	}
+
+	files, err := ioutil.ReadDir(directory)
+	if err != nil {
+		return nil, err
+	}
+
+	removed := false
+	for _, file := range files {
+		if strings.HasPrefix(file.Name(), outboxTempFilePrefix) {
+			utils.LogInfo("Removing incomplete outbox file: " + file.Name())
+			os.Remove(filepath.Join(directory, file.Name()))
+			removed = true
+		}
+	}
+
+	if removed {
+		if err := syncDirectory(directory); err != nil {
+			return nil, err
+		}
+	}
+
+	return &PostQueueOutbox{directory}, nil
+}
+
+// ReadChunkGroups returns the chunk groups that were previously persisted, sorted ascending by timestamp.
+func (outbox *PostQueueOutbox) ReadChunkGroups() []*PostQueueChunkGroup {
+
+	result := []*PostQueueChunkGroup{}
+
+	files, err := ioutil.ReadDir(outbox.directory)
+	if err != nil {
+		utils.LogSevereErr("Unable to read outbox directory: "+outbox.directory, err)
+		return result
+	}
+
+	for _, file := range files {
+
+		if file.IsDir() || !strings.HasSuffix(file.Name(), outboxFileSuffix) {
+			continue
+		}
+
+		path := filepath.Join(outbox.directory, file.Name())
+
+		contents, err := ioutil.ReadFile(path)
+		if err != nil {
+			utils.LogSevereErr("Unable to read outbox file: "+path, err)
+			continue
+		}
+
+		var groupJSON outboxChunkGroupJSON
+		err = json.Unmarshal(contents, &groupJSON)
+		if err != nil || groupJSON.ChunkTotal <= 0 {
+			utils.LogSevereErr("Removing invalid outbox file: "+path, err)
+			os.Remove(path)
+			continue
+		}
+
+		if groupJSON.Encoding == "" {
+			groupJSON.Encoding = PostEncodingZlib
+		}
+
+		chunkGroup := newPostQueueChunkGroup(groupJSON.ProjectID, groupJSON.Timestamp, groupJSON.ExpireTimeInNanos, groupJSON.Encoding, groupJSON.ChunkTotal, groupJSON.Chunks)
+		chunkGroup.outboxFile = path
+
+		result = append(result, chunkGroup)
+	}
+
+	sort.SliceStable(result, func(i, j int) bool {
+		return result[i].timestamp < result[j].timestamp
+	})
+
+	utils.LogInfo("Read " + strconv.Itoa(len(result)) + " chunk group(s) from outbox directory " + outbox.directory)
+
+	return result
+}
+
+// WriteChunkGroup persists the unacknowledged chunks of the chunk group, replacing any previous version of the group's
+// file. If all of the chunks have been acknowledged, the file is removed instead.
+func (outbox *PostQueueOutbox) WriteChunkGroup(chunkGroup *PostQueueChunkGroup) error {
+
+	if chunkGroup.outboxFile == "" {
+		uuid := utils.GenerateUuid()
+		if uuid == nil {
+			return errors.New("Unable to generate outbox file name")
+		}
+		chunkGroup.outboxFile = filepath.Join(outbox.directory, strconv.FormatInt(chunkGroup.timestamp, 10)+"-"+*uuid+outboxFileSuffix)
+	}
+
+	groupJSON := outboxChunkGroupJSON{
+		ExpireTimeInNanos: chunkGroup.expireTimeInNanos,
+		Timestamp:         chunkGroup.timestamp,
+		Encoding:          chunkGroup.encoding,
+		Chunks:            make(map[int]string),
+	}
+
+	for chunkID, chunk := range chunkGroup.chunkMap {
+		groupJSON.ProjectID = chunk.projectID
+		groupJSON.ChunkTotal = chunk.chunkTotal
+
+		if chunkGroup.chunkStatus[chunkID] != COMPLETE {
+			groupJSON.Chunks[chunkID] = chunk.payload
+		}
+	}
+
+	if len(groupJSON.Chunks) == 0 {
+		return outbox.RemoveChunkGroup(chunkGroup)
+	}
+
+	contents, err := json.Marshal(groupJSON)
+	if err != nil {
+		return err
+	}
+
+	return writeFileAtomically(chunkGroup.outboxFile, contents)
+}
+
+// RemoveChunkGroup deletes the chunk group's file, if it exists.
+func (outbox *PostQueueOutbox) RemoveChunkGroup(chunkGroup *PostQueueChunkGroup) error {
+
+	if chunkGroup.outboxFile == "" {
+		return nil
+	}
+
+	err := os.Remove(chunkGroup.outboxFile)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	return syncDirectory(filepath.Dir(chunkGroup.outboxFile))
+}
+
+// MoveToDeadLetter moves the chunk group's file (if it exists) into the 'deadletter' subdirectory of the outbox, where
+// it is retained for diagnosis, but is not replayed on startup.
+func (outbox *PostQueueOutbox) MoveToDeadLetter(chunkGroup *PostQueueChunkGroup) error {
+
+	if chunkGroup.outboxFile == "" {
+		return nil
+	}
+
+	if _, err := os.Stat(chunkGroup.outboxFile); os.IsNotExist(err) {
+		return nil
+	}
+
+	deadLetterDirectory := filepath.Join(outbox.directory, "deadletter")
+	if err := os.MkdirAll(deadLetterDirectory, 0700); err != nil {
+		return err
+	}
+
+	if err := os.Rename(chunkGroup.outboxFile, filepath.Join(deadLetterDirectory, filepath.Base(chunkGroup.outboxFile))); err != nil {
+		return err
+	}
+
+	if err := syncDirectory(deadLetterDirectory); err != nil {
+		return err
+	}
+
+	return syncDirectory(outbox.directory)
+}
+
+// MigrateLegacyOutboxFiles moves the chunk group files from the root of the outbox directory (where they were written
+// before each server had its own subdirectory) into the server's subdirectory, so that they are replayed to the
+// server.
+func MigrateLegacyOutboxFiles(rootDirectory string, serverDirectory string) error {
+
+	files, err := ioutil.ReadDir(rootDirectory)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+
+	migrated := 0
+
+	for _, file := range files {
+
+		if file.IsDir() || !strings.HasSuffix(file.Name(), outboxFileSuffix) {
+			continue
+		}
+
+		if migrated == 0 {
+			if err := os.MkdirAll(serverDirectory, 0700); err != nil {
+				return err
+			}
+		}
+
+		if err := os.Rename(filepath.Join(rootDirectory, file.Name()), filepath.Join(serverDirectory, file.Name())); err != nil {
+			return err
+		}
+
+		migrated++
+	}
+
+	if migrated == 0 {
+		return nil
+	}
+
+	utils.LogInfo("Moved " + strconv.Itoa(migrated) + " chunk group(s) from outbox directory " + rootDirectory + " to " + serverDirectory)
+
+	if err := syncDirectory(serverDirectory); err != nil {
+		return err
+	}
+
+	return syncDirectory(rootDirectory)
+}
+
+/**
+ * Write the contents to a temporary file in the same directory, flush it to disk, then rename it over 'path', and
+ * flush the directory.
+ */
+func writeFileAtomically(path string, contents []byte) error {
+
+	tempFile, err := ioutil.TempFile(filepath.Dir(path), outboxTempFilePrefix)
+	if err != nil {
+		return err
+	}
+
+	_, err = tempFile.Write(contents)
+	if err == nil {
+		err = tempFile.Sync()
+	}
+
+	closeErr := tempFile.Close()
+	if err == nil {
+		err = closeErr
+	}
+
+	if err != nil {
+		os.Remove(tempFile.Name())
+		return err
+	}
+
+	err = os.Rename(tempFile.Name(), path)
+	if err != nil {
+		os.Remove(tempFile.Name())
+		return err
+	}
+
+	return syncDirectory(filepath.Dir(path))
+}
+
+/**
+ * Flush the directory entries of the directory to disk, so that a preceding rename or delete within it is durable.
+ * Directories cannot be flushed on Windows, where renames are durable once the file has been flushed.
+ */
+func syncDirectory(directory string) error {
+
+	if runtime.GOOS == "windows" {
+		return nil
+	}
+
+	dir, err := os.Open(directory)
+	if err != nil {
+		return err
+	}
+
+	err = dir.Sync()
+
+	closeErr := dir.Close()
+	if err == nil {
+		err = closeErr
+	}
+
+	return err
+}
@@ -0,0 +1,115 @@
+/*******************************************************************************
+* Copyright (c) 2020 IBM Corporation and others.
+* All rights reserved. This program and the accompanying materials
+* are made available under the terms of the Eclipse Public License v2.0
+* which accompanies this distribution, and is available at
+* http://www.eclipse.org/legal/epl-v20.html
+*
+* Contributors:
+*     IBM Corporation - initial API and implementation
+*******************************************************************************/
+
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestOutboxCompactsAndRemovesChunkGroups(t *testing.T) {
+
+	directory, err := ioutil.TempDir("", "outbox-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(directory)
+
+	// A temporary file left by a crash is removed on startup
+	if err := ioutil.WriteFile(filepath.Join(directory, outboxTempFilePrefix+"crash"), []byte("{"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	outbox, err := NewPostQueueOutbox(directory)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	chunkGroup := newPostQueueChunkGroup("test-project", 10, 20, PostEncodingJSON, 2, map[int]string{1: "[1]", 2: "[2]"})
+	if err := outbox.WriteChunkGroup(chunkGroup); err != nil {
+		t.Fatal(err)
+	}
+
+	// The first chunk is acknowledged, so only the second is replayed
+	chunk := chunkGroup.AcquireNextChunkAvailableToSend()
+	chunkGroup.InformChunkSent(chunk)
+	if err := outbox.WriteChunkGroup(chunkGroup); err != nil {
+		t.Fatal(err)
+	}
+
+	replayed := outbox.ReadChunkGroups()
+	if len(replayed) != 1 || len(replayed[0].chunkMap) != 1 || replayed[0].chunkMap[2].payload != "[2]" || replayed[0].chunkMap[2].chunkTotal != 2 {
+		t.Fatalf("Unexpected replayed chunk groups: %+v", replayed)
+	}
+
+	// Once every chunk is acknowledged, the file is removed
+	chunk = chunkGroup.AcquireNextChunkAvailableToSend()
+	chunkGroup.InformChunkSent(chunk)
+	if err := outbox.WriteChunkGroup(chunkGroup); err != nil {
+		t.Fatal(err)
+	}
+
+	files, err := ioutil.ReadDir(directory)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != 0 {
+		t.Fatalf("Expected an empty outbox, found %d file(s), first: %s", len(files), files[0].Name())
+	}
+}
+
+func TestLegacyOutboxFilesAreMigratedToServerDirectory(t *testing.T) {
+
+	root, err := ioutil.TempDir("", "outbox-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	// A chunk group written to the root directory, before each server had its own subdirectory
+	legacyOutbox, err := NewPostQueueOutbox(root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := legacyOutbox.WriteChunkGroup(newPostQueueChunkGroup("test-project", 10, 20, PostEncodingJSON, 1, map[int]string{1: "[1]"})); err != nil {
+		t.Fatal(err)
+	}
+
+	serverDirectory := filepath.Join(root, serverDirectoryName("http://localhost:9090"))
+
+	if err := MigrateLegacyOutboxFiles(root, serverDirectory); err != nil {
+		t.Fatal(err)
+	}
+
+	if replayed := legacyOutbox.ReadChunkGroups(); len(replayed) != 0 {
+		t.Fatalf("Chunk groups were left in the root directory: %+v", replayed)
+	}
+
+	outbox, err := NewPostQueueOutbox(serverDirectory)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if replayed := outbox.ReadChunkGroups(); len(replayed) != 1 || replayed[0].projectID != "test-project" || replayed[0].chunkMap[1].payload != "[1]" {
+		t.Fatalf("Unexpected replayed chunk groups: %+v", replayed)
+	}
+
+	// Once migrated, there is nothing more to move
+	if err := MigrateLegacyOutboxFiles(root, serverDirectory); err != nil {
+		t.Fatal(err)
+	}
+	if replayed := outbox.ReadChunkGroups(); len(replayed) != 1 {
+		t.Fatalf("Unexpected replayed chunk groups: %+v", replayed)
+	}
+}
@@ -0,0 +1,203 @@
+/*******************************************************************************
+* Copyright (c) 2020 IBM Corporation and others.
+* All rights reserved. This program and the accompanying materials
+* are made available under the terms of the Eclipse Public License v2.0
+* which accompanies this distribution, and is available at
+* http://www.eclipse.org/legal/epl-v20.html
+*
+* Contributors:
+*     IBM Corporation - initial API and implementation
+*******************************************************************************/
+
+package main
+
+import (
+	"codewind/utils"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+const (
+	// After this many consecutive transient failures of a project, the project's circuit breaker opens
+	circuitBreakerFailureThreshold = 8
+
+	// How long the circuit breaker stays open, before a single trial request is allowed
+	circuitBreakerOpenDuration = 60 * time.Second
+
+	// A chunk group is dead-lettered once its chunks have failed with a permanent error this many times in a row
+	permanentFailureDeadLetterThreshold = 3
+
+	// The maximum number of dead-lettered chunk groups that are kept for debug output
+	maxDeadLetterEntries = 50
+)
+
+type circuitBreakerState int
+
+const (
+	circuitClosed circuitBreakerState = iota + 1
+	circuitOpen
+	circuitHalfOpen
+)
+
+// PostResponseError is returned by sendPost when the server responds with a status code other than 200.
+type PostResponseError struct {
+	StatusCode int
+}
+
+func (e *PostResponseError) Error() string {
+	return "Response code was != 200: " + strconv.Itoa(e.StatusCode)
+}
+
+// IsPermanent returns true if retrying the same request will not succeed: client errors (4xx), other than request
+// timeout and too many requests. Server errors (5xx) and network errors are considered transient.
+func (e *PostResponseError) IsPermanent() bool {
+	return e.StatusCode >= 400 && e.StatusCode < 500 && e.StatusCode != http.StatusRequestTimeout && e.StatusCode != http.StatusTooManyRequests
+}
+
+func isPermanentPostFailure(err error) bool {
+	if respErr, ok := err.(*PostResponseError); ok {
+		return respErr.IsPermanent()
+	}
+	return false
+}
+
+/**
+ * The delivery state of a single project in the HTTP POST output queue: each project has its own backoff and circuit
+ * breaker, so that a project whose requests are failing (for example, because it was deleted on the server) does
+ * not slow delivery for other projects.
+ *
+ * Circuit breaker:
+ * - closed: requests are sent normally (once the project's backoff delay has elapsed, if the previous request failed)
+ * - open: after X consecutive transient failures, no requests are sent for the project for Y seconds
+ * - half-open: after Y seconds, a single trial request is sent; on success the circuit closes, on failure it reopens.
+ *
+ * This class is not thread safe; it should only be used by the HTTP POST output queue's work manager goroutine.
+ */
+type postQueueProjectState struct {
+	projectID string
+
+	backoff utils.ExponentialBackoff
+
+	/** After a failure, no request is sent for this project until this time (zero if the last request succeeded) */
+	nextAttempt time.Time
+
+	circuit          circuitBreakerState
+	circuitOpenUntil time.Time
+
+	consecutiveFailures          int
+	consecutivePermanentFailures int
+
+	/** The number of requests for this project currently being sent */
+	inFlight int
+
+	lastError string
+}
+
+func newPostQueueProjectState(projectID string) *postQueueProjectState {
+	return &postQueueProjectState{
+		projectID: projectID,
+		backoff:   utils.NewExponentialBackoff(),
+		circuit:   circuitClosed,
+	}
+}
+
+/**
+ * Returns true if a new request may be sent for this project, updating the circuit state if the open period has
+ * elapsed. Requests are never sent before the project's backoff delay has elapsed.
+ */
+func (state *postQueueProjectState) canSchedule(now time.Time) bool {
+
+	if now.Before(state.nextAttempt) {
+		return false
+	}
+
+	if state.circuit == circuitOpen && !now.Before(state.circuitOpenUntil) {
+		utils.LogInfo("Circuit breaker is now half-open for project " + state.projectID)
+		state.circuit = circuitHalfOpen
+	}
+
+	if state.circuit == circuitOpen {
+		return false
+	}
+
+	if state.circuit == circuitHalfOpen {
+		// Only a single trial request at a time
+		return state.inFlight == 0
+	}
+
+	return true
+}
+
+func (state *postQueueProjectState) onSuccess() {
+
+	if state.circuit != circuitClosed {
+		utils.LogInfo("Circuit breaker closed for project " + state.projectID)
+	}
+
+	state.circuit = circuitClosed
+	state.consecutiveFailures = 0
+	state.consecutivePermanentFailures = 0
+	state.backoff.SuccessReset()
+	state.nextAttempt = time.Time{}
+}
+
+/** Update the state after a failed request; returns true if the chunk group should be dead-lettered. */
+func (state *postQueueProjectState) onFailure(err error, now time.Time) bool {
+
+	state.lastError = err.Error()
+	state.consecutiveFailures++
+	state.backoff.FailIncrease()
+	state.nextAttempt = now.Add(time.Duration(state.backoff.GetFailureDelay()) * time.Millisecond)
+
+	if isPermanentPostFailure(err) {
+		state.consecutivePermanentFailures++
+		if state.consecutivePermanentFailures >= permanentFailureDeadLetterThreshold {
+			state.consecutivePermanentFailures = 0
+			return true
+		}
+		return false
+	}
+
+	state.consecutivePermanentFailures = 0
+
+	if state.circuit == circuitHalfOpen || state.consecutiveFailures >= circuitBreakerFailureThreshold {
+		if state.circuit != circuitOpen {
+			utils.LogError("Circuit breaker opened for project " + state.projectID + " after " + strconv.Itoa(state.consecutiveFailures) + " consecutive failures; last error: " + state.lastError)
+		}
+		state.circuit = circuitOpen
+		state.circuitOpenUntil = now.Add(circuitBreakerOpenDuration)
+	}
+
+	return false
+}
+
+func (state *postQueueProjectState) toDebugString() string {
+
+	result := "  - projectID: " + state.projectID + "  in-flight: " + strconv.Itoa(state.inFlight) +
+		"  consecutive-failures: " + strconv.Itoa(state.consecutiveFailures) + "  failure-delay: " + strconv.Itoa(state.backoff.GetFailureDelay())
+
+	if state.circuit == circuitOpen {
+		result += "  circuit: open until " + utils.FormatTime(state.circuitOpenUntil)
+	} else if state.circuit == circuitHalfOpen {
+		result += "  circuit: half-open"
+	}
+
+	if state.lastError != "" {
+		result += "  last-error: " + state.lastError
+	}
+
+	return result
+}
+
+/** A record of a chunk group that was dead-lettered, for debug output */
+type deadLetterEntry struct {
+	projectID string
+	timestamp int64
+	reason    string
+	time      time.Time
+}
+
+func (entry deadLetterEntry) toDebugString() string {
+	return "  - projectID: " + entry.projectID + "  timestamp: " + strconv.FormatInt(entry.timestamp, 10) + "  at: " + utils.FormatTime(entry.time) + "  reason: " + entry.reason
+}
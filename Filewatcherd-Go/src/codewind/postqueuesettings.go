@@ -0,0 +1,93 @@
+/*******************************************************************************
+* Copyright (c) 2020 IBM Corporation and others.
+* All rights reserved. This program and the accompanying materials
+* are made available under the terms of the Eclipse Public License v2.0
+* which accompanies this distribution, and is available at
+* http://www.eclipse.org/legal/epl-v20.html
+*
+* Contributors:
+*     IBM Corporation - initial API and implementation
+*******************************************************************************/
+
+package main
+
+import (
+	"codewind/utils"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// HttpPostOutputQueueSettings determines how the HTTP POST output queue sends chunks to the server:
+//   - OutboxDirectory: if non-empty, pending chunk groups are persisted to this directory (see PostQueueOutbox)
+//   - MaxWorkers: the maximum number of POST requests that may be in progress at once
+//   - RateLimitPerSecond: the maximum number of POST requests started per second, on average; 0 to disable
+//   - RateLimitBurst: the number of POST requests that may be started at once, before the rate limit applies
+//   - MaxInFlightBytes: the maximum total size of the chunks of the POST requests in progress; 0 to disable. A chunk
+//     is always sent if no other requests are in progress, even if it is larger than this.
+//
+// These may be set with the FILEWATCHER_POST_OUTBOX_DIR, FILEWATCHER_POST_MAX_WORKERS,
+// FILEWATCHER_POST_RATE_LIMIT_PER_SECOND, FILEWATCHER_POST_RATE_LIMIT_BURST and FILEWATCHER_POST_MAX_IN_FLIGHT_BYTES
+// environment variables.
+type HttpPostOutputQueueSettings struct {
+	OutboxDirectory string
+
+	MaxWorkers int
+
+	RateLimitPerSecond int
+	RateLimitBurst     int
+
+	MaxInFlightBytes int64
+}
+
+// NewDefaultHttpPostOutputQueueSettings returns the settings from the environment, or the default values.
+func NewDefaultHttpPostOutputQueueSettings() HttpPostOutputQueueSettings {
+
+	result := HttpPostOutputQueueSettings{
+		OutboxDirectory:    strings.TrimSpace(os.Getenv("FILEWATCHER_POST_OUTBOX_DIR")),
+		MaxWorkers:         int(utils.GetEnvInt64("FILEWATCHER_POST_MAX_WORKERS", 3)),
+		RateLimitPerSecond: int(utils.GetEnvInt64("FILEWATCHER_POST_RATE_LIMIT_PER_SECOND", 0)),
+		MaxInFlightBytes:   utils.GetEnvInt64("FILEWATCHER_POST_MAX_IN_FLIGHT_BYTES", 0),
+	}
+
+	// By default, allow up to one second's worth of requests at once
+	result.RateLimitBurst = int(utils.GetEnvInt64("FILEWATCHER_POST_RATE_LIMIT_BURST", int64(result.RateLimitPerSecond)))
+
+	if result.MaxWorkers < 1 {
+		utils.LogError("Ignoring invalid max workers value: " + strconv.Itoa(result.MaxWorkers))
+		result.MaxWorkers = 3
+	}
+
+	if result.RateLimitPerSecond < 0 {
+		result.RateLimitPerSecond = 0
+	}
+
+	if result.RateLimitBurst < 1 {
+		result.RateLimitBurst = 1
+	}
+
+	if result.MaxInFlightBytes < 0 {
+		result.MaxInFlightBytes = 0
+	}
+
+	return result
+}
+
+func (settings HttpPostOutputQueueSettings) toDebugString() string {
+
+	result := "max-workers: " + strconv.Itoa(settings.MaxWorkers)
+
+	if settings.RateLimitPerSecond > 0 {
+		result += "  rate-limit: " + strconv.Itoa(settings.RateLimitPerSecond) + "/sec (burst " + strconv.Itoa(settings.RateLimitBurst) + ")"
+	} else {
+		result += "  rate-limit: none"
+	}
+
+	if settings.MaxInFlightBytes > 0 {
+		result += "  max-in-flight-bytes: " + strconv.FormatInt(settings.MaxInFlightBytes, 10)
+	} else {
+		result += "  max-in-flight-bytes: none"
+	}
+
+	return result
+}
@@ -0,0 +1,84 @@
+/*******************************************************************************
+* Copyright (c) 2020 IBM Corporation and others.
+* All rights reserved. This program and the accompanying materials
+* are made available under the terms of the Eclipse Public License v2.0
+* which accompanies this distribution, and is available at
+* http://www.eclipse.org/legal/epl-v20.html
+*
+* Contributors:
+*     IBM Corporation - initial API and implementation
+*******************************************************************************/
+
+package main
+
+import (
+	"testing"
+)
+
+func TestDefaultHttpPostOutputQueueSettingsFromEnvironment(t *testing.T) {
+
+	tests := []struct {
+		name     string
+		env      map[string]string
+		expected HttpPostOutputQueueSettings
+	}{
+		{"defaults", nil, HttpPostOutputQueueSettings{MaxWorkers: 3, RateLimitBurst: 1}},
+		{"outbox directory", map[string]string{"FILEWATCHER_POST_OUTBOX_DIR": " /tmp/outbox "},
+			HttpPostOutputQueueSettings{OutboxDirectory: "/tmp/outbox", MaxWorkers: 3, RateLimitBurst: 1}},
+		{"max workers", map[string]string{"FILEWATCHER_POST_MAX_WORKERS": "8"},
+			HttpPostOutputQueueSettings{MaxWorkers: 8, RateLimitBurst: 1}},
+		{"zero max workers", map[string]string{"FILEWATCHER_POST_MAX_WORKERS": "0"},
+			HttpPostOutputQueueSettings{MaxWorkers: 3, RateLimitBurst: 1}},
+		{"invalid max workers", map[string]string{"FILEWATCHER_POST_MAX_WORKERS": "many"},
+			HttpPostOutputQueueSettings{MaxWorkers: 3, RateLimitBurst: 1}},
+		{"burst defaults to rate", map[string]string{"FILEWATCHER_POST_RATE_LIMIT_PER_SECOND": "5"},
+			HttpPostOutputQueueSettings{MaxWorkers: 3, RateLimitPerSecond: 5, RateLimitBurst: 5}},
+		{"explicit burst", map[string]string{"FILEWATCHER_POST_RATE_LIMIT_PER_SECOND": "5", "FILEWATCHER_POST_RATE_LIMIT_BURST": "2"},
+			HttpPostOutputQueueSettings{MaxWorkers: 3, RateLimitPerSecond: 5, RateLimitBurst: 2}},
+		{"negative rate", map[string]string{"FILEWATCHER_POST_RATE_LIMIT_PER_SECOND": "-5"},
+			HttpPostOutputQueueSettings{MaxWorkers: 3, RateLimitBurst: 1}},
+		{"zero burst", map[string]string{"FILEWATCHER_POST_RATE_LIMIT_PER_SECOND": "5", "FILEWATCHER_POST_RATE_LIMIT_BURST": "0"},
+			HttpPostOutputQueueSettings{MaxWorkers: 3, RateLimitPerSecond: 5, RateLimitBurst: 1}},
+		{"max in-flight bytes", map[string]string{"FILEWATCHER_POST_MAX_IN_FLIGHT_BYTES": "1048576"},
+			HttpPostOutputQueueSettings{MaxWorkers: 3, RateLimitBurst: 1, MaxInFlightBytes: 1048576}},
+		{"negative max in-flight bytes", map[string]string{"FILEWATCHER_POST_MAX_IN_FLIGHT_BYTES": "-1"},
+			HttpPostOutputQueueSettings{MaxWorkers: 3, RateLimitBurst: 1}},
+	}
+
+	variables := []string{"FILEWATCHER_POST_OUTBOX_DIR", "FILEWATCHER_POST_MAX_WORKERS", "FILEWATCHER_POST_RATE_LIMIT_PER_SECOND",
+		"FILEWATCHER_POST_RATE_LIMIT_BURST", "FILEWATCHER_POST_MAX_IN_FLIGHT_BYTES"}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			for _, name := range variables {
+				t.Setenv(name, test.env[name])
+			}
+
+			if actual := NewDefaultHttpPostOutputQueueSettings(); actual != test.expected {
+				t.Fatalf("Unexpected settings: %+v, expected %+v", actual, test.expected)
+			}
+		})
+	}
+}
+
+func TestHttpPostOutputQueueSettingsDebugString(t *testing.T) {
+
+	tests := []struct {
+		name     string
+		settings HttpPostOutputQueueSettings
+		expected string
+	}{
+		{"no limits", HttpPostOutputQueueSettings{MaxWorkers: 3, RateLimitBurst: 1},
+			"max-workers: 3  rate-limit: none  max-in-flight-bytes: none"},
+		{"limits", HttpPostOutputQueueSettings{MaxWorkers: 1, RateLimitPerSecond: 10, RateLimitBurst: 4, MaxInFlightBytes: 2048},
+			"max-workers: 1  rate-limit: 10/sec (burst 4)  max-in-flight-bytes: 2048"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if actual := test.settings.toDebugString(); actual != test.expected {
+				t.Fatalf("toDebugString() = %q, expected %q", actual, test.expected)
+			}
+		})
+	}
+}
@@ -24,6 +24,7 @@ import (
 // - Update project list from a GET response
 // - Update project list from a WebSocket response
 // - Process a file update and pass it to batch utility
+// - Pause, resume, or resync a project, on request from the server
 //
 // Behind the scenes, the ProjectList API calls are translated into channel messages and placed on the projectOperationChannel.
 // This allows us to provide thread safety to the internal project list data, as that data will only ever be accessed
@@ -31,19 +32,21 @@ import (
 type ProjectList struct {
 	projectOperationChannel chan *projectListChannelMessage
 	pathToInstaller         string // maybe be empty
+	defaultBatchPolicy      BatchPolicy
 }
 
 type receiveNewWatchEntriesMessage struct {
-	watchEventEntry *models.WatchEventEntry
-	project         *models.ProjectToWatch
+	watchEventEntries []*models.WatchEventEntry
+	project           *models.ProjectToWatch
 }
 
 // NewProjectList ...
-func NewProjectList(postOutputQueue *HttpPostOutputQueue, pathToInstallerParam string) *ProjectList {
+func NewProjectList(postOutputQueue *HttpPostOutputQueue, pathToInstallerParam string, defaultBatchPolicy BatchPolicy) *ProjectList {
 
 	result := &ProjectList{}
 	result.projectOperationChannel = make(chan *projectListChannelMessage)
 	result.pathToInstaller = pathToInstallerParam
+	result.defaultBatchPolicy = defaultBatchPolicy
 	go result.channelListener(postOutputQueue)
 
 	return result
@@ -59,6 +62,9 @@ const (
 	requestDebugMsg
 	cliFileChangeUpdate
 	receiveIndividualChangesFileListMsg
+	setProjectPausedMsg
+	resyncProjectMsg
+	requestHealthMsg
 )
 
 type projectListChannelMessage struct {
@@ -70,6 +76,14 @@ type projectListChannelMessage struct {
 	requestDebugMessage                    chan string
 	cliFileChangeUpdateMessage             string // project id
 	receiveIndividualChangesMessage        *individualChangesMessage
+	setProjectPausedMessage                *setProjectPausedMessage
+	resyncProjectMessage                   string // project id
+	requestHealthMessage                   chan []*projectHealthJSON
+}
+
+type setProjectPausedMessage struct {
+	projectID string
+	paused    bool
 }
 
 type individualChangesMessage struct {
@@ -124,11 +138,23 @@ func (projectList *ProjectList) RequestDebugMessage() chan string {
 
 }
 
-// ReceiveNewWatchEventEntries ...
-func (projectList *ProjectList) ReceiveNewWatchEventEntries(entry *models.WatchEventEntry, project *models.ProjectToWatch) {
+// RequestHealth returns the state of each project, for health reports; the watch status fields are not filled in, as
+// these are owned by the watch service.
+func (projectList *ProjectList) RequestHealth() chan []*projectHealthJSON {
+	result := make(chan []*projectHealthJSON)
+	projectList.projectOperationChannel <- &projectListChannelMessage{
+		msgType:              requestHealthMsg,
+		requestHealthMessage: result,
+	}
+	return result
+}
+
+// ReceiveNewWatchEventEntries passes a list of watch events (all for the same project) to the project list, to be
+// filtered and forwarded to the project's batch utility as a single unit.
+func (projectList *ProjectList) ReceiveNewWatchEventEntries(entries []*models.WatchEventEntry, project *models.ProjectToWatch) {
 
 	rnwem := &receiveNewWatchEntriesMessage{
-		entry,
+		entries,
 		project,
 	}
 
@@ -147,12 +173,35 @@ func (projectList *ProjectList) CLIFileChangeUpdate(projectID string) {
 	}
 }
 
+// SetProjectPaused pauses (or resumes) the processing of file changes for the project: while a project is paused, its
+// file changes are discarded. On resume, the project is resynchronized (see ResyncProject).
+func (projectList *ProjectList) SetProjectPaused(projectID string, paused bool) {
+
+	projectList.projectOperationChannel <- &projectListChannelMessage{
+		msgType:                 setProjectPausedMsg,
+		setProjectPausedMessage: &setProjectPausedMessage{projectID, paused},
+	}
+}
+
+// ResyncProject re-establishes the watch of the project (rescanning its directories), and runs a full cwctl sync of
+// the project, in case any changes were missed.
+func (projectList *ProjectList) ResyncProject(projectID string) {
+
+	projectList.projectOperationChannel <- &projectListChannelMessage{
+		msgType:              resyncProjectMsg,
+		resyncProjectMessage: projectID,
+	}
+}
+
 func (projectList *ProjectList) channelListener(postOutputQueue *HttpPostOutputQueue) {
 
 	/** projectId -> most recent watch list for a project */
 	var projectsMap map[string]*projectObject
 	projectsMap = make(map[string]*projectObject)
 
+	/** ids of the paused projects (see SetProjectPaused); these may not yet be in projectsMap, and remain paused when their project object is replaced */
+	pausedProjects := make(map[string] /* project id -> */ bool)
+
 	individualFileWatchService := NewIndividualFileWatchService(projectList)
 
 	var watchService *WatchService
@@ -172,25 +221,35 @@ func (projectList *ProjectList) channelListener(postOutputQueue *HttpPostOutputQ
 
 			} else if projectOperationMessage.msgType == receiveNewWatchEventEntriesMsg {
 				msg := projectOperationMessage.receiveNewWatchEventEntriesMessage
-				handleReceiveNewWatchEventEntries(msg.project, msg.watchEventEntry, projectsMap)
+				handleReceiveNewWatchEventEntries(msg.project, msg.watchEventEntries, projectsMap, pausedProjects)
 
 			} else if projectOperationMessage.msgType == requestDebugMsg {
 				responseChan := projectOperationMessage.requestDebugMessage
-				responseChan <- projectList.handleRequestDebugMsg(projectsMap)
+				responseChan <- projectList.handleRequestDebugMsg(projectsMap, pausedProjects)
 
 			} else if projectOperationMessage.msgType == cliFileChangeUpdate {
-				projectList.handleCliFileChangeUpdate(projectOperationMessage.cliFileChangeUpdateMessage, projectsMap)
+				projectList.handleCliFileChangeUpdate(projectOperationMessage.cliFileChangeUpdateMessage, projectsMap, pausedProjects)
 
 			} else if projectOperationMessage.msgType == receiveIndividualChangesFileListMsg {
 				msg := projectOperationMessage.receiveIndividualChangesMessage
-				projectList.handleReceiveIndividualChangesFileList(msg.projectID, msg.entries, projectsMap)
+				projectList.handleReceiveIndividualChangesFileList(msg.projectID, msg.entries, projectsMap, pausedProjects)
+
+			} else if projectOperationMessage.msgType == setProjectPausedMsg {
+				msg := projectOperationMessage.setProjectPausedMessage
+				projectList.handleSetProjectPaused(msg.projectID, msg.paused, projectsMap, pausedProjects, watchService)
+
+			} else if projectOperationMessage.msgType == resyncProjectMsg {
+				projectList.handleResyncProject(projectOperationMessage.resyncProjectMessage, projectsMap, pausedProjects, watchService)
+
+			} else if projectOperationMessage.msgType == requestHealthMsg {
+				projectOperationMessage.requestHealthMessage <- handleRequestHealthMsg(projectsMap, pausedProjects)
 			}
 		}
 
 	}
 }
 
-func (projectList *ProjectList) handleReceiveIndividualChangesFileList(projectID string, changedFiles []ChangedFileEntry, projectsMaps map[string]*projectObject) {
+func (projectList *ProjectList) handleReceiveIndividualChangesFileList(projectID string, changedFiles []ChangedFileEntry, projectsMaps map[string]*projectObject, pausedProjects map[string]bool) {
 
 	projectRootPaths := []string{}
 
@@ -224,7 +283,9 @@ func (projectList *ProjectList) handleReceiveIndividualChangesFileList(projectID
 	}
 
 	po, exists := projectsMaps[projectID]
-	if exists {
+	if pausedProjects[projectID] {
+		utils.LogDebug("Ignoring individual file changes of paused project " + projectID)
+	} else if exists {
 		po.eventBatchUtil.AddChangedFiles(filteredChanges)
 	} else {
 		utils.LogSevere("Could not locate event processing for project id " + projectID)
@@ -233,7 +294,7 @@ func (projectList *ProjectList) handleReceiveIndividualChangesFileList(projectID
 }
 
 /** Inform the CLI of a file change on the specified project. */
-func (projectList *ProjectList) handleCliFileChangeUpdate(projectID string, projectsMap map[string]*projectObject) {
+func (projectList *ProjectList) handleCliFileChangeUpdate(projectID string, projectsMap map[string]*projectObject, pausedProjects map[string]bool) {
 
 	value, exists := projectsMap[projectID]
 
@@ -247,14 +308,86 @@ func (projectList *ProjectList) handleCliFileChangeUpdate(projectID string, proj
 		return
 	}
 
+	if pausedProjects[projectID] {
+		utils.LogDebug("Skipping invocation of CLI command as project is paused: " + projectID)
+		return
+	}
+
+	if !projectList.defaultBatchPolicy.WithProjectOverrides(value.project).DeliveryMode.UsesCwctl() {
+		utils.LogDebug("Skipping invocation of CLI command due to delivery mode of project " + projectID)
+		return
+	}
+
 	if value.cliState != nil {
 		value.cliState.OnFileChangeEvent(value.project.ProjectCreationTime, value.project.Clone())
 	}
 
 }
 
+func (projectList *ProjectList) handleSetProjectPaused(projectID string, paused bool, projectsMap map[string]*projectObject, pausedProjects map[string]bool, watchService *WatchService) {
+
+	if pausedProjects[projectID] == paused {
+		return
+	}
+
+	value, exists := projectsMap[projectID]
+	known := exists && value != nil
+
+	if paused {
+		pausedProjects[projectID] = true
+		if known {
+			utils.LogInfo("Paused processing of file changes for project " + projectID)
+		} else {
+			utils.LogInfo("Paused processing of file changes for project " + projectID + ", which is not yet in the projects map")
+		}
+
+	} else {
+		delete(pausedProjects, projectID)
+		utils.LogInfo("Resumed processing of file changes for project " + projectID)
+
+		// Any changes made while paused were discarded, so resync the project
+		if known {
+			projectList.handleResyncProject(projectID, projectsMap, pausedProjects, watchService)
+		}
+	}
+}
+
+func (projectList *ProjectList) handleResyncProject(projectID string, projectsMap map[string]*projectObject, pausedProjects map[string]bool, watchService *WatchService) {
+
+	value, exists := projectsMap[projectID]
+	if !exists || value == nil {
+		utils.LogError("Asked to resync a project that wasn't in the projects map: " + projectID)
+		return
+	}
+
+	if pausedProjects[projectID] {
+		utils.LogInfo("Ignoring resync request for paused project " + projectID)
+		return
+	}
+
+	utils.LogInfo("Resyncing project " + projectID)
+
+	fileToMonitor, err := utils.ConvertAbsoluteUnixStyleNormalizedPathToLocalFile(value.project.PathToMonitor)
+	if err != nil {
+		utils.LogSevereErr("Unable to convert from absolute unix style normalized path: "+value.project.PathToMonitor, err)
+		return
+	}
+
+	// Remove, then add, the watcher, so that all of the project's directories are rescanned
+	if watchService != nil {
+		watchService.RemoveRootPath(fileToMonitor, *value.project)
+		watchService.AddRootPath(fileToMonitor, *value.project)
+	} else {
+		utils.LogSevere("Watch service is not set in project list and a resync was missed: " + fileToMonitor)
+	}
+
+	if value.cliState != nil && projectList.defaultBatchPolicy.WithProjectOverrides(value.project).DeliveryMode.UsesCwctl() {
+		value.cliState.OnFullSyncRequest(value.project.ProjectCreationTime, value.project.Clone())
+	}
+}
+
 /** Generate an overview of the state of the project list, including the projects being watched. */
-func (projectList *ProjectList) handleRequestDebugMsg(projectsMap map[string]*projectObject) string {
+func (projectList *ProjectList) handleRequestDebugMsg(projectsMap map[string]*projectObject, pausedProjects map[string]bool) string {
 	result := ""
 	for projectID, obj := range projectsMap {
 
@@ -276,13 +409,69 @@ func (projectList *ProjectList) handleRequestDebugMsg(projectsMap map[string]*pr
 			}
 		}
 
+		if obj.project.IgnoredFileSizeLimit > 0 {
+			result += " | ignoredFileSizeLimit: " + strconv.FormatInt(obj.project.IgnoredFileSizeLimit, 10)
+		}
+
+		if obj.project.IgnoreNonRegularFiles {
+			result += " | ignoreNonRegularFiles"
+		}
+
+		if obj.project.IgnoreBinaryFiles {
+			result += " | ignoreBinaryFiles"
+		}
+
+		if pausedProjects[projectID] {
+			result += " | (paused)"
+		}
+
 		result += "\n"
 
 	}
+
+	for projectID := range pausedProjects {
+		if _, exists := projectsMap[projectID]; !exists {
+			result += "- " + projectID + " -> (not yet known) | (paused)\n"
+		}
+	}
+
 	return result
 
 }
 
+func handleRequestHealthMsg(projectsMap map[string]*projectObject, pausedProjects map[string]bool) []*projectHealthJSON {
+	result := []*projectHealthJSON{}
+
+	for projectID, obj := range projectsMap {
+
+		if obj == nil {
+			continue
+		}
+
+		projectHealth := &projectHealthJSON{
+			ProjectID: projectID,
+			Paused:    pausedProjects[projectID],
+		}
+
+		if obj.eventBatchUtil != nil {
+			projectHealth.PendingBatchSize = obj.eventBatchUtil.GetPendingEventCount()
+		}
+
+		if obj.cliState != nil {
+			if lastResult := obj.cliState.GetLastResult(); lastResult != nil {
+				projectHealth.LastCwctlResult = &cwctlResultJSON{
+					ExitCode:  lastResult.errorCode,
+					SpawnTime: lastResult.spawnTime,
+				}
+			}
+		}
+
+		result = append(result, projectHealth)
+	}
+
+	return result
+}
+
 /**
  * This function processes data that is from the GET API response; we use this to synchronize the list of projects
  * that we are watching with what the server wants us to watch.  */
@@ -495,6 +684,9 @@ func (projectList *ProjectList) processProject(projectToProcess models.ProjectTo
 				currProjWatchState.project = &projectToProcess
 				wasProjectObjectUpdatedInThisBlock = true
 
+				// The batch settings may also have changed
+				currProjWatchState.eventBatchUtil.SetBatchPolicy(projectList.defaultBatchPolicy.WithProjectOverrides(&projectToProcess))
+
 				// We remove, then add, the watcher here, because the filters may have changed.
 
 				// Remove the old path
@@ -505,7 +697,7 @@ func (projectList *ProjectList) processProject(projectToProcess models.ProjectTo
 				watchService.AddRootPath(fileToMonitor, projectToProcess)
 				utils.LogInfo("From update, added new project with path '" + projectToProcess.PathToMonitor + "' to watch list, with watch directory: '" + fileToMonitor + "'")
 			} else {
-				utils.LogInfo("The project watch state has not changed for project " + projectToProcess.ProjectID)
+				utils.LogDebug("The project watch state has not changed for project " + projectToProcess.ProjectID)
 			}
 
 		} else {
@@ -576,10 +768,21 @@ func timestampToString(ts int64) string {
 	return strconv.FormatInt(ts, 10)
 }
 
-/** This function is called with a new file change entry, which is filtered (if necessary) then patched to the project's batch utility object.  */
-func handleReceiveNewWatchEventEntries(projectMatch *models.ProjectToWatch, entry *models.WatchEventEntry, projectsMap map[string]*projectObject) {
+/** This function is called with a list of new file change entries, which are filtered (if necessary) then patched to the project's batch utility object.  */
+func handleReceiveNewWatchEventEntries(projectMatch *models.ProjectToWatch, entries []*models.WatchEventEntry, projectsMap map[string]*projectObject, pausedProjects map[string]bool) {
+
+	utils.LogDebug("Received " + strconv.Itoa(len(entries)) + " new watch entries for " + projectMatch.ProjectID)
 
-	utils.LogDebug("Received new watch entry: " + entry.EventType + " " + entry.Path + " " + projectMatch.ProjectID)
+	val, exists := projectsMap[projectMatch.ProjectID]
+	if !exists {
+		utils.LogSevere("Could not locate event processing for project id " + projectMatch.ProjectID)
+		return
+	}
+
+	if pausedProjects[projectMatch.ProjectID] {
+		utils.LogDebug("Ignoring " + strconv.Itoa(len(entries)) + " watch entries of paused project " + projectMatch.ProjectID)
+		return
+	}
 
 	filter, err := utils.NewPathFilter(projectMatch)
 	if err != nil {
@@ -587,24 +790,57 @@ func handleReceiveNewWatchEventEntries(projectMatch *models.ProjectToWatch, entr
 		return
 	}
 
+	timestamp := time.Now().UnixNano() / 1000000
+
+	changedFileEntries := make([]ChangedFileEntry, 0, len(entries))
+
+	for _, entry := range entries {
+
+		path := filterWatchEventEntry(projectMatch, entry, filter)
+		if path == nil {
+			continue
+		}
+
+		changedFileEntry, err := NewChangedFileEntry(*path, entry.EventType, timestamp, entry.IsDir)
+		if err != nil {
+			utils.LogSevereErr("Error in creating new changed file entry", err)
+			continue
+		}
+
+		changedFileEntries = append(changedFileEntries, *changedFileEntry)
+	}
+
+	if len(changedFileEntries) > 0 {
+		val.eventBatchUtil.AddChangedFiles(changedFileEntries)
+	}
+
+}
+
+/** Returns the project-relative path of the entry, or nil if the entry is filtered out by the project's filters. */
+func filterWatchEventEntry(projectMatch *models.ProjectToWatch, entry *models.WatchEventEntry, filter *utils.PathFilter) *string {
+
+	if utils.IsLogDebug() {
+		utils.LogDebug("Received new watch entry: " + entry.EventType + " " + entry.Path + " " + projectMatch.ProjectID)
+	}
+
 	path := utils.ConvertAbsolutePathWithUnixSeparatorsToProjectRelativePath(entry.Path, projectMatch.PathToMonitor)
 
 	if path == nil || len(*path) == 0 {
-		return
+		return nil
 	}
 
 	if projectMatch.IgnoredPaths != nil {
 
 		if filter.IsFilteredOutByPath(*path) {
 			utils.LogDebug("Filtered out '" + *path + "' due to path filter")
-			return
+			return nil
 		}
 
 		// Apply the path filter against parent paths as well (if path is /a/b/c, then also try to match against /a/b and /a)
 		pathsToProcess := utils.SplitRelativeProjectPathIntoComponentPaths(*path)
 		for _, val := range pathsToProcess {
 			if filter.IsFilteredOutByPath(val) {
-				return
+				return nil
 			}
 		}
 
@@ -612,25 +848,14 @@ func handleReceiveNewWatchEventEntries(projectMatch *models.ProjectToWatch, entr
 
 	if projectMatch.IgnoredFilenames != nil && filter.IsFilteredOutByFilename(*path) {
 		utils.LogDebug("Filtered out '" + *path + "' due to filename filter")
-		return
+		return nil
 	}
 
-	val, exists := projectsMap[projectMatch.ProjectID]
-	if exists {
-		entry, err := NewChangedFileEntry(*path, entry.EventType, time.Now().UnixNano()/1000000, entry.IsDir)
-		if err != nil {
-			utils.LogSevereErr("Error in creating new changed file entry", err)
-			return
-		}
-
-		changedFileEntries := []ChangedFileEntry{*entry}
-
-		val.eventBatchUtil.AddChangedFiles(changedFileEntries)
-	} else {
-		utils.LogSevere("Could not locate event processing for project id " + projectMatch.ProjectID)
-		return
-	}
+	// The size/type/content ignore rules have already been applied by the watcher goroutine (see
+	// sharedWatcherHandle.isFilteredOutByFileAttributes), so that the file system is not accessed on the project list
+	// goroutine.
 
+	return path
 }
 
 // Information maintained for each project that is being monitored by the
@@ -670,7 +895,7 @@ func (projectList *ProjectList) newProjectObject(project models.ProjectToWatch,
 
 	return &projectObject{
 		&project,
-		NewFileChangeEventBatchUtil(project.ProjectID, postOutputQueue, projectList),
+		NewFileChangeEventBatchUtil(project.ProjectID, projectList.defaultBatchPolicy.WithProjectOverrides(&project), postOutputQueue, projectList),
 		cliState, // May be null
 	}, nil
 }
@@ -0,0 +1,188 @@
+/*******************************************************************************
+* Copyright (c) 2020 IBM Corporation and others.
+* All rights reserved. This program and the accompanying materials
+* are made available under the terms of the Eclipse Public License v2.0
+* which accompanies this distribution, and is available at
+* http://www.eclipse.org/legal/epl-v20.html
+*
+* Contributors:
+*     IBM Corporation - initial API and implementation
+*******************************************************************************/
+
+package main
+
+import (
+	"codewind/models"
+	"strconv"
+	"testing"
+	"time"
+)
+
+const (
+	benchmarkTreeFiles = 100000
+
+	// One in every X files of the benchmark tree is under an ignored directory
+	benchmarkTreeIgnoredEvery = 10
+)
+
+/** A utils.Clock whose timers never fire, so that the benchmark batches are only sent once they are full. */
+type benchmarkClock struct{}
+
+func (benchmarkClock) Now() time.Time { return time.Now() }
+
+func (benchmarkClock) Sleep(d time.Duration) { time.Sleep(d) }
+
+func (benchmarkClock) After(d time.Duration) <-chan time.Time { return nil }
+
+/** Returns CREATE entries for a project tree of benchmarkTreeFiles files, 100 per directory. */
+func newBenchmarkTreeEntries(project *models.ProjectToWatch) []*models.WatchEventEntry {
+
+	result := make([]*models.WatchEventEntry, 0, benchmarkTreeFiles)
+
+	for index := 0; index < benchmarkTreeFiles; index++ {
+
+		dir := "/src/dir" + strconv.Itoa(index/100)
+		if index%benchmarkTreeIgnoredEvery == 0 {
+			dir = "/node_modules/dir" + strconv.Itoa(index/100)
+		}
+
+		result = append(result, &models.WatchEventEntry{
+			EventType: "CREATE",
+			Path:      project.PathToMonitor + dir + "/file" + strconv.Itoa(index) + ".java",
+			IsDir:     false,
+		})
+	}
+
+	return result
+}
+
+/**
+ * Returns a project list whose goroutine only processes watch entries (as channelListener does) and debug requests
+ * (used to wait for the entries to be processed), with a single project whose batch util sends a batch for every
+ * tree delivered.
+ */
+func newBenchmarkProjectList(b *testing.B, project *models.ProjectToWatch) *ProjectList {
+
+	// The batch util informs cwctl on this project list, which discards the requests
+	sink := &ProjectList{projectOperationChannel: make(chan *projectListChannelMessage)}
+	go func() {
+		for range sink.projectOperationChannel {
+		}
+	}()
+
+	policy := BatchPolicy{
+		QuietPeriod:  time.Second,
+		MaxBatchSize: benchmarkTreeFiles - benchmarkTreeFiles/benchmarkTreeIgnoredEvery,
+		DeliveryMode: DeliveryModeCwctl,
+	}
+
+	projectsMap := map[string]*projectObject{
+		project.ProjectID: {
+			project:        project,
+			eventBatchUtil: newFileChangeEventBatchUtilWithClock(project.ProjectID, policy, nil, sink, benchmarkClock{}),
+		},
+	}
+
+	projectList := &ProjectList{projectOperationChannel: make(chan *projectListChannelMessage)}
+
+	go func() {
+		for msg := range projectList.projectOperationChannel {
+			if msg.msgType == receiveNewWatchEventEntriesMsg {
+				handleReceiveNewWatchEventEntries(msg.receiveNewWatchEventEntriesMessage.project, msg.receiveNewWatchEventEntriesMessage.watchEventEntries, projectsMap, nil)
+			} else if msg.msgType == requestDebugMsg {
+				msg.requestDebugMessage <- ""
+			}
+		}
+	}()
+
+	b.Cleanup(func() {
+		close(projectList.projectOperationChannel)
+	})
+
+	return projectList
+}
+
+/** Deliver a 100k file tree to the project list in lists of (at most) deliverySize entries, per iteration. */
+func benchmarkReceiveNewWatchEventEntries(b *testing.B, deliverySize int) {
+
+	project := &models.ProjectToWatch{
+		ProjectID:        "benchmark-project",
+		PathToMonitor:    "/benchmark/project",
+		IgnoredPaths:     []string{"/node_modules"},
+		IgnoredFilenames: []string{"*.class"},
+	}
+
+	entries := newBenchmarkTreeEntries(project)
+	projectList := newBenchmarkProjectList(b, project)
+
+	b.ReportAllocs()
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+
+		for start := 0; start < len(entries); start += deliverySize {
+			end := start + deliverySize
+			if end > len(entries) {
+				end = len(entries)
+			}
+			projectList.ReceiveNewWatchEventEntries(entries[start:end], project)
+		}
+
+		// Wait for the project list goroutine to process all of the entries
+		<-projectList.RequestDebugMessage()
+	}
+
+	b.ReportMetric(float64(b.Elapsed().Nanoseconds())/float64(b.N*len(entries)), "ns/entry")
+}
+
+func BenchmarkReceiveNewWatchEventEntries(b *testing.B) {
+
+	for _, deliverySize := range []int{1, 1000, benchmarkTreeFiles} {
+		b.Run("deliverySize="+strconv.Itoa(deliverySize), func(b *testing.B) {
+			benchmarkReceiveNewWatchEventEntries(b, deliverySize)
+		})
+	}
+}
+
+func TestPauseAppliesToUnknownAndRecreatedProjects(t *testing.T) {
+
+	project := &models.ProjectToWatch{ProjectID: "test-project", PathToMonitor: "/test/project"}
+	entries := []*models.WatchEventEntry{{EventType: "CREATE", Path: "/test/project/a.java"}}
+
+	projectList := &ProjectList{}
+	projectsMap := map[string]*projectObject{}
+	pausedProjects := map[string]bool{}
+
+	addProjectObject := func() *FileChangeEventBatchUtil {
+		h := newBatchUtilTestHarness(BatchPolicy{QuietPeriod: time.Second}, nil)
+		projectsMap[project.ProjectID] = &projectObject{project: project, eventBatchUtil: h.batchUtil}
+		return h.batchUtil
+	}
+
+	// Paused before the project is known
+	projectList.handleSetProjectPaused(project.ProjectID, true, projectsMap, pausedProjects, nil)
+
+	batchUtil := addProjectObject()
+	handleReceiveNewWatchEventEntries(project, entries, projectsMap, pausedProjects)
+	if count := batchUtil.GetPendingEventCount(); count != 0 {
+		t.Fatalf("Entries of a project paused before it was known were not ignored: %d", count)
+	}
+
+	// The pause survives the replacement of the project object
+	batchUtil = addProjectObject()
+	handleReceiveNewWatchEventEntries(project, entries, projectsMap, pausedProjects)
+	if count := batchUtil.GetPendingEventCount(); count != 0 {
+		t.Fatalf("Entries of a paused project were not ignored after its project object was replaced: %d", count)
+	}
+
+	if health := handleRequestHealthMsg(projectsMap, pausedProjects); len(health) != 1 || !health[0].Paused {
+		t.Fatalf("Unexpected health: %+v", health)
+	}
+
+	projectList.handleSetProjectPaused(project.ProjectID, false, projectsMap, pausedProjects, nil)
+
+	handleReceiveNewWatchEventEntries(project, entries, projectsMap, pausedProjects)
+	if count := batchUtil.GetPendingEventCount(); count != 1 {
+		t.Fatalf("Entries of a resumed project were not processed: %d", count)
+	}
+}
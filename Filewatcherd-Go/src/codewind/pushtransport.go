@@ -0,0 +1,174 @@
+/*******************************************************************************
+* Copyright (c) 2020 IBM Corporation and others.
+* All rights reserved. This program and the accompanying materials
+* are made available under the terms of the Eclipse Public License v2.0
+* which accompanies this distribution, and is available at
+* http://www.eclipse.org/legal/epl-v20.html
+*
+* Contributors:
+*     IBM Corporation - initial API and implementation
+*******************************************************************************/
+
+package main
+
+import (
+	"codewind/utils"
+	"errors"
+	"os"
+	"strconv"
+	"strings"
+)
+
+/**
+ * A push transport is a channel on which the server pushes messages (watch changes, control commands) to the
+ * filewatcher: either a WebSocket (the default), or Server-Sent Events (for networks where a proxy blocks WebSocket
+ * upgrades). Both transports carry the same JSON messages, which are passed to the same message dispatcher.
+ *
+ * The transport is selected with the FILEWATCHER_PUSH_TRANSPORT environment variable:
+ * - 'websocket': only use the WebSocket
+ * - 'sse': only use Server-Sent Events
+ * - 'auto' (the default): start with the WebSocket; after X consecutive failures to connect (see
+ *   FILEWATCHER_PUSH_TRANSPORT_SWITCH_AFTER_FAILURES), switch to the other transport, and so on.
+ */
+type pushTransport interface {
+	/** The name of the transport, and the URL it connects to, for logging */
+	debugName() string
+
+	/** Attempt to connect to the server once; the returned session has not yet been started. */
+	connect(messageHandler func(message []byte, replier wsMessageReplier)) (pushSession, error)
+
+	/** Whether messages may be sent to the server on this transport (SSE is receive-only) */
+	canSendMessages() bool
+}
+
+/** A single connection of a push transport; see wsSession. */
+type pushSession interface {
+	wsMessageReplier
+
+	/** Start receiving messages. */
+	Start()
+
+	/** Returns a channel that is closed once the session has closed. */
+	Done() <-chan struct{}
+
+	/** Close the session, if it is not already closed; may be called from any goroutine, any number of times. */
+	Close(reason string)
+
+	/** The reason the session was closed; only valid after Done() is closed */
+	CloseReason() string
+}
+
+const (
+	pushTransportWebSocket = "websocket"
+	pushTransportSSE       = "sse"
+	pushTransportAuto      = "auto"
+)
+
+var errPushSessionReceiveOnly = errors.New("Messages cannot be sent to the server on a Server-Sent Events connection")
+
+/** The push transport(s) to connect with, in the order they should be tried. */
+type pushTransportSettings struct {
+	transports []pushTransport
+
+	/** When there is more than one transport, switch to the next after this many consecutive connection failures */
+	switchAfterFailures int
+}
+
+func newPushTransportSettings(baseURL string, keepAlive wsKeepAliveSettings) (*pushTransportSettings, error) {
+
+	wsURL, err := utils.JoinWebSocketURL(baseURL, "/websockets/file-changes/v1")
+	if err != nil {
+		return nil, err
+	}
+
+	webSocket := &wsTransport{baseURL, wsURL, keepAlive}
+	sse := newSSETransport(baseURL, utils.JoinURL(baseURL, "/sse/file-changes/v1", nil), keepAlive.pongTimeout)
+
+	result := &pushTransportSettings{
+		switchAfterFailures: int(utils.GetEnvInt64("FILEWATCHER_PUSH_TRANSPORT_SWITCH_AFTER_FAILURES", 5)),
+	}
+
+	if result.switchAfterFailures < 1 {
+		result.switchAfterFailures = 1
+	}
+
+	mode := strings.ToLower(strings.TrimSpace(os.Getenv("FILEWATCHER_PUSH_TRANSPORT")))
+
+	switch mode {
+	case pushTransportWebSocket:
+		result.transports = []pushTransport{webSocket}
+	case pushTransportSSE:
+		result.transports = []pushTransport{sse}
+	case pushTransportAuto, "":
+		mode = pushTransportAuto
+		result.transports = []pushTransport{webSocket, sse}
+	default:
+		return nil, errors.New("Invalid push transport '" + mode + "', must be one of: " + pushTransportWebSocket + ", " + pushTransportSSE + ", " + pushTransportAuto)
+	}
+
+	utils.LogInfo("Push transport: " + mode + ", switch after failures: " + strconv.Itoa(result.switchAfterFailures))
+
+	return result, nil
+}
+
+/**
+ * Keep trying to connect to the server until success, with backoff, switching transports after repeated failures
+ * (if there is more than one). 'current' is the index of the transport to try first, and is updated to the index of
+ * the transport that connected. 'failures' is the number of consecutive failures of the current transport, which
+ * includes sessions that closed before they were healthy (see recordPushTransportFailure); it is not reset on
+ * connect, as a server that accepts then immediately drops each connection has not succeeded.
+ */
+func connectPushTransport(settings *pushTransportSettings, current *int, failures *int, messageHandler func(message []byte, replier wsMessageReplier), backoff *utils.JitterBackoff) (pushSession, pushTransport) {
+
+	for {
+
+		transport := settings.transports[*current]
+
+		utils.LogInfo("Connecting to " + transport.debugName())
+
+		session, err := transport.connect(messageHandler)
+		if err == nil {
+			utils.LogInfo("Successfully connected to " + transport.debugName())
+			backoff.OnConnected()
+			return session, transport
+		}
+
+		utils.LogErrorErr("Error on connecting to "+transport.debugName(), err)
+
+		recordPushTransportFailure(settings, current, failures)
+
+		// On failure, sleep
+		backoff.SleepAfterFail()
+	}
+}
+
+/**
+ * Count a failure of the current transport: either a failure to connect, or a session that closed before it was
+ * healthy. After settings.switchAfterFailures consecutive failures, switch to the next transport (if there is more
+ * than one).
+ */
+func recordPushTransportFailure(settings *pushTransportSettings, current *int, failures *int) {
+
+	*failures++
+
+	if len(settings.transports) > 1 && *failures >= settings.switchAfterFailures {
+		*current = (*current + 1) % len(settings.transports)
+		*failures = 0
+		utils.LogInfo("Unable to maintain a connection after " + strconv.Itoa(settings.switchAfterFailures) + " attempts, switching to " + settings.transports[*current].debugName())
+	}
+}
+
+/**
+ * Returns the URL (with any password redacted), followed by the Unix domain socket it is sent on (if the base URL is
+ * a unix URL), for logging.
+ */
+func debugURLWithSocket(url string, baseURL string) string {
+
+	url = utils.RedactURL(url)
+
+	if socketPath := utils.UnixSocketPath(baseURL); socketPath != "" {
+		return url + " (via " + socketPath + ")"
+	}
+
+	return url
+}
@@ -0,0 +1,49 @@
+/*******************************************************************************
+* Copyright (c) 2020 IBM Corporation and others.
+* All rights reserved. This program and the accompanying materials
+* are made available under the terms of the Eclipse Public License v2.0
+* which accompanies this distribution, and is available at
+* http://www.eclipse.org/legal/epl-v20.html
+*
+* Contributors:
+*     IBM Corporation - initial API and implementation
+*******************************************************************************/
+
+package main
+
+import (
+	"testing"
+)
+
+func TestShortLivedSessionsSwitchTransport(t *testing.T) {
+
+	settings := &pushTransportSettings{
+		transports:          []pushTransport{&wsTransport{}, &sseTransport{}},
+		switchAfterFailures: 3,
+	}
+
+	current := 0
+	failures := 0
+
+	// A failure to connect, then sessions that close before they are healthy, all count towards the switch
+	recordPushTransportFailure(settings, &current, &failures)
+	recordPushTransportFailure(settings, &current, &failures)
+	if current != 0 || failures != 2 {
+		t.Fatalf("Unexpected state: current %d, failures %d", current, failures)
+	}
+
+	recordPushTransportFailure(settings, &current, &failures)
+	if current != 1 || failures != 0 {
+		t.Fatalf("Expected a switch to the second transport: current %d, failures %d", current, failures)
+	}
+
+	// With a single transport, there is nothing to switch to
+	single := &pushTransportSettings{transports: []pushTransport{&wsTransport{}}, switchAfterFailures: 1}
+	current = 0
+	for attempt := 0; attempt < 3; attempt++ {
+		recordPushTransportFailure(single, &current, &failures)
+	}
+	if current != 0 {
+		t.Fatalf("Unexpected transport: %d", current)
+	}
+}
@@ -0,0 +1,386 @@
+/*******************************************************************************
+* Copyright (c) 2020 IBM Corporation and others.
+* All rights reserved. This program and the accompanying materials
+* are made available under the terms of the Eclipse Public License v2.0
+* which accompanies this distribution, and is available at
+* http://www.eclipse.org/legal/epl-v20.html
+*
+* Contributors:
+*     IBM Corporation - initial API and implementation
+*******************************************************************************/
+
+package main
+
+import (
+	"codewind/utils"
+	"sort"
+	"strconv"
+	"sync"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+/**
+ * SharedWatcherPool allows the watch services of multiple server connections to share a single fsnotify watcher for
+ * each project root path, so that a project directory watched on behalf of more than one server does not consume
+ * (for example) twice as many inotify watches.
+ *
+ * Each subscriber to a root path receives a sharedWatcherHandle, which has the same Add/Remove/Close/Events/Errors
+ * API as an fsnotify.Watcher: every event and error of the underlying watcher is delivered to every handle. Each
+ * handle has its own file attribute filter, as the subscribers of a root path may have different ignore rules. The
+ * directories added by each handle are reference counted, so a directory is only removed from the underlying watcher
+ * once no handle is watching it, and the underlying watcher is closed once its last handle is closed.
+ *
+ * Events are queued (without bound) for each handle, so a handle that is slow to read its events does not block the
+ * delivery of events to the other handles.
+ */
+type SharedWatcherPool struct {
+	lock *sync.Mutex
+
+	/** Lock 'lock' before reading/writing this */
+	watchers_synch_lock map[string] /* root path -> */ *sharedWatcher
+}
+
+/** A single fsnotify watcher, shared by the handles of all subscribers to the same root path */
+type sharedWatcher struct {
+	rootPath        string
+	fsnotifyWatcher *fsnotify.Watcher
+
+	/** Acquire before reading/writing subscribers_synch_lock; never held while calling the fsnotify watcher */
+	subscribersLock *sync.Mutex
+
+	subscribers_synch_lock map[*sharedWatcherHandle]bool
+
+	/** Acquire before reading/writing pathRefCounts_synch_lock, or the paths of a handle */
+	pathsLock *sync.Mutex
+
+	/** The number of handles that have added each path */
+	pathRefCounts_synch_lock map[string] /* path -> */ int
+}
+
+/** A single subscriber's view of a shared watcher; see SharedWatcherPool. */
+type sharedWatcherHandle struct {
+	Events chan fsnotify.Event
+	Errors chan error
+
+	pool   *SharedWatcherPool
+	shared *sharedWatcher
+
+	/** The size/type/content ignore rules of this subscriber's project, or nil if it has none; immutable */
+	attributeFilter *utils.PathFilter
+
+	/** The paths added by this handle; lock shared.pathsLock before reading/writing this */
+	paths_synch_lock map[string]bool
+
+	/** Acquire before reading/writing queue_synch_lock */
+	queueLock *sync.Mutex
+
+	/** Events and errors received from the underlying watcher, not yet passed to Events/Errors */
+	queue_synch_lock []sharedWatcherQueueEntry
+
+	/** Signalled (without blocking) whenever an entry is added to the queue */
+	notify chan struct{}
+
+	/** Closed when the handle is closed */
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+/** Only one of the fields of this struct is non-nil per instance */
+type sharedWatcherQueueEntry struct {
+	event *fsnotify.Event
+	err   error
+}
+
+func NewSharedWatcherPool() *SharedWatcherPool {
+	return &SharedWatcherPool{
+		lock:                &sync.Mutex{},
+		watchers_synch_lock: make(map[string]*sharedWatcher),
+	}
+}
+
+/**
+ * Returns a new handle to the watcher of the root path, creating the watcher if there is not yet one for the path.
+ * The attribute filter (which may be nil) only applies to the new handle; see isFilteredOutByFileAttributes.
+ */
+func (pool *SharedWatcherPool) Subscribe(rootPath string, attributeFilter *utils.PathFilter) (*sharedWatcherHandle, error) {
+
+	pool.lock.Lock()
+	defer pool.lock.Unlock()
+
+	shared, exists := pool.watchers_synch_lock[rootPath]
+	if !exists {
+		fsnotifyWatcher, err := fsnotify.NewWatcher()
+		if err != nil {
+			return nil, err
+		}
+
+		shared = &sharedWatcher{
+			rootPath:                 rootPath,
+			fsnotifyWatcher:          fsnotifyWatcher,
+			subscribersLock:          &sync.Mutex{},
+			subscribers_synch_lock:   make(map[*sharedWatcherHandle]bool),
+			pathsLock:                &sync.Mutex{},
+			pathRefCounts_synch_lock: make(map[string]int),
+		}
+
+		pool.watchers_synch_lock[rootPath] = shared
+
+		go shared.dispatchEvents()
+
+	} else {
+		utils.LogInfo("Sharing existing watcher of " + rootPath)
+	}
+
+	handle := &sharedWatcherHandle{
+		Events:           make(chan fsnotify.Event),
+		Errors:           make(chan error),
+		pool:             pool,
+		shared:           shared,
+		attributeFilter:  attributeFilter,
+		paths_synch_lock: make(map[string]bool),
+		queueLock:        &sync.Mutex{},
+		queue_synch_lock: []sharedWatcherQueueEntry{},
+		notify:           make(chan struct{}, 1),
+		done:             make(chan struct{}),
+	}
+
+	shared.subscribersLock.Lock()
+	shared.subscribers_synch_lock[handle] = true
+	shared.subscribersLock.Unlock()
+
+	go handle.deliverQueuedEntries()
+
+	return handle, nil
+}
+
+func (pool *SharedWatcherPool) GetDebugState() string {
+
+	pool.lock.Lock()
+	defer pool.lock.Unlock()
+
+	result := []string{}
+
+	for rootPath, shared := range pool.watchers_synch_lock {
+
+		shared.subscribersLock.Lock()
+		subscribers := len(shared.subscribers_synch_lock)
+		shared.subscribersLock.Unlock()
+
+		shared.pathsLock.Lock()
+		paths := len(shared.pathRefCounts_synch_lock)
+		shared.pathsLock.Unlock()
+
+		result = append(result, "- "+rootPath+" | subscribers: "+strconv.Itoa(subscribers)+" | watched directories: "+strconv.Itoa(paths)+"\n")
+	}
+
+	sort.Strings(result)
+
+	debugStr := ""
+	for _, line := range result {
+		debugStr += line
+	}
+
+	return debugStr
+}
+
+/** Pass each event and error of the underlying watcher to the queue of every handle, until the watcher is closed. */
+func (shared *sharedWatcher) dispatchEvents() {
+
+	for {
+		var entry sharedWatcherQueueEntry
+
+		select {
+		case event, ok := <-shared.fsnotifyWatcher.Events:
+			if !ok {
+				return
+			}
+			entry.event = &event
+
+		case err, ok := <-shared.fsnotifyWatcher.Errors:
+			if !ok {
+				return
+			}
+			entry.err = err
+		}
+
+		shared.subscribersLock.Lock()
+		for handle := range shared.subscribers_synch_lock {
+			handle.enqueue(entry)
+		}
+		shared.subscribersLock.Unlock()
+	}
+}
+
+/** Add an entry to the handle's queue; this never blocks. */
+func (handle *sharedWatcherHandle) enqueue(entry sharedWatcherQueueEntry) {
+
+	handle.queueLock.Lock()
+	handle.queue_synch_lock = append(handle.queue_synch_lock, entry)
+	handle.queueLock.Unlock()
+
+	select {
+	case handle.notify <- struct{}{}:
+	default:
+		// A notification is already pending
+	}
+}
+
+/** Pass queued entries to the Events/Errors channels until the handle is closed, then close the channels. */
+func (handle *sharedWatcherHandle) deliverQueuedEntries() {
+
+	defer close(handle.Events)
+	defer close(handle.Errors)
+
+	for {
+		select {
+		case <-handle.notify:
+		case <-handle.done:
+			return
+		}
+
+		handle.queueLock.Lock()
+		entries := handle.queue_synch_lock
+		handle.queue_synch_lock = []sharedWatcherQueueEntry{}
+		handle.queueLock.Unlock()
+
+		for _, entry := range entries {
+			if entry.event != nil {
+				select {
+				case handle.Events <- *entry.event:
+				case <-handle.done:
+					return
+				}
+			} else {
+				select {
+				case handle.Errors <- entry.err:
+				case <-handle.done:
+					return
+				}
+			}
+		}
+	}
+}
+
+/**
+ * Returns true if the file at localPath should be ignored due to the size/type/content ignore rules of this handle's
+ * subscriber (see PathFilter.IsFilteredOutByFileAttributes). This reads from the file system, so it should only be
+ * called on the goroutine that reads the handle's events, and not on the project list goroutine.
+ *
+ * A DELETE event can only be filtered out by the binary file extension rule: the file no longer exists, so its size,
+ * type and contents cannot be checked. Otherwise the DELETE is reported, even if the earlier CREATE/MODIFY events of
+ * the file were filtered out (which is harmless, as the server ignores deletes of files it does not have).
+ */
+func (handle *sharedWatcherHandle) isFilteredOutByFileAttributes(localPath string) bool {
+
+	filter := handle.attributeFilter
+	if filter == nil || !filter.HasFileAttributeFilters() {
+		return false
+	}
+
+	filteredOut, reason := filter.IsFilteredOutByFileAttributes(localPath)
+	if filteredOut {
+		utils.LogDebug("Filtered out '" + localPath + "' due to " + reason)
+	}
+
+	return filteredOut
+}
+
+/**
+ * Watch the path; the path is only counted once per handle. The path is always added to the underlying watcher, even
+ * if it is already counted: when a directory is deleted, its watch is silently dropped by the underlying watcher (but
+ * not from the counts), so a directory that is re-created at the same path must be added again.
+ */
+func (handle *sharedWatcherHandle) Add(path string) error {
+
+	shared := handle.shared
+
+	shared.pathsLock.Lock()
+	defer shared.pathsLock.Unlock()
+
+	// Adding a path that is already watched has no effect
+	if err := shared.fsnotifyWatcher.Add(path); err != nil {
+		return err
+	}
+
+	if handle.paths_synch_lock[path] {
+		return nil
+	}
+
+	shared.pathRefCounts_synch_lock[path]++
+	handle.paths_synch_lock[path] = true
+
+	return nil
+}
+
+/** Stop watching the path on behalf of this handle; the path is only removed once no handle is watching it. */
+func (handle *sharedWatcherHandle) Remove(path string) error {
+
+	shared := handle.shared
+
+	shared.pathsLock.Lock()
+	defer shared.pathsLock.Unlock()
+
+	if !handle.paths_synch_lock[path] {
+		return nil
+	}
+
+	delete(handle.paths_synch_lock, path)
+
+	return shared.releasePath(path)
+}
+
+/** Decrement the reference count of the path, and remove it from the watcher once unused; lock pathsLock before calling. */
+func (shared *sharedWatcher) releasePath(path string) error {
+
+	shared.pathRefCounts_synch_lock[path]--
+	if shared.pathRefCounts_synch_lock[path] > 0 {
+		return nil
+	}
+
+	delete(shared.pathRefCounts_synch_lock, path)
+
+	return shared.fsnotifyWatcher.Remove(path)
+}
+
+/**
+ * Close the handle: its paths are released, and its Events and Errors channels are closed. The underlying watcher
+ * is closed once its last handle is closed.
+ */
+func (handle *sharedWatcherHandle) Close() error {
+
+	var result error
+
+	handle.closeOnce.Do(func() {
+
+		pool := handle.pool
+		shared := handle.shared
+
+		pool.lock.Lock()
+		shared.subscribersLock.Lock()
+		delete(shared.subscribers_synch_lock, handle)
+		lastSubscriber := len(shared.subscribers_synch_lock) == 0
+		shared.subscribersLock.Unlock()
+		if lastSubscriber {
+			delete(pool.watchers_synch_lock, shared.rootPath)
+		}
+		pool.lock.Unlock()
+
+		close(handle.done)
+
+		if lastSubscriber {
+			result = shared.fsnotifyWatcher.Close()
+			return
+		}
+
+		shared.pathsLock.Lock()
+		for path := range handle.paths_synch_lock {
+			// Errors are expected here, for example, if the directory has been deleted (and thus already unwatched)
+			shared.releasePath(path)
+		}
+		handle.paths_synch_lock = make(map[string]bool)
+		shared.pathsLock.Unlock()
+	})
+
+	return result
+}
@@ -0,0 +1,191 @@
+/*******************************************************************************
+* Copyright (c) 2020 IBM Corporation and others.
+* All rights reserved. This program and the accompanying materials
+* are made available under the terms of the Eclipse Public License v2.0
+* which accompanies this distribution, and is available at
+* http://www.eclipse.org/legal/epl-v20.html
+*
+* Contributors:
+*     IBM Corporation - initial API and implementation
+*******************************************************************************/
+
+package main
+
+import (
+	"bytes"
+	"codewind/models"
+	"codewind/utils"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+/** Wait for an event of the given path and operation, ignoring any others. */
+func expectSharedWatcherEvent(t *testing.T, handle *sharedWatcherHandle, path string, op fsnotify.Op) {
+	t.Helper()
+
+	timeout := time.After(10 * time.Second)
+	for {
+		select {
+		case event := <-handle.Events:
+			if event.Name == path && event.Op&op != 0 {
+				return
+			}
+		case err := <-handle.Errors:
+			t.Fatalf("Unexpected error: %v", err)
+		case <-timeout:
+			t.Fatalf("Timed out waiting for %v of %s", op, path)
+		}
+	}
+}
+
+func TestSharedWatcherWatchesRecreatedDirectory(t *testing.T) {
+
+	root, err := ioutil.TempDir("", "sharedwatcherpool")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	dir := filepath.Join(root, "dir")
+	if err := os.Mkdir(dir, 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	pool := NewSharedWatcherPool()
+
+	handles := []*sharedWatcherHandle{}
+	for index := 0; index < 2; index++ {
+		handle, err := pool.Subscribe(root, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer handle.Close()
+
+		for _, path := range []string{root, dir} {
+			if err := handle.Add(path); err != nil {
+				t.Fatal(err)
+			}
+		}
+		handles = append(handles, handle)
+	}
+
+	// Deleting the directory drops its watch from the underlying watcher, but the handles still count it
+	if err := os.Remove(dir); err != nil {
+		t.Fatal(err)
+	}
+	for _, handle := range handles {
+		expectSharedWatcherEvent(t, handle, dir, fsnotify.Remove)
+	}
+
+	if err := os.Mkdir(dir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	for _, handle := range handles {
+		expectSharedWatcherEvent(t, handle, dir, fsnotify.Create)
+	}
+
+	// The re-created directory is added again by a single handle, as the watch service does on a CREATE event
+	if err := handles[0].Add(dir); err != nil {
+		t.Fatal(err)
+	}
+
+	file := filepath.Join(dir, "file")
+	if err := ioutil.WriteFile(file, []byte("content"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	for _, handle := range handles {
+		expectSharedWatcherEvent(t, handle, file, fsnotify.Create)
+	}
+
+	// The directory is counted once per handle, so it is only removed once both handles have removed it
+	handles[0].Remove(dir)
+	if debugState := pool.GetDebugState(); debugState != "- "+root+" | subscribers: 2 | watched directories: 2\n" {
+		t.Fatalf("Unexpected debug state: %s", debugState)
+	}
+	handles[1].Remove(dir)
+	if debugState := pool.GetDebugState(); debugState != "- "+root+" | subscribers: 2 | watched directories: 1\n" {
+		t.Fatalf("Unexpected debug state: %s", debugState)
+	}
+}
+
+func TestSharedWatcherHandlesHaveTheirOwnAttributeFilters(t *testing.T) {
+
+	root, err := ioutil.TempDir("", "sharedwatcherpool")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	sizeLimitFilter, err := utils.NewPathFilter(&models.ProjectToWatch{IgnoredFileSizeLimit: 10})
+	if err != nil {
+		t.Fatal(err)
+	}
+	binaryFilter, err := utils.NewPathFilter(&models.ProjectToWatch{IgnoreBinaryFiles: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	pool := NewSharedWatcherPool()
+
+	sizeLimitHandle, err := pool.Subscribe(root, sizeLimitFilter)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sizeLimitHandle.Close()
+
+	binaryHandle, err := pool.Subscribe(root, binaryFilter)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer binaryHandle.Close()
+
+	for _, handle := range []*sharedWatcherHandle{sizeLimitHandle, binaryHandle} {
+		if err := handle.Add(root); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if debugState := pool.GetDebugState(); debugState != "- "+root+" | subscribers: 2 | watched directories: 1\n" {
+		t.Fatalf("Unexpected debug state: %s", debugState)
+	}
+
+	largeText := filepath.Join(root, "large.txt")
+	smallBinary := filepath.Join(root, "small.jar")
+
+	for _, path := range []string{largeText, smallBinary} {
+		contents := []byte("a")
+		if path == largeText {
+			contents = bytes.Repeat(contents, 100)
+		}
+		if err := ioutil.WriteFile(path, contents, 0644); err != nil {
+			t.Fatal(err)
+		}
+
+		// Every event of the shared watcher is delivered to both handles, regardless of their filters
+		expectSharedWatcherEvent(t, sizeLimitHandle, path, fsnotify.Create)
+		expectSharedWatcherEvent(t, binaryHandle, path, fsnotify.Create)
+	}
+
+	tests := []struct {
+		name     string
+		handle   *sharedWatcherHandle
+		path     string
+		expected bool
+	}{
+		{"size limit handle, large text file", sizeLimitHandle, largeText, true},
+		{"size limit handle, small binary file", sizeLimitHandle, smallBinary, false},
+		{"binary handle, large text file", binaryHandle, largeText, false},
+		{"binary handle, small binary file", binaryHandle, smallBinary, true},
+	}
+
+	for _, test := range tests {
+		if actual := test.handle.isFilteredOutByFileAttributes(test.path); actual != test.expected {
+			t.Errorf("%s: isFilteredOutByFileAttributes = %v, expected %v", test.name, actual, test.expected)
+		}
+	}
+}
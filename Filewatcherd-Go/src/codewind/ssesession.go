@@ -0,0 +1,209 @@
+/*******************************************************************************
+* Copyright (c) 2020 IBM Corporation and others.
+* All rights reserved. This program and the accompanying materials
+* are made available under the terms of the Eclipse Public License v2.0
+* which accompanies this distribution, and is available at
+* http://www.eclipse.org/legal/epl-v20.html
+*
+* Contributors:
+*     IBM Corporation - initial API and implementation
+*******************************************************************************/
+
+package main
+
+import (
+	"bufio"
+	"codewind/utils"
+	"errors"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+/**
+ * The Server-Sent Events (text/event-stream) push transport, for networks where a proxy blocks WebSocket upgrades.
+ *
+ * The data of each event is a single JSON message, identical to those sent on the WebSocket (for example, a
+ * WatchChangeJson with type 'watchChanged'); the SSE 'event' and 'id' fields are ignored. The server should send
+ * a comment line (eg ': ping') periodically, as if nothing is received within the idle timeout, the connection is
+ * assumed to be dead, and a reconnect is triggered.
+ */
+type sseTransport struct {
+	baseURL     string
+	sseURL      string
+	idleTimeout time.Duration
+
+	/** Shared by every connection, so that the connections (and their goroutines) of closed sessions are not leaked */
+	client *http.Client
+}
+
+const (
+	// The maximum size of a single line of the event stream
+	sseMaxLineSize = 16 * 1024 * 1024
+
+	// How long to wait for the response headers, when connecting
+	sseResponseHeaderTimeout = 30 * time.Second
+)
+
+func newSSETransport(baseURL string, sseURL string, idleTimeout time.Duration) *sseTransport {
+
+	tr := utils.NewHTTPTransport(baseURL)
+	tr.ResponseHeaderTimeout = sseResponseHeaderTimeout
+
+	return &sseTransport{
+		baseURL:     baseURL,
+		sseURL:      sseURL,
+		idleTimeout: idleTimeout,
+
+		// No client timeout, as the response body is read for the life of the connection
+		client: &http.Client{Transport: utils.NewBasicAuthRoundTripper(baseURL, tr)},
+	}
+}
+
+func (transport *sseTransport) debugName() string {
+	return "Server-Sent Events " + debugURLWithSocket(transport.sseURL, transport.baseURL)
+}
+
+func (transport *sseTransport) canSendMessages() bool {
+	return false
+}
+
+func (transport *sseTransport) connect(messageHandler func(message []byte, replier wsMessageReplier)) (pushSession, error) {
+
+	req, err := http.NewRequest(http.MethodGet, transport.sseURL, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	req.Header.Set("Accept", "text/event-stream")
+	req.Header.Set("Cache-Control", "no-cache")
+
+	resp, err := transport.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+
+	if resp.StatusCode != 200 {
+		resp.Body.Close()
+		return nil, errors.New("Unexpected response code from event stream: " + strconv.Itoa(resp.StatusCode))
+	}
+
+	if contentType := resp.Header.Get("Content-Type"); !strings.HasPrefix(contentType, "text/event-stream") {
+		resp.Body.Close()
+		return nil, errors.New("Unexpected content type from event stream: " + contentType)
+	}
+
+	return newSSESession(resp.Body, transport.idleTimeout, messageHandler), nil
+}
+
+/**
+ * A single Server-Sent Events connection, and the goroutine that reads it; the session is closed exactly once, as
+ * described in wsSession. The session is receive-only: SendMessage always returns an error.
+ */
+type sseSession struct {
+	body        io.ReadCloser
+	idleTimeout time.Duration
+
+	messageHandler func(message []byte, replier wsMessageReplier)
+
+	closed    chan struct{}
+	closeOnce sync.Once
+
+	/** The reason the session was closed; only read after 'closed' is closed */
+	closeReason string
+}
+
+func newSSESession(body io.ReadCloser, idleTimeout time.Duration, messageHandler func(message []byte, replier wsMessageReplier)) *sseSession {
+
+	return &sseSession{
+		body:           body,
+		idleTimeout:    idleTimeout,
+		messageHandler: messageHandler,
+		closed:         make(chan struct{}),
+	}
+}
+
+/** Start the reader goroutine. */
+func (session *sseSession) Start() {
+	go session.readLoop()
+}
+
+func (session *sseSession) Done() <-chan struct{} {
+	return session.closed
+}
+
+/** Messages cannot be sent to the server on this transport, so this always returns an error. */
+func (session *sseSession) SendMessage(message interface{}) error {
+	return errPushSessionReceiveOnly
+}
+
+func (session *sseSession) Close(reason string) {
+
+	session.closeOnce.Do(func() {
+		utils.LogInfo("Closing Server-Sent Events session: " + reason)
+		session.closeReason = reason
+		close(session.closed)
+		session.body.Close()
+	})
+}
+
+func (session *sseSession) CloseReason() string {
+	return session.closeReason
+}
+
+func (session *sseSession) readLoop() {
+
+	// If nothing is received from the server within the timeout, close the body, which fails the read below
+	idleTimer := time.AfterFunc(session.idleTimeout, func() {
+		session.Close("No data received from server in " + session.idleTimeout.String())
+	})
+	defer idleTimer.Stop()
+
+	scanner := bufio.NewScanner(session.body)
+	scanner.Buffer(make([]byte, 0, 64*1024), sseMaxLineSize)
+
+	// The data lines of the event currently being received
+	data := []string{}
+
+	for scanner.Scan() {
+
+		idleTimer.Reset(session.idleTimeout)
+
+		line := strings.TrimSuffix(scanner.Text(), "\r")
+
+		if line == "" {
+			// A blank line ends the event
+			if len(data) > 0 {
+				session.messageHandler([]byte(strings.Join(data, "\n")), session)
+				data = []string{}
+			}
+			continue
+		}
+
+		if strings.HasPrefix(line, ":") {
+			// A comment, which the server sends to keep the connection alive
+			continue
+		}
+
+		field := line
+		value := ""
+		if index := strings.Index(line, ":"); index != -1 {
+			field = line[:index]
+			value = strings.TrimPrefix(line[index+1:], " ")
+		}
+
+		if field == "data" {
+			data = append(data, value)
+		}
+	}
+
+	reason := "End of event stream"
+	if err := scanner.Err(); err != nil {
+		reason = "Read error: " + err.Error()
+	}
+
+	session.Close(reason)
+}
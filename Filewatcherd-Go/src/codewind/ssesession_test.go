@@ -0,0 +1,112 @@
+/*******************************************************************************
+* Copyright (c) 2020 IBM Corporation and others.
+* All rights reserved. This program and the accompanying materials
+* are made available under the terms of the Eclipse Public License v2.0
+* which accompanies this distribution, and is available at
+* http://www.eclipse.org/legal/epl-v20.html
+*
+* Contributors:
+*     IBM Corporation - initial API and implementation
+*******************************************************************************/
+
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"runtime"
+	"testing"
+	"time"
+)
+
+func TestSSESessionsDoNotLeakGoroutines(t *testing.T) {
+
+	const sessions = 20
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.Write([]byte("data: {\"type\":\"hello\"}\n\n"))
+		w.(http.Flusher).Flush()
+
+		// Stream until the client closes the session
+		<-r.Context().Done()
+	}))
+	defer server.Close()
+
+	transport := newSSETransport(server.URL, server.URL+"/sse/file-changes/v1", time.Minute)
+
+	connectAndClose := func() {
+		t.Helper()
+
+		received := make(chan []byte, 1)
+
+		session, err := transport.connect(func(message []byte, replier wsMessageReplier) {
+			received <- message
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		session.Start()
+
+		select {
+		case message := <-received:
+			if string(message) != `{"type":"hello"}` {
+				t.Fatalf("Unexpected message: %s", message)
+			}
+		case <-time.After(10 * time.Second):
+			t.Fatal("Timed out waiting for a message")
+		}
+
+		session.Close("Test")
+		<-session.Done()
+	}
+
+	// Connect and close once first, so that goroutines started on first use (by net/http) are not counted
+	connectAndClose()
+
+	baseline := waitForStableGoroutineCount()
+
+	for index := 0; index < sessions; index++ {
+		connectAndClose()
+	}
+
+	if count := waitForGoroutineCount(baseline + sessions/4); count > baseline+sessions/4 {
+		buf := make([]byte, 1<<20)
+		t.Fatalf("Goroutine count grew from %d to %d after %d sessions:\n%s", baseline, count, sessions, buf[:runtime.Stack(buf, true)])
+	}
+}
+
+func TestFailedSSEConnectsDoNotLeakGoroutines(t *testing.T) {
+
+	const attempts = 20
+
+	// The client keeps each rejected connection alive, to be reused by the next request
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer server.Close()
+
+	transport := newSSETransport(server.URL, server.URL+"/sse/file-changes/v1", time.Minute)
+
+	connect := func() {
+		t.Helper()
+
+		if _, err := transport.connect(func(message []byte, replier wsMessageReplier) {}); err == nil {
+			t.Fatal("Expected the connection to be rejected")
+		}
+	}
+
+	connect()
+
+	baseline := waitForStableGoroutineCount()
+
+	for index := 0; index < attempts; index++ {
+		connect()
+	}
+
+	if count := waitForGoroutineCount(baseline + attempts/4); count > baseline+attempts/4 {
+		buf := make([]byte, 1<<20)
+		t.Fatalf("Goroutine count grew from %d to %d after %d rejected connections:\n%s", baseline, count, attempts, buf[:runtime.Stack(buf, true)])
+	}
+}
@@ -0,0 +1,81 @@
+/*******************************************************************************
+* Copyright (c) 2020 IBM Corporation and others.
+* All rights reserved. This program and the accompanying materials
+* are made available under the terms of the Eclipse Public License v2.0
+* which accompanies this distribution, and is available at
+* http://www.eclipse.org/legal/epl-v20.html
+*
+* Contributors:
+*     IBM Corporation - initial API and implementation
+*******************************************************************************/
+
+package utils
+
+import (
+	"bytes"
+	"io"
+	"os"
+)
+
+// The number of leading bytes of a file that are examined to determine if it is binary.
+const binaryDetectionHeaderSize = 8000
+
+// Used by the PathFilter when a project enables binary file filtering, but does not specify its own extension list.
+var defaultBinaryFileExtensions = []string{
+	".a", ".bin", ".class", ".core", ".dll", ".dylib", ".ear", ".exe", ".gz", ".iso", ".jar", ".o", ".obj",
+	".so", ".tar", ".tgz", ".war", ".zip", ".7z", ".bz2", ".xz",
+	".bmp", ".gif", ".ico", ".jpeg", ".jpg", ".png", ".tif", ".tiff", ".webp",
+	".mov", ".mp3", ".mp4", ".wav",
+}
+
+// Well-known leading bytes of common binary formats.
+var binaryMagicNumbers = [][]byte{
+	[]byte("\x7fELF"),             // ELF executables, shared libraries, and core dumps
+	[]byte("\xca\xfe\xba\xbe"),    // Java class files, and Mach-O universal binaries
+	[]byte("\xcf\xfa\xed\xfe"),    // Mach-O 64-bit
+	[]byte("\xce\xfa\xed\xfe"),    // Mach-O 32-bit
+	[]byte("PK\x03\x04"),          // zip/jar/war
+	[]byte("\x1f\x8b"),            // gzip
+	[]byte("\xfd7zXZ\x00"),        // xz
+	[]byte("7z\xbc\xaf\x27\x1c"),  // 7-zip
+	[]byte("\x89PNG\r\n\x1a\n"),   // PNG
+	[]byte("\xff\xd8\xff"),        // JPEG
+	[]byte("GIF8"),                // GIF
+	[]byte("SQLite format 3\x00"), // SQLite database
+}
+
+// IsNonRegularFileMode returns true for sockets, named pipes (FIFOs), and character/block devices.
+func IsNonRegularFileMode(mode os.FileMode) bool {
+	return mode&(os.ModeSocket|os.ModeNamedPipe|os.ModeDevice|os.ModeCharDevice|os.ModeIrregular) != 0
+}
+
+// IsBinaryFileContents reads the leading bytes of the (regular) file at path, and returns true if they match a
+// known binary file format, or if they contain a NUL byte (the same heuristic used by git and diff).
+func IsBinaryFileContents(path string) (bool, error) {
+
+	file, err := os.Open(path)
+	if err != nil {
+		return false, err
+	}
+	defer file.Close()
+
+	header := make([]byte, binaryDetectionHeaderSize)
+	n, err := io.ReadFull(file, header)
+	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+		return false, err
+	}
+
+	return IsBinaryFileHeader(header[:n]), nil
+}
+
+// IsBinaryFileHeader returns true if the given leading bytes of a file indicate that the file is binary.
+func IsBinaryFileHeader(header []byte) bool {
+
+	for _, magic := range binaryMagicNumbers {
+		if bytes.HasPrefix(header, magic) {
+			return true
+		}
+	}
+
+	return bytes.IndexByte(header, 0) != -1
+}
@@ -0,0 +1,120 @@
+/*******************************************************************************
+* Copyright (c) 2020 IBM Corporation and others.
+* All rights reserved. This program and the accompanying materials
+* are made available under the terms of the Eclipse Public License v2.0
+* which accompanies this distribution, and is available at
+* http://www.eclipse.org/legal/epl-v20.html
+*
+* Contributors:
+*     IBM Corporation - initial API and implementation
+*******************************************************************************/
+
+package utils
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestIsBinaryFileHeader(t *testing.T) {
+
+	tests := []struct {
+		name     string
+		header   []byte
+		expected bool
+	}{
+		{"empty", []byte{}, false},
+		{"text", []byte("package main\n\nfunc main() {}\n"), false},
+		{"utf-8 text", []byte("héllo wörld\n"), false},
+		{"ELF", []byte("\x7fELF\x02\x01\x01"), true},
+		{"Java class", []byte("\xca\xfe\xba\xbe\x00\x00\x00\x34"), true},
+		{"zip", []byte("PK\x03\x04\x14\x00"), true},
+		{"gzip", []byte("\x1f\x8b\x08"), true},
+		{"PNG", []byte("\x89PNG\r\n\x1a\n"), true},
+		{"JPEG", []byte("\xff\xd8\xff\xe0"), true},
+		{"GIF", []byte("GIF89a"), true},
+		{"SQLite", []byte("SQLite format 3\x00"), true},
+		{"truncated magic number", []byte("\x7fEL"), false},
+		{"magic number not at start", []byte("text \x7fELF"), false},
+		{"NUL byte", []byte("text\x00text"), true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if actual := IsBinaryFileHeader(test.header); actual != test.expected {
+				t.Fatalf("IsBinaryFileHeader(%q) = %v, expected %v", test.header, actual, test.expected)
+			}
+		})
+	}
+}
+
+func TestIsBinaryFileContents(t *testing.T) {
+
+	dir, err := ioutil.TempDir("", "filetypeutils")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	tests := []struct {
+		name     string
+		contents []byte
+		expected bool
+	}{
+		{"empty", []byte{}, false},
+		{"text", []byte("hello world\n"), false},
+		{"ELF", []byte("\x7fELF\x02\x01\x01\x00"), true},
+		{"NUL byte within header", append(bytes.Repeat([]byte("a"), binaryDetectionHeaderSize-1), 0), true},
+		{"NUL byte after header", append(bytes.Repeat([]byte("a"), binaryDetectionHeaderSize), 0), false},
+	}
+
+	for index, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			path := filepath.Join(dir, "file"+string(rune('a'+index)))
+			if err := ioutil.WriteFile(path, test.contents, 0644); err != nil {
+				t.Fatal(err)
+			}
+
+			actual, err := IsBinaryFileContents(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if actual != test.expected {
+				t.Fatalf("IsBinaryFileContents(%s) = %v, expected %v", test.name, actual, test.expected)
+			}
+		})
+	}
+
+	if _, err := IsBinaryFileContents(filepath.Join(dir, "missing")); err == nil {
+		t.Fatal("Expected an error for a missing file")
+	}
+}
+
+func TestIsNonRegularFileMode(t *testing.T) {
+
+	tests := []struct {
+		name     string
+		mode     os.FileMode
+		expected bool
+	}{
+		{"regular", 0644, false},
+		{"directory", os.ModeDir | 0755, false},
+		{"symlink", os.ModeSymlink | 0777, false},
+		{"socket", os.ModeSocket | 0755, true},
+		{"named pipe", os.ModeNamedPipe | 0644, true},
+		{"block device", os.ModeDevice | 0660, true},
+		{"character device", os.ModeDevice | os.ModeCharDevice | 0666, true},
+		{"irregular", os.ModeIrregular, true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if actual := IsNonRegularFileMode(test.mode); actual != test.expected {
+				t.Fatalf("IsNonRegularFileMode(%v) = %v, expected %v", test.mode, actual, test.expected)
+			}
+		})
+	}
+}
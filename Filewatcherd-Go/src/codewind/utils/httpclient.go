@@ -0,0 +1,106 @@
+/*******************************************************************************
+* Copyright (c) 2020 IBM Corporation and others.
+* All rights reserved. This program and the accompanying materials
+* are made available under the terms of the Eclipse Public License v2.0
+* which accompanies this distribution, and is available at
+* http://www.eclipse.org/legal/epl-v20.html
+*
+* Contributors:
+*     IBM Corporation - initial API and implementation
+*******************************************************************************/
+
+package utils
+
+import (
+	"context"
+	"crypto/tls"
+	"net"
+	"net/http"
+)
+
+/**
+ * Returns a new HTTP transport for requests to the server with the given base URL. If the base URL is a unix URL
+ * (see ParseBaseURL), every connection is made to the server's Unix domain socket, regardless of the host of the
+ * request URL.
+ */
+func NewHTTPTransport(baseURL string) *http.Transport {
+
+	result := &http.Transport{
+		TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
+	}
+
+	if socketPath := UnixSocketPath(baseURL); socketPath != "" {
+		result.DialContext = func(ctx context.Context, network string, addr string) (net.Conn, error) {
+			var dialer net.Dialer
+			return dialer.DialContext(ctx, "unix", socketPath)
+		}
+	}
+
+	return result
+}
+
+/**
+ * Returns a new HTTP client for requests to the server with the given base URL; see NewHTTPTransport and
+ * NewBasicAuthRoundTripper.
+ */
+func NewHTTPClient(baseURL string) *http.Client {
+	return &http.Client{Transport: NewBasicAuthRoundTripper(baseURL, NewHTTPTransport(baseURL))}
+}
+
+/** Adds the Authorization header of the base URL's userinfo to each request, then sends it with 'next'. */
+type basicAuthRoundTripper struct {
+	authorization string
+	next          http.RoundTripper
+}
+
+func (roundTripper *basicAuthRoundTripper) RoundTrip(req *http.Request) (*http.Response, error) {
+
+	if req.Header.Get("Authorization") == "" {
+		// A RoundTripper must not modify the original request
+		req = req.Clone(req.Context())
+		req.Header.Set("Authorization", roundTripper.authorization)
+	}
+
+	return roundTripper.next.RoundTrip(req)
+}
+
+/**
+ * Returns a RoundTripper that sends the credentials of the base URL's userinfo (if any) as basic authentication, as
+ * the request URLs do not contain them (see JoinURL); if the base URL has no userinfo, 'next' is returned.
+ */
+func NewBasicAuthRoundTripper(baseURL string, next http.RoundTripper) http.RoundTripper {
+
+	authorization := BasicAuthorization(baseURL)
+	if authorization == "" {
+		return next
+	}
+
+	return &basicAuthRoundTripper{authorization, next}
+}
+
+/** Returns the headers of a WebSocket handshake to the server with the given base URL, or nil if there are none. */
+func NewWebSocketHeader(baseURL string) http.Header {
+
+	authorization := BasicAuthorization(baseURL)
+	if authorization == "" {
+		return nil
+	}
+
+	return http.Header{"Authorization": {authorization}}
+}
+
+/**
+ * Returns a dial function that connects to the Unix domain socket of the base URL (ignoring the network and address
+ * parameters), or nil if the base URL is not a unix URL.
+ */
+func NewUnixSocketDialer(baseURL string) func(network string, addr string) (net.Conn, error) {
+
+	socketPath := UnixSocketPath(baseURL)
+	if socketPath == "" {
+		return nil
+	}
+
+	return func(network string, addr string) (net.Conn, error) {
+		return net.Dial("unix", socketPath)
+	}
+}
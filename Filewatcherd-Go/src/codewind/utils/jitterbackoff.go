@@ -0,0 +1,146 @@
+/*******************************************************************************
+* Copyright (c) 2020 IBM Corporation and others.
+* All rights reserved. This program and the accompanying materials
+* are made available under the terms of the Eclipse Public License v2.0
+* which accompanies this distribution, and is available at
+* http://www.eclipse.org/legal/epl-v20.html
+*
+* Contributors:
+*     IBM Corporation - initial API and implementation
+*******************************************************************************/
+
+package utils
+
+import (
+	"math/rand"
+	"time"
+)
+
+/** Clock is the source of the current time, of sleeps, and of timers, so that they may be replaced in tests. */
+type Clock interface {
+	Now() time.Time
+	Sleep(d time.Duration)
+
+	/** Returns a channel that receives the current time once d has elapsed (as time.After) */
+	After(d time.Duration) <-chan time.Time
+}
+
+type systemClock struct{}
+
+func (systemClock) Now() time.Time { return time.Now() }
+
+func (systemClock) Sleep(d time.Duration) { time.Sleep(d) }
+
+func (systemClock) After(d time.Duration) <-chan time.Time { return time.After(d) }
+
+// SystemClock is the Clock backed by the time package.
+var SystemClock Clock = systemClock{}
+
+/**
+ * Implements a 'decorrelated jitter' backoff for reconnecting to the server: each delay is a random value between
+ * the base delay and 3x the previous delay, capped at the maximum delay. The randomness ensures that when the server
+ * restarts, the clients that were connected to it do not all reconnect in lockstep.
+ *
+ * For connections (as opposed to individual requests), the backoff is only reset once the connection has stayed
+ * healthy for HealthyPeriod: a connection that is accepted and then immediately dropped continues to back off.
+ *
+ * This class is not thread safe.
+ */
+type JitterBackoff struct {
+	BaseDelay     time.Duration
+	MaxDelay      time.Duration
+	HealthyPeriod time.Duration
+
+	clock  Clock
+	random *rand.Rand
+
+	/** The most recent delay, or 0 if there have been no failures since the last reset */
+	previousDelay time.Duration
+
+	/** When the current connection was established, or zero if not connected */
+	connectedAt time.Time
+}
+
+// NewJitterBackoff creates a backoff using the system clock and a randomly seeded source.
+func NewJitterBackoff(baseDelay time.Duration, maxDelay time.Duration, healthyPeriod time.Duration) *JitterBackoff {
+	return NewJitterBackoffWithClock(baseDelay, maxDelay, healthyPeriod, SystemClock, rand.NewSource(time.Now().UnixNano()))
+}
+
+// NewJitterBackoffWithClock creates a backoff with the given clock and random source, for example, for tests.
+func NewJitterBackoffWithClock(baseDelay time.Duration, maxDelay time.Duration, healthyPeriod time.Duration, clock Clock, source rand.Source) *JitterBackoff {
+
+	if baseDelay <= 0 {
+		baseDelay = 200 * time.Millisecond
+	}
+
+	if maxDelay < baseDelay {
+		maxDelay = baseDelay
+	}
+
+	return &JitterBackoff{
+		BaseDelay:     baseDelay,
+		MaxDelay:      maxDelay,
+		HealthyPeriod: healthyPeriod,
+		clock:         clock,
+		random:        rand.New(source),
+	}
+}
+
+// NewDefaultReconnectBackoff creates a backoff with the values of the FILEWATCHER_RECONNECT_BASE_DELAY_MS,
+// FILEWATCHER_RECONNECT_MAX_DELAY_MS and FILEWATCHER_RECONNECT_HEALTHY_PERIOD_MS environment variables, or the defaults.
+func NewDefaultReconnectBackoff() *JitterBackoff {
+	return NewJitterBackoff(
+		time.Duration(GetEnvInt64("FILEWATCHER_RECONNECT_BASE_DELAY_MS", 200))*time.Millisecond,
+		time.Duration(GetEnvInt64("FILEWATCHER_RECONNECT_MAX_DELAY_MS", 10000))*time.Millisecond,
+		time.Duration(GetEnvInt64("FILEWATCHER_RECONNECT_HEALTHY_PERIOD_MS", 30000))*time.Millisecond)
+}
+
+/** Returns the next delay, and records it as the previous delay. */
+func (b *JitterBackoff) NextDelay() time.Duration {
+
+	upper := b.previousDelay * 3
+	if upper < b.BaseDelay {
+		upper = b.BaseDelay
+	}
+
+	delay := b.BaseDelay
+	if upper > b.BaseDelay {
+		delay += time.Duration(b.random.Int63n(int64(upper - b.BaseDelay)))
+	}
+
+	if delay > b.MaxDelay {
+		delay = b.MaxDelay
+	}
+
+	b.previousDelay = delay
+
+	return delay
+}
+
+/** Sleep for the next delay. */
+func (b *JitterBackoff) SleepAfterFail() {
+	b.clock.Sleep(b.NextDelay())
+}
+
+/** Reset the backoff, for example after a successful request. */
+func (b *JitterBackoff) Reset() {
+	b.previousDelay = 0
+}
+
+/** Inform the backoff that a connection was established. */
+func (b *JitterBackoff) OnConnected() {
+	b.connectedAt = b.clock.Now()
+}
+
+/** Inform the backoff that the connection was lost; resets the backoff, and returns true, if the connection was healthy for long enough. */
+func (b *JitterBackoff) OnDisconnected() bool {
+
+	healthy := !b.connectedAt.IsZero() && b.clock.Now().Sub(b.connectedAt) >= b.HealthyPeriod
+	b.connectedAt = time.Time{}
+
+	if healthy {
+		b.Reset()
+	}
+
+	return healthy
+}
@@ -0,0 +1,172 @@
+/*******************************************************************************
+* Copyright (c) 2020 IBM Corporation and others.
+* All rights reserved. This program and the accompanying materials
+* are made available under the terms of the Eclipse Public License v2.0
+* which accompanies this distribution, and is available at
+* http://www.eclipse.org/legal/epl-v20.html
+*
+* Contributors:
+*     IBM Corporation - initial API and implementation
+*******************************************************************************/
+
+package utils
+
+import (
+	"math/rand"
+	"testing"
+	"time"
+)
+
+/** A Clock whose time only moves when slept or advanced; it records each sleep. */
+type fakeBackoffClock struct {
+	now    time.Time
+	sleeps []time.Duration
+}
+
+func (clock *fakeBackoffClock) Now() time.Time { return clock.now }
+
+func (clock *fakeBackoffClock) Sleep(d time.Duration) {
+	clock.sleeps = append(clock.sleeps, d)
+	clock.now = clock.now.Add(d)
+}
+
+func (clock *fakeBackoffClock) After(d time.Duration) <-chan time.Time {
+	clock.now = clock.now.Add(d)
+
+	result := make(chan time.Time, 1)
+	result <- clock.now
+	return result
+}
+
+func newTestJitterBackoff(seed int64) (*JitterBackoff, *fakeBackoffClock) {
+	clock := &fakeBackoffClock{now: time.Unix(1000, 0)}
+	return NewJitterBackoffWithClock(100*time.Millisecond, 5*time.Second, 30*time.Second, clock, rand.NewSource(seed)), clock
+}
+
+func TestJitterBackoffDelaysAreWithinBounds(t *testing.T) {
+
+	for seed := int64(0); seed < 100; seed++ {
+
+		backoff, _ := newTestJitterBackoff(seed)
+
+		previous := time.Duration(0)
+		for attempt := 0; attempt < 50; attempt++ {
+
+			delay := backoff.NextDelay()
+
+			upper := 3 * previous
+			if upper < backoff.BaseDelay {
+				upper = backoff.BaseDelay
+			}
+			if upper > backoff.MaxDelay {
+				upper = backoff.MaxDelay
+			}
+
+			if delay < backoff.BaseDelay || delay > upper {
+				t.Fatalf("Seed %d, attempt %d: delay %v is outside [%v, %v]", seed, attempt, delay, backoff.BaseDelay, upper)
+			}
+
+			previous = delay
+		}
+	}
+}
+
+func TestJitterBackoffIsCappedAtMaxDelay(t *testing.T) {
+
+	backoff, _ := newTestJitterBackoff(1)
+
+	reachedMax := false
+	for attempt := 0; attempt < 200; attempt++ {
+		delay := backoff.NextDelay()
+		if delay > backoff.MaxDelay {
+			t.Fatalf("Delay %v exceeds the maximum %v", delay, backoff.MaxDelay)
+		}
+		if delay == backoff.MaxDelay {
+			reachedMax = true
+		}
+	}
+
+	if !reachedMax {
+		t.Fatal("The delay never reached the maximum")
+	}
+}
+
+func TestJitterBackoffConstructorCorrectsInvalidDelays(t *testing.T) {
+
+	backoff := NewJitterBackoffWithClock(0, time.Millisecond, time.Second, &fakeBackoffClock{}, rand.NewSource(1))
+
+	if backoff.BaseDelay != 200*time.Millisecond || backoff.MaxDelay != backoff.BaseDelay {
+		t.Fatalf("Unexpected delays: base %v, max %v", backoff.BaseDelay, backoff.MaxDelay)
+	}
+
+	if delay := backoff.NextDelay(); delay != backoff.BaseDelay {
+		t.Fatalf("Unexpected delay: %v", delay)
+	}
+}
+
+func TestJitterBackoffSleepsOnClock(t *testing.T) {
+
+	backoff, clock := newTestJitterBackoff(1)
+
+	start := clock.Now()
+
+	for attempt := 0; attempt < 5; attempt++ {
+		backoff.SleepAfterFail()
+	}
+
+	if len(clock.sleeps) != 5 {
+		t.Fatalf("Unexpected sleeps: %v", clock.sleeps)
+	}
+
+	total := time.Duration(0)
+	for _, sleep := range clock.sleeps {
+		total += sleep
+	}
+
+	if clock.Now().Sub(start) != total {
+		t.Fatalf("Sleeps of %v did not advance the clock by %v", clock.sleeps, clock.Now().Sub(start))
+	}
+}
+
+func TestJitterBackoffOnlyResetsAfterHealthyPeriod(t *testing.T) {
+
+	backoff, clock := newTestJitterBackoff(1)
+
+	// Never connected
+	backoff.NextDelay()
+	if backoff.OnDisconnected() {
+		t.Fatal("A backoff that never connected was reset")
+	}
+
+	// Build up the delay
+	for attempt := 0; attempt < 10; attempt++ {
+		backoff.NextDelay()
+	}
+	previous := backoff.previousDelay
+
+	// A connection that drops before the healthy period does not reset the backoff
+	backoff.OnConnected()
+	clock.Sleep(backoff.HealthyPeriod - time.Millisecond)
+	if backoff.OnDisconnected() {
+		t.Fatal("A connection shorter than the healthy period reset the backoff")
+	}
+	if backoff.previousDelay != previous {
+		t.Fatalf("Unexpected previous delay: %v, expected %v", backoff.previousDelay, previous)
+	}
+
+	// A disconnect without a new connection is not healthy, even once the healthy period has elapsed
+	clock.Sleep(backoff.HealthyPeriod)
+	if backoff.OnDisconnected() {
+		t.Fatal("A second disconnect reset the backoff")
+	}
+
+	// A connection that stays up for the healthy period resets the backoff, so the next delay is the base delay
+	backoff.OnConnected()
+	clock.Sleep(backoff.HealthyPeriod)
+	if !backoff.OnDisconnected() {
+		t.Fatal("A connection that stayed up for the healthy period did not reset the backoff")
+	}
+	if delay := backoff.NextDelay(); delay != backoff.BaseDelay {
+		t.Fatalf("Unexpected delay after reset: %v", delay)
+	}
+}
@@ -12,10 +12,13 @@
 package utils
 
 import (
+	"errors"
 	"fmt"
 	"os"
 	"strconv"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -31,8 +34,15 @@ import (
  */
 
 type MonitorLogger struct {
-	output   chan outputLine
-	logLevel LogLevel
+	/** The number of error and severe messages logged, at any log level; always access with atomic (and keep these
+	 * first in the struct, for 64-bit alignment on 32-bit platforms) */
+	errorCount  int64
+	severeCount int64
+
+	output chan outputLine
+
+	/** The LogLevel; may be changed at runtime, so always access with getLogLevel/SetLogLevel */
+	logLevel int32
 }
 
 type outputLine struct {
@@ -59,7 +69,7 @@ func loggerInternal() *MonitorLogger {
 	// Create a single instance of Logger, on first use
 	once.Do(func() {
 		messages := make(chan outputLine, 100)
-		logger = &MonitorLogger{messages, INFO}
+		logger = &MonitorLogger{0, 0, messages, int32(INFO)}
 		go logger.logOutputter()
 	})
 
@@ -69,7 +79,7 @@ func loggerInternal() *MonitorLogger {
 func LogDebug(msg string) {
 	l := loggerInternal()
 
-	if l.logLevel > DEBUG {
+	if l.getLogLevel() > DEBUG {
 		return
 	}
 	l.out(msg)
@@ -77,7 +87,7 @@ func LogDebug(msg string) {
 
 func LogInfo(msg string) {
 	l := loggerInternal()
-	if l.logLevel > INFO {
+	if l.getLogLevel() > INFO {
 		return
 	}
 	l.out(msg)
@@ -86,7 +96,8 @@ func LogInfo(msg string) {
 
 func LogError(msg string) {
 	l := loggerInternal()
-	if l.logLevel > ERROR {
+	atomic.AddInt64(&l.errorCount, 1)
+	if l.getLogLevel() > ERROR {
 		return
 	}
 	l.err("! ERROR !:" + msg)
@@ -95,7 +106,8 @@ func LogError(msg string) {
 
 func LogErrorErr(msg string, err error) {
 	l := loggerInternal()
-	if l.logLevel > ERROR {
+	atomic.AddInt64(&l.errorCount, 1)
+	if l.getLogLevel() > ERROR {
 		return
 	}
 
@@ -110,6 +122,7 @@ func LogErrorErr(msg string, err error) {
 
 func LogSevere(msg string) {
 	l := loggerInternal()
+	atomic.AddInt64(&l.severeCount, 1)
 	l.err("!!! SEVERE !!!: " + msg)
 }
 
@@ -122,12 +135,67 @@ func LogSevereErr(msg string, err error) {
 	}
 
 	l := loggerInternal()
+	atomic.AddInt64(&l.severeCount, 1)
 	l.err(outputMsg)
 }
 
+// GetErrorCounts returns the number of error and severe messages logged since startup (including error messages
+// that were not output due to the log level).
+func GetErrorCounts() (errorCount int64, severeCount int64) {
+	l := loggerInternal()
+	return atomic.LoadInt64(&l.errorCount), atomic.LoadInt64(&l.severeCount)
+}
+
 func IsLogDebug() bool {
 	l := loggerInternal()
-	return l.logLevel == DEBUG
+	return l.getLogLevel() == DEBUG
+}
+
+func (l *MonitorLogger) getLogLevel() LogLevel {
+	return LogLevel(atomic.LoadInt32(&l.logLevel))
+}
+
+// GetLogLevel returns the current log level.
+func GetLogLevel() LogLevel {
+	return loggerInternal().getLogLevel()
+}
+
+// SetLogLevel changes the log level; this may be called at any time, from any goroutine.
+func SetLogLevel(level LogLevel) {
+	atomic.StoreInt32(&loggerInternal().logLevel, int32(level))
+}
+
+// ParseLogLevel converts a (case-insensitive) level name, eg "debug", to a LogLevel.
+func ParseLogLevel(str string) (LogLevel, error) {
+
+	switch strings.ToLower(strings.TrimSpace(str)) {
+	case "debug":
+		return DEBUG, nil
+	case "info":
+		return INFO, nil
+	case "error":
+		return ERROR, nil
+	case "severe":
+		return SEVERE, nil
+	}
+
+	return 0, errors.New("Invalid log level: " + str)
+}
+
+func (level LogLevel) String() string {
+
+	switch level {
+	case DEBUG:
+		return "debug"
+	case INFO:
+		return "info"
+	case ERROR:
+		return "error"
+	case SEVERE:
+		return "severe"
+	}
+
+	return strconv.Itoa(int(level))
 }
 
 func (l *MonitorLogger) out(msg string) {
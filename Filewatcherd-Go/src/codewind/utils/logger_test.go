@@ -0,0 +1,52 @@
+/*******************************************************************************
+* Copyright (c) 2020 IBM Corporation and others.
+* All rights reserved. This program and the accompanying materials
+* are made available under the terms of the Eclipse Public License v2.0
+* which accompanies this distribution, and is available at
+* http://www.eclipse.org/legal/epl-v20.html
+*
+* Contributors:
+*     IBM Corporation - initial API and implementation
+*******************************************************************************/
+
+package utils
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestErrorCountsIncreaseAtEveryLogLevel(t *testing.T) {
+
+	previousLevel := GetLogLevel()
+	t.Cleanup(func() { SetLogLevel(previousLevel) })
+
+	tests := []struct {
+		name           string
+		log            func()
+		expectedError  int64
+		expectedSevere int64
+	}{
+		{"LogError", func() { LogError("Test error") }, 1, 0},
+		{"LogErrorErr", func() { LogErrorErr("Test error", errors.New("test")) }, 1, 0},
+		{"LogSevere", func() { LogSevere("Test severe error") }, 0, 1},
+		{"LogSevereErr", func() { LogSevereErr("Test severe error", errors.New("test")) }, 0, 1},
+		{"LogInfo", func() { LogInfo("Test info") }, 0, 0},
+	}
+
+	// Errors are counted even when the log level is too high for them to be output
+	for _, level := range []LogLevel{DEBUG, SEVERE} {
+		SetLogLevel(level)
+
+		for _, test := range tests {
+			errorBefore, severeBefore := GetErrorCounts()
+			test.log()
+			errorAfter, severeAfter := GetErrorCounts()
+
+			if errorAfter-errorBefore != test.expectedError || severeAfter-severeBefore != test.expectedSevere {
+				t.Errorf("%s at level %d changed the counts by %d/%d, expected %d/%d", test.name, level,
+					errorAfter-errorBefore, severeAfter-severeBefore, test.expectedError, test.expectedSevere)
+			}
+		}
+	}
+}
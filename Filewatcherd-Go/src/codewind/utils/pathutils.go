@@ -14,8 +14,11 @@ package utils
 import (
 	"codewind/models"
 	"errors"
+	"os"
+	"path/filepath"
 	"regexp"
 	"runtime"
+	"strconv"
 	"strings"
 	"unicode"
 )
@@ -150,6 +153,14 @@ func ConvertAbsoluteUnixStyleNormalizedPathToLocalFileOS(str string, isWindows b
 type PathFilter struct {
 	filenameExcludePatterns []*regexp.Regexp
 	pathExcludePatterns     []*regexp.Regexp
+
+	/** Files larger than this (in bytes) are filtered out; 0 if disabled */
+	fileSizeLimit int64
+
+	ignoreNonRegularFiles bool
+
+	/** Lowercase extension (including the leading '.') -> true; nil if binary files are not filtered */
+	binaryExtensions map[string]bool
 }
 
 // NewPathFilter ...
@@ -158,6 +169,28 @@ func NewPathFilter(project *models.ProjectToWatch) (*PathFilter, error) {
 	result := PathFilter{
 		make([]*regexp.Regexp, 0),
 		make([]*regexp.Regexp, 0),
+		project.IgnoredFileSizeLimit,
+		project.IgnoreNonRegularFiles,
+		nil,
+	}
+
+	if project.IgnoreBinaryFiles {
+		extensions := project.BinaryFileExtensions
+		if len(extensions) == 0 {
+			extensions = defaultBinaryFileExtensions
+		}
+
+		result.binaryExtensions = make(map[string]bool)
+		for _, val := range extensions {
+			val = strings.ToLower(strings.TrimSpace(val))
+			if len(val) == 0 {
+				continue
+			}
+			if !strings.HasPrefix(val, ".") {
+				val = "." + val
+			}
+			result.binaryExtensions[val] = true
+		}
 	}
 
 	ignoredFilenames := project.IgnoredFilenames
@@ -252,6 +285,62 @@ func (p *PathFilter) IsFilteredOutByPath(path string) bool {
 
 }
 
+// HasFileAttributeFilters returns true if the filter needs to examine the file on disk (size, type, or contents).
+func (p *PathFilter) HasFileAttributeFilters() bool {
+	return p.fileSizeLimit > 0 || p.ignoreNonRegularFiles || p.binaryExtensions != nil
+}
+
+// IsFilteredOutByFileAttributes examines the file at localPath (an OS-specific absolute path) and returns true,
+// along with the reason, if the file should be ignored due to its size, type, or contents. Directories are never
+// filtered out by this method, and files that no longer exist (for example, on delete) are only filtered out by
+// their extension. This method reads from the file system, so it should not be called on the project list goroutine.
+func (p *PathFilter) IsFilteredOutByFileAttributes(localPath string) (bool, string) {
+
+	if !p.HasFileAttributeFilters() {
+		return false, ""
+	}
+
+	if p.binaryExtensions != nil {
+		ext := strings.ToLower(filepath.Ext(localPath))
+		if len(ext) > 0 && p.binaryExtensions[ext] {
+			return true, "binary file extension '" + ext + "'"
+		}
+	}
+
+	info, err := os.Lstat(localPath)
+	if err != nil || info.IsDir() {
+		return false, ""
+	}
+
+	mode := info.Mode()
+
+	if p.ignoreNonRegularFiles && IsNonRegularFileMode(mode) {
+		return true, "non-regular file (" + mode.String() + ")"
+	}
+
+	if !mode.IsRegular() {
+		// Size and content checks only apply to regular files (reading a FIFO, for example, would block)
+		return false, ""
+	}
+
+	if p.fileSizeLimit > 0 && info.Size() > p.fileSizeLimit {
+		return true, "file size of " + strconv.FormatInt(info.Size(), 10) + " bytes exceeds limit of " + strconv.FormatInt(p.fileSizeLimit, 10)
+	}
+
+	if p.binaryExtensions != nil && info.Size() > 0 {
+		isBinary, err := IsBinaryFileContents(localPath)
+		if err != nil {
+			LogDebug("Unable to read file contents for binary detection: " + localPath + " " + err.Error())
+			return false, ""
+		}
+		if isBinary {
+			return true, "binary file contents"
+		}
+	}
+
+	return false, ""
+}
+
 // ConvertAbsolutePathWithUnixSeparatorsToProjectRelativePath ...
 func ConvertAbsolutePathWithUnixSeparatorsToProjectRelativePath(path string, rootPath string) *string {
 
@@ -0,0 +1,147 @@
+/*******************************************************************************
+* Copyright (c) 2020 IBM Corporation and others.
+* All rights reserved. This program and the accompanying materials
+* are made available under the terms of the Eclipse Public License v2.0
+* which accompanies this distribution, and is available at
+* http://www.eclipse.org/legal/epl-v20.html
+*
+* Contributors:
+*     IBM Corporation - initial API and implementation
+*******************************************************************************/
+
+package utils
+
+import (
+	"bytes"
+	"codewind/models"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestPathFilterIsFilteredOutByFileAttributes(t *testing.T) {
+
+	dir, err := ioutil.TempDir("", "pathutils")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	writeFile := func(name string, contents []byte) string {
+		path := filepath.Join(dir, name)
+		if err := ioutil.WriteFile(path, contents, 0644); err != nil {
+			t.Fatal(err)
+		}
+		return path
+	}
+
+	small := writeFile("small.txt", []byte("hello"))
+	large := writeFile("large.txt", bytes.Repeat([]byte("a"), 100))
+	jar := writeFile("lib.jar", []byte("not really a jar"))
+	upperCaseJar := writeFile("LIB.JAR", []byte("not really a jar"))
+	custom := writeFile("data.custom", []byte("text"))
+	png := writeFile("image.txt", []byte("\x89PNG\r\n\x1a\n"))
+	nul := writeFile("nul.txt", []byte("text\x00text"))
+	empty := writeFile("empty.txt", []byte{})
+	missing := filepath.Join(dir, "missing.txt")
+	missingJar := filepath.Join(dir, "missing.jar")
+
+	subdir := filepath.Join(dir, "subdir.jar.d")
+	if err := os.Mkdir(subdir, 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	socket := filepath.Join(dir, "socket")
+	listener, err := net.Listen("unix", socket)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+
+	symlink := filepath.Join(dir, "symlink.txt")
+	if err := os.Symlink(large, symlink); err != nil {
+		t.Fatal(err)
+	}
+
+	sizeLimit := &models.ProjectToWatch{IgnoredFileSizeLimit: 10}
+	nonRegular := &models.ProjectToWatch{IgnoreNonRegularFiles: true}
+	binary := &models.ProjectToWatch{IgnoreBinaryFiles: true}
+	customBinary := &models.ProjectToWatch{IgnoreBinaryFiles: true, BinaryFileExtensions: []string{"CUSTOM", " "}}
+	none := &models.ProjectToWatch{}
+
+	tests := []struct {
+		name     string
+		project  *models.ProjectToWatch
+		path     string
+		expected bool
+	}{
+		{"no filters", none, large, false},
+		{"below size limit", sizeLimit, small, false},
+		{"above size limit", sizeLimit, large, true},
+		{"size limit does not apply to directories", sizeLimit, subdir, false},
+		{"size limit does not follow symlinks", sizeLimit, symlink, false},
+		{"size limit of missing file", sizeLimit, missing, false},
+		{"regular file with non-regular filter", nonRegular, small, false},
+		{"socket with non-regular filter", nonRegular, socket, true},
+		{"socket without non-regular filter", sizeLimit, socket, false},
+		{"symlink is not non-regular", nonRegular, symlink, false},
+		{"default binary extension", binary, jar, true},
+		{"binary extension is case-insensitive", binary, upperCaseJar, true},
+		{"binary extension of missing file", binary, missingJar, true},
+		{"text extension of missing file", binary, missing, false},
+		{"directories are never filtered", binary, subdir, false},
+		{"custom extension replaces defaults", customBinary, jar, false},
+		{"custom extension without leading dot", customBinary, custom, true},
+		{"magic number sniffing", binary, png, true},
+		{"NUL byte sniffing", binary, nul, true},
+		{"empty file is not binary", binary, empty, false},
+		{"text file is not binary", binary, small, false},
+		{"contents are not sniffed without binary filter", sizeLimit, png, false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			filter, err := NewPathFilter(test.project)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			actual, reason := filter.IsFilteredOutByFileAttributes(test.path)
+			if actual != test.expected {
+				t.Fatalf("IsFilteredOutByFileAttributes(%s) = %v (%q), expected %v", filepath.Base(test.path), actual, reason, test.expected)
+			}
+			if actual && reason == "" {
+				t.Fatal("Expected a reason for the filtered out file")
+			}
+		})
+	}
+}
+
+func TestPathFilterHasFileAttributeFilters(t *testing.T) {
+
+	tests := []struct {
+		name     string
+		project  *models.ProjectToWatch
+		expected bool
+	}{
+		{"none", &models.ProjectToWatch{}, false},
+		{"size limit", &models.ProjectToWatch{IgnoredFileSizeLimit: 1}, true},
+		{"non-regular files", &models.ProjectToWatch{IgnoreNonRegularFiles: true}, true},
+		{"binary files", &models.ProjectToWatch{IgnoreBinaryFiles: true}, true},
+		{"extensions without binary files", &models.ProjectToWatch{BinaryFileExtensions: []string{".jar"}}, false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			filter, err := NewPathFilter(test.project)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if actual := filter.HasFileAttributeFilters(); actual != test.expected {
+				t.Fatalf("HasFileAttributeFilters() = %v, expected %v", actual, test.expected)
+			}
+		})
+	}
+}
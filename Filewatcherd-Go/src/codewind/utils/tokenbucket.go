@@ -0,0 +1,96 @@
+/*******************************************************************************
+* Copyright (c) 2020 IBM Corporation and others.
+* All rights reserved. This program and the accompanying materials
+* are made available under the terms of the Eclipse Public License v2.0
+* which accompanies this distribution, and is available at
+* http://www.eclipse.org/legal/epl-v20.html
+*
+* Contributors:
+*     IBM Corporation - initial API and implementation
+*******************************************************************************/
+
+package utils
+
+import (
+	"time"
+)
+
+/**
+ * Implements a token bucket rate limiter: tokens are added to the bucket at a fixed rate (per second), up to a
+ * maximum of 'burst' tokens, and each operation must take one token.
+ *
+ * This class is not thread safe.
+ */
+type TokenBucket struct {
+	ratePerSecond float64
+	burst         float64
+	tokens        float64
+
+	// Zero until the first operation: a new bucket is full, so its first refill only sets this. The current time is
+	// never read by the bucket, as the time of each operation is given by the caller (which may use a Clock).
+	lastRefill time.Time
+}
+
+// NewTokenBucket returns a full bucket; burst must be at least 1.
+func NewTokenBucket(ratePerSecond float64, burst int) *TokenBucket {
+
+	if burst < 1 {
+		burst = 1
+	}
+
+	return &TokenBucket{
+		ratePerSecond: ratePerSecond,
+		burst:         float64(burst),
+		tokens:        float64(burst),
+	}
+}
+
+func (b *TokenBucket) refill(now time.Time) {
+
+	elapsed := now.Sub(b.lastRefill).Seconds()
+	if elapsed <= 0 {
+		return
+	}
+
+	b.tokens += elapsed * b.ratePerSecond
+	if b.tokens > b.burst {
+		b.tokens = b.burst
+	}
+	b.lastRefill = now
+}
+
+// TryTake takes a token and returns true if one is available, otherwise returns false.
+func (b *TokenBucket) TryTake(now time.Time) bool {
+
+	b.refill(now)
+
+	if b.tokens < 1 {
+		return false
+	}
+
+	b.tokens--
+	return true
+}
+
+// DelayUntilAvailable returns how long until a token will be available (0 if one is available now).
+func (b *TokenBucket) DelayUntilAvailable(now time.Time) time.Duration {
+
+	b.refill(now)
+
+	if b.tokens >= 1 || b.ratePerSecond <= 0 {
+		return 0
+	}
+
+	return time.Duration((1 - b.tokens) / b.ratePerSecond * float64(time.Second))
+}
+
+// AvailableTokens returns the (fractional) number of tokens currently in the bucket.
+func (b *TokenBucket) AvailableTokens(now time.Time) float64 {
+	b.refill(now)
+	return b.tokens
+}
+
+// RatePerSecond returns the rate at which tokens are added to the bucket.
+func (b *TokenBucket) RatePerSecond() float64 {
+	return b.ratePerSecond
+}
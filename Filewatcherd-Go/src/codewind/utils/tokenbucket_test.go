@@ -0,0 +1,132 @@
+/*******************************************************************************
+* Copyright (c) 2020 IBM Corporation and others.
+* All rights reserved. This program and the accompanying materials
+* are made available under the terms of the Eclipse Public License v2.0
+* which accompanies this distribution, and is available at
+* http://www.eclipse.org/legal/epl-v20.html
+*
+* Contributors:
+*     IBM Corporation - initial API and implementation
+*******************************************************************************/
+
+package utils
+
+import (
+	"testing"
+	"time"
+)
+
+/** Take tokens until the bucket is empty, and return the number taken */
+func takeAllTokens(bucket *TokenBucket, clock Clock) int {
+
+	taken := 0
+	for bucket.TryTake(clock.Now()) {
+		taken++
+		if taken > 1000 {
+			break
+		}
+	}
+
+	return taken
+}
+
+func TestTokenBucketAllowsBurst(t *testing.T) {
+
+	tests := []struct {
+		name     string
+		burst    int
+		expected int
+	}{
+		{"burst of 1", 1, 1},
+		{"burst of 5", 5, 5},
+		{"zero burst is raised to 1", 0, 1},
+		{"negative burst is raised to 1", -3, 1},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			clock := &fakeBackoffClock{now: time.Unix(1000, 0)}
+			bucket := NewTokenBucket(2, test.burst)
+
+			if taken := takeAllTokens(bucket, clock); taken != test.expected {
+				t.Fatalf("Took %d tokens from a new bucket, expected %d", taken, test.expected)
+			}
+
+			if delay := bucket.DelayUntilAvailable(clock.Now()); delay != 500*time.Millisecond {
+				t.Fatalf("Unexpected delay of an empty bucket: %v", delay)
+			}
+		})
+	}
+}
+
+func TestTokenBucketRefillsAtRate(t *testing.T) {
+
+	clock := &fakeBackoffClock{now: time.Unix(1000, 0)}
+	bucket := NewTokenBucket(4, 2)
+
+	if taken := takeAllTokens(bucket, clock); taken != 2 {
+		t.Fatalf("Took %d tokens from a new bucket, expected 2", taken)
+	}
+
+	// A token is added every 250ms
+	clock.Sleep(100 * time.Millisecond)
+	if bucket.TryTake(clock.Now()) {
+		t.Fatal("Took a token before one was added")
+	}
+	if delay := bucket.DelayUntilAvailable(clock.Now()); delay != 150*time.Millisecond {
+		t.Fatalf("Unexpected delay: %v", delay)
+	}
+
+	clock.Sleep(150 * time.Millisecond)
+	if delay := bucket.DelayUntilAvailable(clock.Now()); delay != 0 {
+		t.Fatalf("Unexpected delay once a token was added: %v", delay)
+	}
+	if taken := takeAllTokens(bucket, clock); taken != 1 {
+		t.Fatalf("Took %d tokens after 250ms, expected 1", taken)
+	}
+
+	clock.Sleep(500 * time.Millisecond)
+	if taken := takeAllTokens(bucket, clock); taken != 2 {
+		t.Fatalf("Took %d tokens after 500ms, expected 2", taken)
+	}
+}
+
+func TestTokenBucketRefillIsCappedAtBurst(t *testing.T) {
+
+	clock := &fakeBackoffClock{now: time.Unix(1000, 0)}
+	bucket := NewTokenBucket(10, 3)
+
+	takeAllTokens(bucket, clock)
+
+	clock.Sleep(time.Hour)
+	if available := bucket.AvailableTokens(clock.Now()); available != 3 {
+		t.Fatalf("Unexpected available tokens after an hour: %v", available)
+	}
+	if taken := takeAllTokens(bucket, clock); taken != 3 {
+		t.Fatalf("Took %d tokens after an hour, expected 3", taken)
+	}
+}
+
+func TestTokenBucketIgnoresTimeGoingBackwards(t *testing.T) {
+
+	clock := &fakeBackoffClock{now: time.Unix(1000, 0)}
+	bucket := NewTokenBucket(1, 1)
+
+	if !bucket.TryTake(clock.Now()) {
+		t.Fatal("Unable to take a token from a new bucket")
+	}
+
+	if bucket.TryTake(clock.Now().Add(-time.Hour)) {
+		t.Fatal("Took a token at an earlier time")
+	}
+
+	// The refill is from the latest time, not the earlier one
+	clock.Sleep(999 * time.Millisecond)
+	if bucket.TryTake(clock.Now()) {
+		t.Fatal("Took a token before one was added")
+	}
+	clock.Sleep(time.Millisecond)
+	if !bucket.TryTake(clock.Now()) {
+		t.Fatal("Unable to take a token once one was added")
+	}
+}
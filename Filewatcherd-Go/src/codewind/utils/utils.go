@@ -13,8 +13,11 @@ package utils
 
 import (
 	"crypto/rand"
+	"crypto/sha256"
 	"encoding/hex"
 	"fmt"
+	"os"
+	"strconv"
 	"strings"
 	"time"
 )
@@ -84,20 +87,29 @@ func StripTrailingForwardSlash(str string) string {
 
 }
 
-func IsValidURLBase(str string) bool {
+/** Returns the integer value of the given environment variable, or defaultValue if it is not set or not a valid integer. */
+func GetEnvInt64(name string, defaultValue int64) int64 {
 
-	if strings.HasPrefix(str, "http://") {
-		return true
+	value, ok := os.LookupEnv(name)
+	if !ok || strings.TrimSpace(value) == "" {
+		return defaultValue
 	}
 
-	if strings.HasPrefix(str, "https://") {
-		return true
+	result, err := strconv.ParseInt(strings.TrimSpace(value), 10, 64)
+	if err != nil {
+		LogError("Ignoring invalid integer value for environment variable " + name + ": " + value)
+		return defaultValue
 	}
 
-	return false
+	return result
+}
+
+func IsValidURLBase(str string) bool {
+	_, err := ParseBaseURL(str)
+	return err == nil
 }
 
-/** Ok, more like a "uuid", but at least the same amount of entropy */
+/** Returns a random (version 4) UUID, as described in RFC 4122, eg 'f47ac10b-58cc-4372-a567-0e02b2c3d479'; returns nil if no random bytes are available. */
 func GenerateUuid() *string {
 	u := make([]byte, 16)
 	_, err := rand.Read(u)
@@ -105,11 +117,51 @@ func GenerateUuid() *string {
 		return nil
 	}
 
-	result := hex.EncodeToString(u)
+	u[6] = (u[6] & 0x0f) | 0x40 // Version 4 (random)
+	u[8] = (u[8] & 0x3f) | 0x80 // Variant 10 (RFC 4122)
+
+	result := hex.EncodeToString(u[0:4]) + "-" + hex.EncodeToString(u[4:6]) + "-" + hex.EncodeToString(u[6:8]) + "-" +
+		hex.EncodeToString(u[8:10]) + "-" + hex.EncodeToString(u[10:16])
 
 	return &result
 }
 
+/** Returns true if the string is a UUID in the canonical (lowercase, 8-4-4-4-12 hex digit) form. */
+func IsValidUuid(str string) bool {
+
+	if len(str) != 36 {
+		return false
+	}
+
+	for i, c := range str {
+		if i == 8 || i == 13 || i == 18 || i == 23 {
+			if c != '-' {
+				return false
+			}
+		} else if !(c >= '0' && c <= '9') && !(c >= 'a' && c <= 'f') {
+			return false
+		}
+	}
+
+	return true
+}
+
+// IdempotencyKeyHeader is the request header containing a key that is the same for every retry of the same request,
+// so that the server can ignore a request it has already processed (for example, when the response was lost).
+const IdempotencyKeyHeader = "Idempotency-Key"
+
+/** Returns a stable idempotency key for the given parts: the same parts always produce the same key. */
+func GenerateIdempotencyKey(parts ...string) string {
+
+	hash := sha256.New()
+	for _, part := range parts {
+		// Length-prefix each part, so that different splits of the same characters produce different keys
+		hash.Write([]byte(strconv.Itoa(len(part)) + ":" + part))
+	}
+
+	return hex.EncodeToString(hash.Sum(nil))
+}
+
 func FormatTime(t time.Time) string {
 
 	formatted := "[" + fmt.Sprintf("%d-%02d-%02d %02d:%02d:%02d.%03d",
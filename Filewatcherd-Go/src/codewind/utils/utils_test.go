@@ -0,0 +1,79 @@
+/*******************************************************************************
+* Copyright (c) 2020 IBM Corporation and others.
+* All rights reserved. This program and the accompanying materials
+* are made available under the terms of the Eclipse Public License v2.0
+* which accompanies this distribution, and is available at
+* http://www.eclipse.org/legal/epl-v20.html
+*
+* Contributors:
+*     IBM Corporation - initial API and implementation
+*******************************************************************************/
+
+package utils
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestGenerateUuidIsRandomVersion4(t *testing.T) {
+
+	seen := make(map[string]bool)
+
+	for index := 0; index < 1000; index++ {
+		uuid := GenerateUuid()
+		if uuid == nil {
+			t.Fatal("Unable to generate UUID")
+		}
+
+		if !IsValidUuid(*uuid) {
+			t.Fatalf("Generated UUID is not in 8-4-4-4-12 form: %s", *uuid)
+		}
+
+		// The version is the first hex digit of the third group
+		if version := (*uuid)[14]; version != '4' {
+			t.Fatalf("Generated UUID does not have version 4: %s", *uuid)
+		}
+
+		// The variant is the top bits of the first hex digit of the fourth group, which must be 10xx
+		if variant := (*uuid)[19]; !strings.ContainsRune("89ab", rune(variant)) {
+			t.Fatalf("Generated UUID does not have the RFC 4122 variant: %s", *uuid)
+		}
+
+		if seen[*uuid] {
+			t.Fatalf("Generated the same UUID twice: %s", *uuid)
+		}
+		seen[*uuid] = true
+	}
+}
+
+func TestIsValidUuid(t *testing.T) {
+
+	tests := []struct {
+		name     string
+		uuid     string
+		expected bool
+	}{
+		{"valid", "f47ac10b-58cc-4372-a567-0e02b2c3d479", true},
+		{"all zeros", "00000000-0000-0000-0000-000000000000", true},
+		{"empty", "", false},
+		{"uppercase", "F47AC10B-58CC-4372-A567-0E02B2C3D479", false},
+		{"braces", "{f47ac10b-58cc-4372-a567-0e02b2c3d479}", false},
+		{"no hyphens", "f47ac10b58cc4372a5670e02b2c3d479", false},
+		{"hyphens moved", "f47ac10b5-8cc-4372-a567-0e02b2c3d479", false},
+		{"hyphen replaced", "f47ac10b_58cc-4372-a567-0e02b2c3d479", false},
+		{"non-hex digit", "g47ac10b-58cc-4372-a567-0e02b2c3d479", false},
+		{"too short", "f47ac10b-58cc-4372-a567-0e02b2c3d47", false},
+		{"too long", "f47ac10b-58cc-4372-a567-0e02b2c3d4790", false},
+		{"trailing newline", "f47ac10b-58cc-4372-a567-0e02b2c3d47\n", false},
+		{"multi-byte character", "f47ac10b-58cc-4372-a567-0e02b2c3d4é", false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if actual := IsValidUuid(test.uuid); actual != test.expected {
+				t.Fatalf("IsValidUuid(%q) = %v, expected %v", test.uuid, actual, test.expected)
+			}
+		})
+	}
+}
@@ -0,0 +1,256 @@
+/*******************************************************************************
+* Copyright (c) 2020 IBM Corporation and others.
+* All rights reserved. This program and the accompanying materials
+* are made available under the terms of the Eclipse Public License v2.0
+* which accompanies this distribution, and is available at
+* http://www.eclipse.org/legal/epl-v20.html
+*
+* Contributors:
+*     IBM Corporation - initial API and implementation
+*******************************************************************************/
+
+package main
+
+import (
+	"bytes"
+	"codewind/utils"
+	"encoding/json"
+	"net/http"
+	neturl "net/url"
+	"strconv"
+	"time"
+)
+
+/**
+ * WatchStatusReporter is responsible for informing the server (via HTTP PUT request) of the success/failure of the
+ * initial watch of each project.
+ *
+ * Only the latest status of each project is kept: a new report for a project replaces any report that has not yet
+ * been sent, and once a project's watch is removed, its pending report is dropped. Failed requests are retried
+ * (with a per-project exponential backoff) until they succeed, or until the report is older than the maximum age
+ * (watchStatusReportMaxAge, by default). At most one request per project is in progress at a time.
+ *
+ * All state is owned by a single goroutine; the public methods communicate with it by channel.
+ */
+type WatchStatusReporter struct {
+	baseURL    string
+	clientUUID string
+
+	/** Used by every status request, so that connections to the server are reused; thread safe */
+	client *http.Client
+
+	/** The source of the creation time of reports, and of the retry timers */
+	clock utils.Clock
+
+	/** A report that has not been successfully sent after this long is dropped */
+	maxAge time.Duration
+
+	reportChannel       chan *watchStatusReport
+	cancelChannel       chan string
+	requestDebugChannel chan chan string
+}
+
+const (
+	// By default, a report that has not been successfully sent after this long is dropped
+	watchStatusReportMaxAge = 60 * time.Minute
+)
+
+type watchStatusReport struct {
+	projectID    string
+	watchStateID string
+	success      bool
+	created      time.Time
+
+	// The following fields are only used by the reporter goroutine
+	backoff     utils.ExponentialBackoff
+	nextAttempt time.Time
+	attempts    int
+}
+
+type watchStatusResult struct {
+	report *watchStatusReport
+	err    error
+}
+
+type watchStatusRequestBodyJSON struct {
+	Success bool `json:"success"`
+}
+
+func NewWatchStatusReporter(baseURL string, clientUUID string) *WatchStatusReporter {
+	return newWatchStatusReporterWithClock(baseURL, clientUUID, utils.SystemClock, watchStatusReportMaxAge)
+}
+
+/** Create a reporter whose reports are retried (and dropped after maxAge) using the given clock, for example, for tests. */
+func newWatchStatusReporterWithClock(baseURL string, clientUUID string, clock utils.Clock, maxAge time.Duration) *WatchStatusReporter {
+
+	result := &WatchStatusReporter{
+		baseURL:             baseURL,
+		clientUUID:          clientUUID,
+		client:              utils.NewHTTPClient(baseURL),
+		clock:               clock,
+		maxAge:              maxAge,
+		reportChannel:       make(chan *watchStatusReport),
+		cancelChannel:       make(chan string),
+		requestDebugChannel: make(chan chan string),
+	}
+
+	go result.reporterLoop()
+
+	return result
+}
+
+/** Queue a report of the watch status of the project, replacing any unsent report for the same project. */
+func (reporter *WatchStatusReporter) ReportStatus(projectID string, watchStateID string, success bool) {
+
+	reporter.reportChannel <- &watchStatusReport{
+		projectID:    projectID,
+		watchStateID: watchStateID,
+		success:      success,
+		created:      reporter.clock.Now(),
+		backoff:      utils.NewExponentialBackoff(),
+	}
+}
+
+/** Drop any unsent report for the project, for example because the project is no longer watched. */
+func (reporter *WatchStatusReporter) CancelReports(projectID string) {
+	reporter.cancelChannel <- projectID
+}
+
+func (reporter *WatchStatusReporter) RequestDebugMessage() chan string {
+	result := make(chan string)
+
+	reporter.requestDebugChannel <- result
+
+	return result
+}
+
+func (reporter *WatchStatusReporter) reporterLoop() {
+
+	// The latest unsent report of each project
+	pending := make(map[string] /* project id -> */ *watchStatusReport)
+
+	// The report of each project that is currently being sent
+	inFlight := make(map[string] /* project id -> */ *watchStatusReport)
+
+	resultChannel := make(chan *watchStatusResult)
+
+	for {
+
+		now := reporter.clock.Now()
+
+		// Start a request for each report that is due, and determine when the next report will be due
+		var nextAttemptTimer <-chan time.Time
+		var nextAttempt time.Time
+
+		for projectID, report := range pending {
+
+			if _, exists := inFlight[projectID]; exists {
+				continue
+			}
+
+			if now.Sub(report.created) > reporter.maxAge {
+				utils.LogSevere("Unable to inform server of watch state after " + strconv.Itoa(report.attempts) + " attempts, giving up: " + report.projectID + ", watch-state-id: " + report.watchStateID)
+				delete(pending, projectID)
+				continue
+			}
+
+			if !now.Before(report.nextAttempt) {
+				inFlight[projectID] = report
+				report.attempts++
+				go reporter.sendReport(report, resultChannel)
+
+			} else if nextAttempt.IsZero() || report.nextAttempt.Before(nextAttempt) {
+				nextAttempt = report.nextAttempt
+			}
+		}
+
+		if !nextAttempt.IsZero() {
+			nextAttemptTimer = reporter.clock.After(nextAttempt.Sub(now))
+		}
+
+		select {
+		case report := <-reporter.reportChannel:
+			if existing, exists := pending[report.projectID]; exists && existing != inFlight[report.projectID] {
+				utils.LogInfo("Dropping superseded watch status report for " + existing.projectID + ", watch-state-id: " + existing.watchStateID)
+			}
+			pending[report.projectID] = report
+
+		case projectID := <-reporter.cancelChannel:
+			if existing, exists := pending[projectID]; exists {
+				utils.LogInfo("Dropping watch status report for removed project " + projectID + ", watch-state-id: " + existing.watchStateID)
+				delete(pending, projectID)
+			}
+
+		case result := <-resultChannel:
+			report := result.report
+			delete(inFlight, report.projectID)
+
+			// Ignore the result if the report was superseded or cancelled while in flight
+			if pending[report.projectID] != report {
+				continue
+			}
+
+			if result.err == nil {
+				utils.LogInfo("Successfully informed server of watch state for " + report.projectID + ", watch-state-id: " + report.watchStateID + ", success: " + strconv.FormatBool(report.success))
+				delete(pending, report.projectID)
+			} else {
+				utils.LogErrorErr("Error from PUT request for "+report.projectID, result.err)
+				report.backoff.FailIncrease()
+				report.nextAttempt = reporter.clock.Now().Add(time.Duration(report.backoff.GetFailureDelay()) * time.Millisecond)
+			}
+
+		case <-nextAttemptTimer:
+			// Due reports are sent at the top of the loop
+
+		case debugResponseChannel := <-reporter.requestDebugChannel:
+			result := ""
+			for _, report := range pending {
+				result += "- projectID: " + report.projectID + "  watch-state-id: " + report.watchStateID + "  success: " + strconv.FormatBool(report.success) + "  attempts: " + strconv.Itoa(report.attempts)
+				if _, exists := inFlight[report.projectID]; exists {
+					result += "  (in flight)"
+				}
+				result += "\n"
+			}
+			debugResponseChannel <- result
+		}
+	}
+}
+
+/** Send the PUT request for the report, then communicate the result back on the result channel. */
+func (reporter *WatchStatusReporter) sendReport(report *watchStatusReport, resultChannel chan *watchStatusResult) {
+	resultChannel <- &watchStatusResult{report, reporter.sendPut(report)}
+}
+
+func (reporter *WatchStatusReporter) sendPut(report *watchStatusReport) error {
+
+	url := utils.JoinURL(reporter.baseURL, "/api/v1/projects/"+report.projectID+"/file-changes/"+report.watchStateID+"/status", neturl.Values{"clientUuid": {reporter.clientUUID}})
+
+	utils.LogDebug("Sending PUT request to " + utils.RedactURL(url))
+
+	body, err := json.Marshal(watchStatusRequestBodyJSON{report.success})
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequest(http.MethodPut, url, bytes.NewBuffer(body))
+	if err != nil {
+		return err
+	}
+
+	// Each retry of this status report has the same key, so the server can ignore duplicates
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(utils.IdempotencyKeyHeader, utils.GenerateIdempotencyKey(reporter.clientUUID, report.projectID, report.watchStateID, strconv.FormatBool(report.success)))
+
+	resp, err := reporter.client.Do(req)
+	if err != nil {
+		return err
+	}
+
+	resp.Body.Close()
+
+	if resp.StatusCode != 200 {
+		return &PostResponseError{resp.StatusCode}
+	}
+
+	return nil
+}
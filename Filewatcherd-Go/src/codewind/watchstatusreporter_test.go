@@ -0,0 +1,318 @@
+/*******************************************************************************
+* Copyright (c) 2020 IBM Corporation and others.
+* All rights reserved. This program and the accompanying materials
+* are made available under the terms of the Eclipse Public License v2.0
+* which accompanies this distribution, and is available at
+* http://www.eclipse.org/legal/epl-v20.html
+*
+* Contributors:
+*     IBM Corporation - initial API and implementation
+*******************************************************************************/
+
+package main
+
+import (
+	"codewind/utils"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+/** A watch status PUT request received by the test server */
+type receivedPutRequest struct {
+	path           string
+	idempotencyKey string
+
+	/** The response is only sent once the status code is sent to this channel */
+	respond chan int
+}
+
+/**
+ * A server that records the watch status PUT requests it receives. Each request is answered with the next status
+ * code of the 'statusCodes' channel (200 once it is empty), unless the server is blocking, in which case the test
+ * must send the status code of each request to its 'respond' channel.
+ */
+type putTestServer struct {
+	*httptest.Server
+
+	received    chan *receivedPutRequest
+	statusCodes chan int
+	blocking    bool
+}
+
+func newPutTestServer(t *testing.T, blocking bool, statusCodes ...int) *putTestServer {
+
+	server := &putTestServer{
+		received:    make(chan *receivedPutRequest, 100),
+		statusCodes: make(chan int, 100),
+		blocking:    blocking,
+	}
+
+	for _, statusCode := range statusCodes {
+		server.statusCodes <- statusCode
+	}
+
+	server.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPut {
+			t.Errorf("Unexpected request: %s %s", r.Method, r.URL.Path)
+		}
+
+		request := &receivedPutRequest{r.URL.Path, r.Header.Get(utils.IdempotencyKeyHeader), make(chan int, 1)}
+		server.received <- request
+
+		if server.blocking {
+			select {
+			case statusCode := <-request.respond:
+				w.WriteHeader(statusCode)
+			case <-time.After(10 * time.Second):
+				w.WriteHeader(http.StatusServiceUnavailable)
+			}
+			return
+		}
+
+		select {
+		case statusCode := <-server.statusCodes:
+			w.WriteHeader(statusCode)
+		default:
+			w.WriteHeader(http.StatusOK)
+		}
+	}))
+
+	t.Cleanup(server.Close)
+
+	return server
+}
+
+func (server *putTestServer) nextRequest(t *testing.T) *receivedPutRequest {
+	t.Helper()
+
+	select {
+	case request := <-server.received:
+		return request
+	case <-time.After(10 * time.Second):
+		t.Fatal("Timed out waiting for a PUT request")
+		return nil
+	}
+}
+
+func (server *putTestServer) expectNoRequest(t *testing.T) {
+	t.Helper()
+
+	select {
+	case request := <-server.received:
+		t.Fatalf("Unexpected PUT request: %+v", request)
+	case <-time.After(200 * time.Millisecond):
+	}
+}
+
+/** Advance the clock to the deadline of the next retry timer of the reporter. */
+func advanceToNextWatchStatusRetry(t *testing.T, clock *fakeClock) time.Time {
+	t.Helper()
+
+	deadline := clock.nextAfterCall(t)
+	if delay := deadline.Sub(clock.Now()); delay > 0 {
+		clock.Advance(delay)
+	}
+
+	return deadline
+}
+
+/** Wait for the reporter to have no pending reports. */
+func waitForNoPendingWatchStatusReports(t *testing.T, reporter *WatchStatusReporter) {
+	t.Helper()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		pending := <-reporter.RequestDebugMessage()
+		if pending == "" {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("Timed out waiting for the pending reports to be dropped: %s", pending)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func watchStatusPath(projectID string, watchStateID string) string {
+	return "/api/v1/projects/" + projectID + "/file-changes/" + watchStateID + "/status"
+}
+
+func TestRetriedWatchStatusHasSameIdempotencyKey(t *testing.T) {
+
+	server := newPutTestServer(t, false, http.StatusInternalServerError)
+
+	reporter := NewWatchStatusReporter(server.URL, "test-client-uuid")
+
+	reporter.ReportStatus("test-project", "state-1", true)
+
+	// The first request fails, and is retried after the backoff delay
+	first := server.nextRequest(t)
+	second := server.nextRequest(t)
+
+	if first.path != watchStatusPath("test-project", "state-1") || first.path != second.path {
+		t.Fatalf("Unexpected requests: %+v %+v", first, second)
+	}
+
+	if first.idempotencyKey == "" || first.idempotencyKey != second.idempotencyKey {
+		t.Fatalf("Retry of a watch status report did not have the same idempotency key: %+v %+v", first, second)
+	}
+
+	// A report of a different watch state has a different key
+	reporter.ReportStatus("test-project", "state-2", true)
+
+	if third := server.nextRequest(t); third.idempotencyKey == first.idempotencyKey {
+		t.Fatalf("Different reports had the same idempotency key: %+v %+v", first, third)
+	}
+
+	server.expectNoRequest(t)
+}
+
+func TestNewerWatchStatusReplacesPendingReport(t *testing.T) {
+
+	server := newPutTestServer(t, false, http.StatusInternalServerError)
+	clock := newFakeClock()
+	reporter := newWatchStatusReporterWithClock(server.URL, "test-client-uuid", clock, time.Hour)
+
+	reporter.ReportStatus("test-project", "state-1", false)
+
+	if request := server.nextRequest(t); request.path != watchStatusPath("test-project", "state-1") {
+		t.Fatalf("Unexpected request: %+v", request)
+	}
+
+	// Wait for the retry of the failed report to be scheduled, then replace it
+	clock.nextAfterCall(t)
+	reporter.ReportStatus("test-project", "state-2", true)
+
+	// The newer report is sent immediately, rather than after the backoff delay of the report it replaced
+	if request := server.nextRequest(t); request.path != watchStatusPath("test-project", "state-2") {
+		t.Fatalf("Unexpected request: %+v", request)
+	}
+	waitForNoPendingWatchStatusReports(t, reporter)
+
+	// The replaced report is never retried
+	clock.Advance(time.Minute)
+	server.expectNoRequest(t)
+}
+
+func TestNewerWatchStatusReplacesInFlightReport(t *testing.T) {
+
+	server := newPutTestServer(t, true)
+	clock := newFakeClock()
+	reporter := newWatchStatusReporterWithClock(server.URL, "test-client-uuid", clock, time.Hour)
+
+	reporter.ReportStatus("test-project", "state-1", false)
+
+	first := server.nextRequest(t)
+	if first.path != watchStatusPath("test-project", "state-1") {
+		t.Fatalf("Unexpected request: %+v", first)
+	}
+
+	// Only one request per project is in progress at a time, so the newer report waits for the first to complete
+	reporter.ReportStatus("test-project", "state-2", true)
+	server.expectNoRequest(t)
+
+	first.respond <- http.StatusInternalServerError
+
+	second := server.nextRequest(t)
+	if second.path != watchStatusPath("test-project", "state-2") {
+		t.Fatalf("Unexpected request: %+v", second)
+	}
+	second.respond <- http.StatusOK
+	waitForNoPendingWatchStatusReports(t, reporter)
+
+	// The failure of the replaced report is ignored, rather than retried
+	clock.Advance(time.Minute)
+	server.expectNoRequest(t)
+}
+
+func TestCancelledWatchStatusIsNotRetried(t *testing.T) {
+
+	for _, inFlight := range []bool{false, true} {
+
+		name := "pending"
+		if inFlight {
+			name = "in flight"
+		}
+
+		t.Run(name, func(t *testing.T) {
+
+			server := newPutTestServer(t, true)
+			clock := newFakeClock()
+			reporter := newWatchStatusReporterWithClock(server.URL, "test-client-uuid", clock, time.Hour)
+
+			reporter.ReportStatus("removed-project", "state-1", true)
+			reporter.ReportStatus("other-project", "state-1", true)
+
+			requests := map[string]*receivedPutRequest{}
+			for index := 0; index < 2; index++ {
+				request := server.nextRequest(t)
+				requests[strings.Split(request.path, "/")[4]] = request
+			}
+
+			if inFlight {
+				// The project is removed while its request is in progress, and the request then fails
+				reporter.CancelReports("removed-project")
+				requests["removed-project"].respond <- http.StatusInternalServerError
+			} else {
+				// The project is removed while its failed report is waiting to be retried
+				requests["removed-project"].respond <- http.StatusInternalServerError
+				clock.nextAfterCall(t)
+				reporter.CancelReports("removed-project")
+			}
+
+			// The report of the other project is still retried
+			requests["other-project"].respond <- http.StatusInternalServerError
+			advanceToNextWatchStatusRetry(t, clock)
+
+			request := server.nextRequest(t)
+			if request.path != watchStatusPath("other-project", "state-1") {
+				t.Fatalf("Unexpected request: %+v", request)
+			}
+			request.respond <- http.StatusOK
+
+			waitForNoPendingWatchStatusReports(t, reporter)
+
+			clock.Advance(time.Hour)
+			server.expectNoRequest(t)
+		})
+	}
+}
+
+func TestWatchStatusIsDroppedAfterMaxAge(t *testing.T) {
+
+	// Every request fails
+	server := newPutTestServer(t, true)
+	clock := newFakeClock()
+	maxAge := 5 * time.Second
+	reporter := newWatchStatusReporterWithClock(server.URL, "test-client-uuid", clock, maxAge)
+
+	created := clock.Now()
+	reporter.ReportStatus("test-project", "state-1", true)
+
+	attempts := 0
+	for {
+		request := server.nextRequest(t)
+		if request.path != watchStatusPath("test-project", "state-1") {
+			t.Fatalf("Unexpected request: %+v", request)
+		}
+		attempts++
+		request.respond <- http.StatusInternalServerError
+
+		// The report is retried until a retry would be sent after the maximum age
+		if retry := advanceToNextWatchStatusRetry(t, clock); retry.Sub(created) > maxAge {
+			break
+		}
+	}
+
+	if attempts < 2 {
+		t.Fatalf("Expected the report to be retried before it was dropped, but it was sent %d time(s)", attempts)
+	}
+
+	waitForNoPendingWatchStatusReports(t, reporter)
+
+	clock.Advance(time.Hour)
+	server.expectNoRequest(t)
+}
@@ -12,14 +12,9 @@
 package main
 
 import (
-	"codewind/models"
 	"codewind/utils"
 	"crypto/tls"
-	"encoding/json"
 	"errors"
-	"net/url"
-	"strconv"
-	"strings"
 	"time"
 
 	"github.com/gorilla/websocket"
@@ -27,215 +22,143 @@ import (
 
 /**
  * The purpose of the WebSocket Connection Manager is to initiate and maintain the WebSocket
- * connection between the filewatcher and the server.
+ * connection between the filewatcher and the server (or, if WebSockets are blocked, the
+ * Server-Sent Events connection; see pushtransport.go).
  *
- * After queueEstablishConnection(...) is called, we will keep trying to connect
- * to the server until it succeeds. If that connection ever goes down for any
- * reason, queueEstablishConnection() still start the reconnection process over
- * again.
+ * After StartWSConnectionManager(...) is called, we will keep trying to connect
+ * to the server until it succeeds. Each connection is managed by a session (wsSession or
+ * sseSession); if the session ever closes for any reason, the reconnection process starts
+ * over again.
  *
- * This class also sends a simple "keep alive" packet every X seconds (eg 25).
+ * This class also sends a WebSocket ping every X seconds (eg 25), and expects a pong (or any other message) from the
+ * server within Y seconds (eg 60); otherwise, the connection is assumed to be dead (for example, a half-open TCP
+ * connection after the laptop has slept) and a reconnect is triggered.
+ *
+ * If enabled, a health report is also sent to the server on each connection every Z seconds (see wstelemetry.go).
  */
 
-type ReconnectMessage int
+// The keep-alive settings of the WebSocket connection, set with the FILEWATCHER_WS_PING_INTERVAL_MS and
+// FILEWATCHER_WS_PONG_TIMEOUT_MS environment variables.
+type wsKeepAliveSettings struct {
+	pingInterval time.Duration
+	pongTimeout  time.Duration
+}
 
-const (
-	Reconnect = iota + 1
-	Terminate
-)
+func newWSKeepAliveSettings() wsKeepAliveSettings {
 
-func StartWSConnectionManager(baseURL string, projectList *ProjectList, httpGetStatusThread *HttpGetStatusThread) error {
-	baseURL = utils.StripTrailingForwardSlash(baseURL)
-
-	if !utils.IsValidURLBase(baseURL) {
-		return errors.New("URL is invalid: " + baseURL)
+	result := wsKeepAliveSettings{
+		pingInterval: time.Duration(utils.GetEnvInt64("FILEWATCHER_WS_PING_INTERVAL_MS", 25000)) * time.Millisecond,
+		pongTimeout:  time.Duration(utils.GetEnvInt64("FILEWATCHER_WS_PONG_TIMEOUT_MS", 60000)) * time.Millisecond,
 	}
 
-	wsURLType := "ws"
-	if strings.HasPrefix(baseURL, "https:") {
-		wsURLType = "wss"
+	if result.pingInterval <= 0 {
+		result.pingInterval = 25 * time.Second
 	}
 
-	lastSlash := strings.LastIndex(baseURL, "/")
-	if lastSlash == -1 {
-		return errors.New("Invalid URL format, no slash found: " + baseURL)
+	// The server must have at least one chance to respond to a ping before the connection is considered dead
+	if result.pongTimeout <= result.pingInterval {
+		utils.LogError("WebSocket pong timeout must be greater than the ping interval, using " + (2 * result.pingInterval).String())
+		result.pongTimeout = 2 * result.pingInterval
 	}
 
-	hostnameAndPort := baseURL[lastSlash+1:]
-
-	go eventLoop(wsURLType, hostnameAndPort, projectList, httpGetStatusThread)
-
-	return nil
+	return result
 }
 
-func eventLoop(wsURLType string, hostnameAndPort string, projectList *ProjectList, httpGetStatusThread *HttpGetStatusThread) {
+func StartWSConnectionManager(baseURL string, projectList *ProjectList, httpGetStatusThread *HttpGetStatusThread, debugTimer *DebugTimer) error {
+	baseURL = utils.StripTrailingForwardSlash(baseURL)
 
-	for {
+	if !utils.IsValidURLBase(baseURL) {
+		return errors.New("URL is invalid: " + utils.RedactURL(baseURL))
+	}
 
-		reconnectNeeded := make(chan ReconnectMessage)
+	transportSettings, err := newPushTransportSettings(baseURL, newWSKeepAliveSettings())
+	if err != nil {
+		return err
+	}
 
-		// Kick off websocket using channel
-		startWebSocketThread(wsURLType, hostnameAndPort, reconnectNeeded, projectList, httpGetStatusThread)
+	telemetryInterval := getTelemetryInterval()
+	if telemetryInterval > 0 {
+		utils.LogInfo("Health reports will be sent to the server every " + telemetryInterval.String())
+	}
 
-		// We only read the first message from this channel, to avoid duplicates
-		v := <-reconnectNeeded
+	go eventLoop(transportSettings, newDefaultWSMessageDispatcher(projectList, debugTimer), httpGetStatusThread, debugTimer, telemetryInterval)
 
-		if v == Reconnect {
-			// Ignore and loop to top
-			utils.LogInfo("WebSocket thread received reconnect message.")
+	return nil
+}
 
-			// We lost the WebSocket connection, and theoretically might have missed
-			// a watch refresh, so reacquire the latest watches.
-			httpGetStatusThread.SignalStatusRefreshNeeded()
+func eventLoop(transportSettings *pushTransportSettings, dispatcher *wsMessageDispatcher, httpGetStatusThread *HttpGetStatusThread, debugTimer *DebugTimer, telemetryInterval time.Duration) {
 
-		} else if v == Terminate {
-			utils.LogInfo("WebSocket thread received terminate message.")
-			return
-		}
-	}
+	// Shared across connections, so that a connection that is repeatedly accepted then dropped continues to back off
+	backoff := utils.NewDefaultReconnectBackoff()
 
-}
+	// The index of the transport to connect with first; this is the transport that most recently connected
+	currentTransport := 0
 
-func startWebSocketThread(wsURLType string, hostnameAndPort string, triggerRetry chan ReconnectMessage, projectList *ProjectList, httpGetStatusThread *HttpGetStatusThread) {
+	// The consecutive failures of the current transport, across sessions, so that a transport whose sessions are
+	// always dropped soon after connecting is eventually switched
+	transportFailures := 0
 
-	u := url.URL{Scheme: wsURLType, Host: hostnameAndPort, Path: "/websockets/file-changes/v1"}
+	for {
 
-	backoff := utils.NewExponentialBackoff()
+		// Keep trying to connect until success
+		session, transport := connectPushTransport(transportSettings, &currentTransport, &transportFailures, dispatcher.Dispatch, backoff)
 
-	var c *websocket.Conn
+		// On success, issue a GET request in case we missed anything.
+		httpGetStatusThread.SignalStatusRefreshNeeded()
 
-	// Keep trying to connect on the WebSocket thread, until success
-	for {
+		session.Start()
 
-		utils.LogInfo("Connecting to " + u.String())
+		startHealthReports(session, transport, debugTimer, telemetryInterval)
 
-		dialer := &websocket.Dialer{}
-		dialer.TLSClientConfig = &tls.Config{InsecureSkipVerify: true}
+		<-session.Done()
 
-		innerC, _, err := dialer.Dial(u.String(), nil)
+		utils.LogInfo("Session of " + transport.debugName() + " has closed, reconnecting. Reason: " + session.CloseReason())
 
-		c = innerC
+		// We lost the connection, and theoretically might have missed
+		// a watch refresh, so reacquire the latest watches.
+		httpGetStatusThread.SignalStatusRefreshNeeded()
 
-		if err != nil {
-			utils.LogErrorErr("Error on connecting:", err)
-			if innerC != nil {
-				innerC.Close() // Unnecessary?
-			}
+		// Always wait (at least the base delay, with jitter) before reconnecting, so that clients do not all reconnect
+		// at the same moment when the server restarts; the delay is only reset if the connection was healthy.
+		if backoff.OnDisconnected() {
+			transportFailures = 0
 		} else {
-			// Success, so stop trying to connect
-			break
+			recordPushTransportFailure(transportSettings, &currentTransport, &transportFailures)
 		}
-
-		// On failure, sleep
 		backoff.SleepAfterFail()
-		backoff.FailIncrease()
 	}
 
-	utils.LogInfo("Successfully connected to " + u.String())
-
-	// On success, issue a GET request in case we missed anything.
-	httpGetStatusThread.SignalStatusRefreshNeeded()
-
-	ticker := time.NewTicker(25 * time.Second)
-	tickerClosedChan := make(chan *time.Ticker)
-
-	startWriteEmptyMessageTickerHandler(ticker, c, tickerClosedChan)
-
-	c.SetCloseHandler(func(code int, text string) error {
-		triggerRetry <- Reconnect
-		utils.LogInfo("Close handler called with values: " + strconv.Itoa(code) + " " + text)
-
-		if c != nil {
-			c.Close()
-		}
-
-		ticker.Stop()
-		tickerClosedChan <- ticker
-
-		return nil
-	})
-
-	// Start a new listening thread, which informs us on failure
-	go func() {
-		for {
-			_, message, err := c.ReadMessage()
-			if err != nil {
-				triggerRetry <- Reconnect
-				utils.LogErrorErr("Read error:", err)
-				c.Close()
-
-				ticker.Stop()
-				tickerClosedChan <- ticker
-				return
-			}
-
-			var emptyInterface interface{}
-			err = json.Unmarshal(message, &emptyInterface)
-			m := emptyInterface.(map[string]interface{})
-			if m["type"] == "debug" {
-				// This string is sent only by automated tests
-				if str, ok := m["msg"].(string); ok {
-					utils.LogInfo("------------------------------------------------------------")
-					utils.LogInfo("[Server-Debug] " + str)
-					utils.LogInfo("------------------------------------------------------------")
-				}
-				continue
-			}
-
-			var watchChangeJSON models.WatchChangeJson
-			error := json.Unmarshal(message, &watchChangeJSON)
-
-			if error != nil {
-				utils.LogSevereErr("Error occurred while unmarshalling JSON ", error)
-				continue
-			}
-
-			projectUpdatesReceived := ""
-
-			projectList.UpdateProjectListFromWebSocket(&watchChangeJSON)
-
-			utils.LogInfo("Received watch change message from WebSocket: " + string(message))
-
-			for x := 0; x < len(watchChangeJSON.Projects); x++ {
-
-				entry := watchChangeJSON.Projects[x]
-				projectUpdatesReceived += "[" + entry.ProjectID + " in " + entry.PathToMonitor + "], "
-			}
-
-			// Trim whitespace and trailing comma
-			projectUpdatesReceived = strings.TrimSpace(projectUpdatesReceived)
-			if strings.HasSuffix(projectUpdatesReceived, ",") {
-				projectUpdatesReceived = projectUpdatesReceived[:len(projectUpdatesReceived)-1]
-			}
+}
 
-			utils.LogInfo("Watch list change message received for { " + projectUpdatesReceived + " }")
+/** The WebSocket push transport */
+type wsTransport struct {
+	baseURL   string
+	wsURL     string
+	keepAlive wsKeepAliveSettings
+}
 
-		}
-	}()
+func (transport *wsTransport) debugName() string {
+	return "WebSocket " + debugURLWithSocket(transport.wsURL, transport.baseURL)
+}
 
+func (transport *wsTransport) canSendMessages() bool {
+	return true
 }
 
-func startWriteEmptyMessageTickerHandler(ticker *time.Ticker, c *websocket.Conn, tickerClosedChan chan *time.Ticker) {
-
-	// Start a new goroutine to send an empty json string every 25 seconds
-	go func() {
-		t := "{}"
-
-		for {
-			select {
-			case <-ticker.C:
-				// On ticker (every 25 seconds), send an empty string to the socket
-				err := c.WriteMessage(websocket.TextMessage, []byte(t))
-				if err != nil {
-					utils.LogErrorErr("Unable to write empty WebSocket message", err)
-					return
-				}
-			case <-tickerClosedChan:
-				// If the ticker is closed, terminate the thread
-				return
-			}
+func (transport *wsTransport) connect(messageHandler func(message []byte, replier wsMessageReplier)) (pushSession, error) {
 
+	dialer := &websocket.Dialer{}
+	dialer.TLSClientConfig = &tls.Config{InsecureSkipVerify: true}
+	dialer.NetDial = utils.NewUnixSocketDialer(transport.baseURL) // nil (the default dialer) unless a unix URL
+
+	// The WebSocket URL has no userinfo (which the dialer rejects), so the credentials are sent as a header
+	c, _, err := dialer.Dial(transport.wsURL, utils.NewWebSocketHeader(transport.baseURL))
+	if err != nil {
+		if c != nil {
+			c.Close() // Unnecessary?
 		}
-	}()
+		return nil, err
+	}
 
+	return newWSSession(c, transport.keepAlive, messageHandler), nil
 }
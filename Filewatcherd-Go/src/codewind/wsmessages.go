@@ -0,0 +1,278 @@
+/*******************************************************************************
+* Copyright (c) 2020 IBM Corporation and others.
+* All rights reserved. This program and the accompanying materials
+* are made available under the terms of the Eclipse Public License v2.0
+* which accompanies this distribution, and is available at
+* http://www.eclipse.org/legal/epl-v20.html
+*
+* Contributors:
+*     IBM Corporation - initial API and implementation
+*******************************************************************************/
+
+package main
+
+import (
+	"codewind/models"
+	"codewind/utils"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+const (
+	wsMessageTypeDebug        = "debug"
+	wsMessageTypeWatchChanged = "watchChanged"
+
+	// Control commands from the server
+	wsMessageTypePauseProject     = "pauseProject"
+	wsMessageTypeResumeProject    = "resumeProject"
+	wsMessageTypeResyncProject    = "resyncProject"
+	wsMessageTypeSetLogLevel      = "setLogLevel"
+	wsMessageTypeRequestStateDump = "requestStateDump"
+
+	// Responses to the server
+	wsMessageTypeStateDump = "stateDump"
+)
+
+/** The fields common to every message received from the server on the WebSocket */
+type wsMessageEnvelope struct {
+	Type string `json:"type"`
+}
+
+/** A 'debug' message, which is sent only by automated tests */
+type wsDebugMessage struct {
+	Type string `json:"type"`
+	Msg  string `json:"msg"`
+}
+
+/** A control command that applies to a single project: pauseProject, resumeProject or resyncProject */
+type wsProjectCommandMessage struct {
+	Type      string `json:"type"`
+	ProjectID string `json:"projectID"`
+}
+
+/** A control command to change the log level (debug, info, error or severe) */
+type wsSetLogLevelMessage struct {
+	Type  string `json:"type"`
+	Level string `json:"level"`
+}
+
+/** A request for the internal state of the filewatcher; the requestId is returned in the response */
+type wsRequestStateDumpMessage struct {
+	Type      string `json:"type"`
+	RequestID string `json:"requestId"`
+}
+
+/** The response to a requestStateDump message */
+type wsStateDumpMessage struct {
+	Type      string `json:"type"`
+	RequestID string `json:"requestId"`
+	State     string `json:"state"`
+}
+
+/** Sends a message (which is converted to JSON) to the server, on the connection that a message was received from. */
+type wsMessageReplier interface {
+	SendMessage(message interface{}) error
+}
+
+/**
+ * Handles a single message of a specific type: the handler unmarshals the full message into its own type. Any
+ * response is sent with the replier.
+ */
+type wsMessageHandler func(message []byte, replier wsMessageReplier) error
+
+/**
+ * Routes each message received from the server to the handler registered for the message's 'type' field.
+ *
+ * Messages that are not JSON objects, or that have no handler for their type, are logged and ignored. A handler
+ * that fails (or panics) only affects the message it was handling.
+ */
+type wsMessageDispatcher struct {
+	handlers map[string] /* message type -> */ wsMessageHandler
+}
+
+func newWSMessageDispatcher() *wsMessageDispatcher {
+	return &wsMessageDispatcher{
+		handlers: make(map[string]wsMessageHandler),
+	}
+}
+
+/** Returns a dispatcher with handlers registered for all of the message types that the server sends. */
+func newDefaultWSMessageDispatcher(projectList *ProjectList, debugTimer *DebugTimer) *wsMessageDispatcher {
+
+	result := newWSMessageDispatcher()
+
+	result.Register(wsMessageTypeDebug, func(message []byte, replier wsMessageReplier) error {
+		return handleWSDebugMessage(message)
+	})
+
+	result.Register(wsMessageTypeWatchChanged, func(message []byte, replier wsMessageReplier) error {
+		return handleWSWatchChangedMessage(message, projectList)
+	})
+
+	result.Register(wsMessageTypePauseProject, func(message []byte, replier wsMessageReplier) error {
+		return handleWSProjectCommandMessage(message, func(projectID string) {
+			projectList.SetProjectPaused(projectID, true)
+		})
+	})
+
+	result.Register(wsMessageTypeResumeProject, func(message []byte, replier wsMessageReplier) error {
+		return handleWSProjectCommandMessage(message, func(projectID string) {
+			projectList.SetProjectPaused(projectID, false)
+		})
+	})
+
+	result.Register(wsMessageTypeResyncProject, func(message []byte, replier wsMessageReplier) error {
+		return handleWSProjectCommandMessage(message, projectList.ResyncProject)
+	})
+
+	result.Register(wsMessageTypeSetLogLevel, func(message []byte, replier wsMessageReplier) error {
+		return handleWSSetLogLevelMessage(message)
+	})
+
+	result.Register(wsMessageTypeRequestStateDump, func(message []byte, replier wsMessageReplier) error {
+		return handleWSRequestStateDumpMessage(message, debugTimer, replier)
+	})
+
+	return result
+}
+
+func (dispatcher *wsMessageDispatcher) Register(messageType string, handler wsMessageHandler) {
+	dispatcher.handlers[messageType] = handler
+}
+
+func (dispatcher *wsMessageDispatcher) Dispatch(message []byte, replier wsMessageReplier) {
+
+	defer func() {
+		if r := recover(); r != nil {
+			utils.LogSevere("Recovered from failure while handling WebSocket message: " + fmt.Sprint(r) + ", message: " + string(message))
+		}
+	}()
+
+	var envelope wsMessageEnvelope
+	if err := json.Unmarshal(message, &envelope); err != nil {
+		utils.LogSevereErr("Ignoring WebSocket message that is not a valid JSON object: "+string(message), err)
+		return
+	}
+
+	handler, exists := dispatcher.handlers[envelope.Type]
+	if !exists {
+		utils.LogError("Ignoring WebSocket message with unrecognized type '" + envelope.Type + "': " + string(message))
+		return
+	}
+
+	if err := handler(message, replier); err != nil {
+		utils.LogSevereErr("Unable to handle WebSocket message of type '"+envelope.Type+"': "+string(message), err)
+	}
+}
+
+func handleWSDebugMessage(message []byte) error {
+
+	var debugMessage wsDebugMessage
+	if err := json.Unmarshal(message, &debugMessage); err != nil {
+		return err
+	}
+
+	utils.LogInfo("------------------------------------------------------------")
+	utils.LogInfo("[Server-Debug] " + debugMessage.Msg)
+	utils.LogInfo("------------------------------------------------------------")
+
+	return nil
+}
+
+func handleWSWatchChangedMessage(message []byte, projectList *ProjectList) error {
+
+	var watchChangeJSON models.WatchChangeJson
+	if err := json.Unmarshal(message, &watchChangeJSON); err != nil {
+		return err
+	}
+
+	if watchChangeJSON.Projects == nil {
+		return errors.New("Watch change message has no projects")
+	}
+
+	utils.LogInfo("Received watch change message from WebSocket: " + string(message))
+
+	projectList.UpdateProjectListFromWebSocket(&watchChangeJSON)
+
+	projectUpdatesReceived := ""
+
+	for x := 0; x < len(watchChangeJSON.Projects); x++ {
+
+		entry := watchChangeJSON.Projects[x]
+		projectUpdatesReceived += "[" + entry.ProjectID + " in " + entry.PathToMonitor + "], "
+	}
+
+	// Trim whitespace and trailing comma
+	projectUpdatesReceived = strings.TrimSpace(projectUpdatesReceived)
+	if strings.HasSuffix(projectUpdatesReceived, ",") {
+		projectUpdatesReceived = projectUpdatesReceived[:len(projectUpdatesReceived)-1]
+	}
+
+	utils.LogInfo("Watch list change message received for { " + projectUpdatesReceived + " }")
+
+	return nil
+}
+
+func handleWSProjectCommandMessage(message []byte, command func(projectID string)) error {
+
+	var commandMessage wsProjectCommandMessage
+	if err := json.Unmarshal(message, &commandMessage); err != nil {
+		return err
+	}
+
+	if commandMessage.ProjectID == "" {
+		return errors.New("Project command message has no projectID")
+	}
+
+	utils.LogInfo("Received " + commandMessage.Type + " command for project " + commandMessage.ProjectID)
+
+	command(commandMessage.ProjectID)
+
+	return nil
+}
+
+func handleWSSetLogLevelMessage(message []byte) error {
+
+	var setLogLevelMessage wsSetLogLevelMessage
+	if err := json.Unmarshal(message, &setLogLevelMessage); err != nil {
+		return err
+	}
+
+	level, err := utils.ParseLogLevel(setLogLevelMessage.Level)
+	if err != nil {
+		return err
+	}
+
+	utils.LogInfo("Log level changed by server from " + utils.GetLogLevel().String() + " to " + level.String())
+	utils.SetLogLevel(level)
+
+	return nil
+}
+
+func handleWSRequestStateDumpMessage(message []byte, debugTimer *DebugTimer, replier wsMessageReplier) error {
+
+	var requestMessage wsRequestStateDumpMessage
+	if err := json.Unmarshal(message, &requestMessage); err != nil {
+		return err
+	}
+
+	utils.LogInfo("Received state dump request from server: " + requestMessage.RequestID)
+
+	// Collecting the state requires a response from each component, so do this on a separate goroutine, rather than
+	// blocking the reading of further messages.
+	go func() {
+		response := wsStateDumpMessage{
+			Type:      wsMessageTypeStateDump,
+			RequestID: requestMessage.RequestID,
+			State:     debugTimer.GenerateDebugState(),
+		}
+
+		if err := replier.SendMessage(response); err != nil {
+			utils.LogErrorErr("Unable to send state dump to server", err)
+		}
+	}()
+
+	return nil
+}
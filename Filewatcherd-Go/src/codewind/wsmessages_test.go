@@ -0,0 +1,217 @@
+/*******************************************************************************
+* Copyright (c) 2020 IBM Corporation and others.
+* All rights reserved. This program and the accompanying materials
+* are made available under the terms of the Eclipse Public License v2.0
+* which accompanies this distribution, and is available at
+* http://www.eclipse.org/legal/epl-v20.html
+*
+* Contributors:
+*     IBM Corporation - initial API and implementation
+*******************************************************************************/
+
+package main
+
+import (
+	"codewind/models"
+	"codewind/utils"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"testing"
+	"time"
+)
+
+/** A wsMessageReplier that discards every message */
+type discardReplier struct{}
+
+func (discardReplier) SendMessage(message interface{}) error { return nil }
+
+/**
+ * Dispatch arbitrary payloads with the default handlers: no handler may panic (which Dispatch would otherwise recover
+ * from and log), and only well-formed commands may reach the project list.
+ */
+func FuzzDispatch(f *testing.F) {
+
+	for _, seed := range []string{
+		``, `[]`, `"watchChanged"`, `null`, `0`, `-1.5e300`, `true`, `{}`, `{"type":null}`, `{"type":["debug"]}`,
+		`{"type":"unknown"}`, `{"type":"debug","msg":{}}`,
+		`{"type":"watchChanged"}`, `{"type":"watchChanged","projects":null}`, `{"type":"watchChanged","projects":{}}`,
+		`{"type":"watchChanged","projects":"p"}`, `{"type":"watchChanged","projects":1}`, `{"type":"watchChanged","projects":[null]}`,
+		`{"type":"watchChanged","projects":[{"projectID":1}]}`, `{"type":"watchChanged","projects":[{"projectID":"p","ignoredPaths":"x"}]}`,
+		`{"type":"pauseProject"}`, `{"type":"pauseProject","projectID":null}`, `{"type":"resumeProject","projectID":1}`,
+		`{"type":"resyncProject","projectID":"p"}`, `{"type":"setLogLevel","level":null}`, `{"type":"setLogLevel","level":"verbose"}`,
+		`{"type":"requestStateDump","requestId":[]}`, "{\"type\":\"debug\",\"msg\":\"\xff\"}",
+	} {
+		f.Add([]byte(seed))
+	}
+
+	originalLogLevel := utils.GetLogLevel()
+	f.Cleanup(func() {
+		utils.SetLogLevel(originalLogLevel)
+	})
+
+	// Each command sends at most one message to the project list, which is checked after each dispatch
+	projectList := &ProjectList{projectOperationChannel: make(chan *projectListChannelMessage, 1)}
+
+	f.Fuzz(func(t *testing.T, message []byte) {
+
+		dispatcher := newDefaultWSMessageDispatcher(projectList, nil)
+
+		// Collecting a state dump requires every component, so only the parsing of the request is exercised
+		dispatcher.Register(wsMessageTypeRequestStateDump, func(message []byte, replier wsMessageReplier) error {
+			var requestMessage wsRequestStateDumpMessage
+			return json.Unmarshal(message, &requestMessage)
+		})
+
+		// Wrap each handler, as Dispatch would otherwise recover from the panic
+		for messageType, handler := range dispatcher.handlers {
+			messageType, handler := messageType, handler
+			dispatcher.Register(messageType, func(message []byte, replier wsMessageReplier) error {
+				defer func() {
+					if r := recover(); r != nil {
+						t.Fatalf("Handler of '%s' panicked on %q: %s", messageType, message, fmt.Sprint(r))
+					}
+				}()
+				return handler(message, replier)
+			})
+		}
+
+		dispatcher.Dispatch(message, discardReplier{})
+
+		select {
+		case msg := <-projectList.projectOperationChannel:
+			switch msg.msgType {
+			case updateProjectListFromWebSocketMsg:
+				if msg.updateProjectListFromWebSocketMessage == nil || msg.updateProjectListFromWebSocketMessage.Projects == nil {
+					t.Fatalf("Watch change without projects was forwarded: %q", message)
+				}
+			case setProjectPausedMsg:
+				if msg.setProjectPausedMessage.projectID == "" {
+					t.Fatalf("Pause command without a project was forwarded: %q", message)
+				}
+			case resyncProjectMsg:
+				if msg.resyncProjectMessage == "" {
+					t.Fatalf("Resync command without a project was forwarded: %q", message)
+				}
+			default:
+				t.Fatalf("Unexpected project list message %d for %q", msg.msgType, message)
+			}
+		default:
+		}
+	})
+}
+
+/** Returns a watch service whose requests are discarded, so that no project directories are watched. */
+func newDiscardingWatchService(f *testing.F) *WatchService {
+
+	watchService := &WatchService{watchServiceChannel: make(chan *WatchServiceChannelMessage)}
+
+	go func() {
+		for range watchService.watchServiceChannel {
+		}
+	}()
+
+	f.Cleanup(func() {
+		close(watchService.watchServiceChannel)
+	})
+
+	return watchService
+}
+
+/** Returns the ids of the projects in the project list, once it has processed every preceding message. */
+func requestProjectIDs(projectList *ProjectList) map[string]bool {
+
+	result := make(map[string]bool)
+	for _, projectHealth := range <-projectList.RequestHealth() {
+		result[projectHealth.ProjectID] = true
+	}
+
+	return result
+}
+
+/**
+ * Dispatch arbitrary payloads to a real project list: no handler may panic (which would crash the project list's
+ * goroutine), and the projects of a watch change must be added and removed as the change describes. The project
+ * list is shared by every input, so the projects and paused projects of each input are removed before the next.
+ */
+func FuzzDispatchToProjectList(f *testing.F) {
+
+	for _, seed := range []string{
+		`{}`, `{"type":"watchChanged","projects":[]}`,
+		`{"type":"watchChanged","projects":[{"projectID":"p","pathToMonitor":"/p","projectWatchStateID":"1"}]}`,
+		`{"type":"watchChanged","projects":[{"projectID":"p","pathToMonitor":"/p"},{"projectID":"p","pathToMonitor":"/moved","projectWatchStateID":"2"}]}`,
+		`{"type":"watchChanged","projects":[{"projectID":"p","pathToMonitor":"/p"},{"projectID":"p","changeType":"delete"}]}`,
+		`{"type":"watchChanged","projects":[{"projectID":"p","changeType":"delete"},{"projectID":"","pathToMonitor":""}]}`,
+		`{"type":"watchChanged","projects":[{"projectID":"p","pathToMonitor":"/p","refPaths":[{"from":"/outside","to":"/inside"}]}]}`,
+		`{"type":"watchChanged","projects":[{"projectID":"p","pathToMonitor":"/p","ignoredPaths":["[","/a/**"],"ignoredFilenames":["\\"]}]}`,
+		`{"type":"pauseProject","projectID":"p"}`, `{"type":"resumeProject","projectID":"p"}`, `{"type":"resyncProject","projectID":"p"}`,
+	} {
+		f.Add([]byte(seed))
+	}
+
+	originalLogLevel := utils.GetLogLevel()
+	f.Cleanup(func() {
+		utils.SetLogLevel(originalLogLevel)
+	})
+
+	projectList := NewProjectList(nil, "", BatchPolicy{QuietPeriod: time.Second, DeliveryMode: DeliveryModeCwctl})
+	projectList.SetWatchService(newDiscardingWatchService(f))
+
+	f.Fuzz(func(t *testing.T, message []byte) {
+
+		dispatcher := newDefaultWSMessageDispatcher(projectList, nil)
+		dispatcher.Register(wsMessageTypeRequestStateDump, func(message []byte, replier wsMessageReplier) error {
+			return nil
+		})
+
+		// The ids of every project the input may have added or paused, and the projects it should have added
+		touchedProjectIDs := make(map[string]bool)
+		var expectedProjectIDs map[string]bool
+
+		var envelope wsMessageEnvelope
+		if json.Unmarshal(message, &envelope) == nil {
+			switch envelope.Type {
+			case wsMessageTypeWatchChanged:
+				var watchChange models.WatchChangeJson
+				if json.Unmarshal(message, &watchChange) == nil && watchChange.Projects != nil {
+					expectedProjectIDs = make(map[string]bool)
+					for _, project := range watchChange.Projects {
+						touchedProjectIDs[project.ProjectID] = true
+						if project.ChangeType == "delete" {
+							delete(expectedProjectIDs, project.ProjectID)
+						} else {
+							expectedProjectIDs[project.ProjectID] = true
+						}
+					}
+				}
+			case wsMessageTypePauseProject:
+				var command wsProjectCommandMessage
+				if json.Unmarshal(message, &command) == nil {
+					touchedProjectIDs[command.ProjectID] = true
+				}
+			}
+		}
+
+		dispatcher.Dispatch(message, discardReplier{})
+
+		if expectedProjectIDs != nil {
+			if actual := requestProjectIDs(projectList); !reflect.DeepEqual(actual, expectedProjectIDs) {
+				t.Fatalf("Projects after %q were %v, expected %v", message, actual, expectedProjectIDs)
+			}
+		}
+
+		// Remove the projects, then resume them, so that the project list is empty for the next input
+		removal := models.WatchlistEntries{}
+		for projectID := range touchedProjectIDs {
+			removal = append(removal, models.ProjectToWatch{ProjectID: projectID, ChangeType: "delete"})
+		}
+		projectList.UpdateProjectListFromWebSocket(&models.WatchChangeJson{Type: wsMessageTypeWatchChanged, Projects: removal})
+		for projectID := range touchedProjectIDs {
+			projectList.SetProjectPaused(projectID, false)
+		}
+
+		if debugMessage := <-projectList.RequestDebugMessage(); debugMessage != "" {
+			t.Fatalf("Project list was not empty after %q: %s", message, debugMessage)
+		}
+	})
+}
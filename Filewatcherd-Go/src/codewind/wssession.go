@@ -0,0 +1,167 @@
+/*******************************************************************************
+* Copyright (c) 2020 IBM Corporation and others.
+* All rights reserved. This program and the accompanying materials
+* are made available under the terms of the Eclipse Public License v2.0
+* which accompanies this distribution, and is available at
+* http://www.eclipse.org/legal/epl-v20.html
+*
+* Contributors:
+*     IBM Corporation - initial API and implementation
+*******************************************************************************/
+
+package main
+
+import (
+	"codewind/utils"
+	"encoding/json"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+/**
+ * A single connected WebSocket, and the goroutines that use it:
+ * - A single reader goroutine, which passes each received message to the message handler.
+ * - A single writer goroutine, which writes queued messages and pings; gorilla connections support at most one
+ *   concurrent writer, so all writes go through this goroutine.
+ *
+ * When either goroutine fails (or Close is called), the session is closed exactly once: the connection is closed,
+ * both goroutines exit, and the channel returned by Done() is closed. A closed session is never reused; a new session
+ * is created on reconnect.
+ */
+type wsSession struct {
+	conn      *websocket.Conn
+	keepAlive wsKeepAliveSettings
+
+	messageHandler func(message []byte, replier wsMessageReplier)
+
+	writeChannel chan *wsOutgoingMessage
+
+	closed    chan struct{}
+	closeOnce sync.Once
+
+	/** The reason the session was closed; only read after 'closed' is closed */
+	closeReason string
+}
+
+type wsOutgoingMessage struct {
+	messageType int
+	data        []byte
+}
+
+const (
+	// How long a single write to the WebSocket may take, before the connection is considered dead
+	wsWriteTimeout = 10 * time.Second
+)
+
+func newWSSession(conn *websocket.Conn, keepAlive wsKeepAliveSettings, messageHandler func(message []byte, replier wsMessageReplier)) *wsSession {
+
+	return &wsSession{
+		conn:           conn,
+		keepAlive:      keepAlive,
+		messageHandler: messageHandler,
+		writeChannel:   make(chan *wsOutgoingMessage, 16),
+		closed:         make(chan struct{}),
+	}
+}
+
+/** Start the reader and writer goroutines. */
+func (session *wsSession) Start() {
+
+	// If nothing (including a pong) is received from the server within the timeout, the read will fail
+	session.conn.SetReadDeadline(time.Now().Add(session.keepAlive.pongTimeout))
+	session.conn.SetPongHandler(func(string) error {
+		return session.conn.SetReadDeadline(time.Now().Add(session.keepAlive.pongTimeout))
+	})
+
+	go session.readLoop()
+	go session.writeLoop()
+}
+
+/** Returns a channel that is closed once the session has closed. */
+func (session *wsSession) Done() <-chan struct{} {
+	return session.closed
+}
+
+/** Queue a message to be written by the writer goroutine; returns an error if the session is closed. */
+func (session *wsSession) Send(messageType int, data []byte) error {
+
+	select {
+	case session.writeChannel <- &wsOutgoingMessage{messageType, data}:
+		return nil
+	case <-session.closed:
+		return errors.New("WebSocket session is closed")
+	}
+}
+
+/** Queue a message, converted to JSON, to be written as a text message; implements wsMessageReplier. */
+func (session *wsSession) SendMessage(message interface{}) error {
+
+	data, err := json.Marshal(message)
+	if err != nil {
+		return err
+	}
+
+	return session.Send(websocket.TextMessage, data)
+}
+
+/** Close the session, if it is not already closed; this may be called from any goroutine, any number of times. */
+func (session *wsSession) Close(reason string) {
+
+	session.closeOnce.Do(func() {
+		utils.LogInfo("Closing WebSocket session: " + reason)
+		session.closeReason = reason
+		close(session.closed)
+		session.conn.Close()
+	})
+}
+
+func (session *wsSession) CloseReason() string {
+	return session.closeReason
+}
+
+func (session *wsSession) readLoop() {
+
+	for {
+		_, message, err := session.conn.ReadMessage()
+		if err != nil {
+			session.Close("Read error: " + err.Error())
+			return
+		}
+
+		// Any message from the server shows that the connection is still alive
+		session.conn.SetReadDeadline(time.Now().Add(session.keepAlive.pongTimeout))
+
+		session.messageHandler(message, session)
+	}
+}
+
+func (session *wsSession) writeLoop() {
+
+	ticker := time.NewTicker(session.keepAlive.pingInterval)
+	defer ticker.Stop()
+
+	for {
+		var err error
+
+		select {
+		case msg := <-session.writeChannel:
+			session.conn.SetWriteDeadline(time.Now().Add(wsWriteTimeout))
+			err = session.conn.WriteMessage(msg.messageType, msg.data)
+
+		case <-ticker.C:
+			session.conn.SetWriteDeadline(time.Now().Add(wsWriteTimeout))
+			err = session.conn.WriteMessage(websocket.PingMessage, nil)
+
+		case <-session.closed:
+			return
+		}
+
+		if err != nil {
+			session.Close("Write error: " + err.Error())
+			return
+		}
+	}
+}
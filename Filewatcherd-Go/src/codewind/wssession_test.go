@@ -0,0 +1,145 @@
+/*******************************************************************************
+* Copyright (c) 2020 IBM Corporation and others.
+* All rights reserved. This program and the accompanying materials
+* are made available under the terms of the Eclipse Public License v2.0
+* which accompanies this distribution, and is available at
+* http://www.eclipse.org/legal/epl-v20.html
+*
+* Contributors:
+*     IBM Corporation - initial API and implementation
+*******************************************************************************/
+
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+/**
+ * Start a WebSocket server that sends a single message on each connection, then closes the connection (as a
+ * restarting server would) once 'restart' is closed.
+ */
+func newRestartingWSTestServer(t *testing.T, restart chan struct{}) *httptest.Server {
+
+	upgrader := websocket.Upgrader{}
+
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			t.Errorf("Unable to upgrade connection: %v", err)
+			return
+		}
+		defer conn.Close()
+
+		if err := conn.WriteMessage(websocket.TextMessage, []byte(`{"type":"hello"}`)); err != nil {
+			t.Errorf("Unable to write message: %v", err)
+			return
+		}
+
+		<-restart
+	}))
+}
+
+func TestWSSessionsDoNotLeakGoroutinesAcrossServerRestarts(t *testing.T) {
+
+	const restarts = 20
+
+	keepAlive := wsKeepAliveSettings{pingInterval: 50 * time.Millisecond, pongTimeout: time.Second}
+
+	connectAndRestart := func() {
+		t.Helper()
+
+		restart := make(chan struct{})
+		server := newRestartingWSTestServer(t, restart)
+
+		received := make(chan []byte, 1)
+
+		transport := &wsTransport{
+			baseURL:   server.URL,
+			wsURL:     "ws" + strings.TrimPrefix(server.URL, "http"),
+			keepAlive: keepAlive,
+		}
+
+		session, err := transport.connect(func(message []byte, replier wsMessageReplier) {
+			received <- message
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		session.Start()
+
+		select {
+		case <-received:
+		case <-time.After(10 * time.Second):
+			t.Fatal("Timed out waiting for a message")
+		}
+
+		close(restart)
+		server.Close()
+
+		select {
+		case <-session.Done():
+		case <-time.After(10 * time.Second):
+			t.Fatal("Timed out waiting for the session to close after the server restarted")
+		}
+	}
+
+	// Connect and disconnect once first, so that goroutines started on first use (by net/http) are not counted
+	connectAndRestart()
+
+	baseline := waitForStableGoroutineCount()
+
+	for index := 0; index < restarts; index++ {
+		connectAndRestart()
+	}
+
+	// A leak of even one goroutine per session would exceed the tolerance
+	if count := waitForGoroutineCount(baseline + restarts/4); count > baseline+restarts/4 {
+		buf := make([]byte, 1<<20)
+		t.Fatalf("Goroutine count grew from %d to %d after %d server restarts:\n%s", baseline, count, restarts, buf[:runtime.Stack(buf, true)])
+	}
+}
+
+/**
+ * Wait (for up to 5 seconds) for the number of goroutines to fall to at most 'max', as closed connections may take
+ * some time to wind down (eg the HTTP client drains a closed response body for up to 50ms), then return the number.
+ */
+func waitForGoroutineCount(max int) int {
+
+	deadline := time.Now().Add(5 * time.Second)
+
+	count := runtime.NumGoroutine()
+	for count > max && time.Now().Before(deadline) {
+		time.Sleep(20 * time.Millisecond)
+		count = runtime.NumGoroutine()
+	}
+
+	return count
+}
+
+/** Wait for exited goroutines to be cleaned up, then return the number of goroutines. */
+func waitForStableGoroutineCount() int {
+
+	count := runtime.NumGoroutine()
+
+	for attempt := 0; attempt < 50; attempt++ {
+		time.Sleep(20 * time.Millisecond)
+
+		next := runtime.NumGoroutine()
+		if next == count {
+			return count
+		}
+		count = next
+	}
+
+	return count
+}
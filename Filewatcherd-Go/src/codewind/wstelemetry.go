@@ -0,0 +1,117 @@
+/*******************************************************************************
+* Copyright (c) 2020 IBM Corporation and others.
+* All rights reserved. This program and the accompanying materials
+* are made available under the terms of the Eclipse Public License v2.0
+* which accompanies this distribution, and is available at
+* http://www.eclipse.org/legal/epl-v20.html
+*
+* Contributors:
+*     IBM Corporation - initial API and implementation
+*******************************************************************************/
+
+package main
+
+import (
+	"codewind/utils"
+	"time"
+)
+
+/**
+ * Health reports are (optionally) sent by the filewatcher to the server, on the WebSocket, every X seconds, so that
+ * the server can display the health of the filewatcher without scraping its logs. The report is built from the same
+ * components that are queried by the DebugTimer.
+ *
+ * Health reports are disabled unless the FILEWATCHER_TELEMETRY_INTERVAL_MS environment variable is greater than 0.
+ */
+
+const (
+	wsMessageTypeHealthReport = "healthReport"
+
+	// The watch status of a project in a health report
+	projectWatchStatusWatching   = "watching"   // The project directory exists, and is being watched
+	projectWatchStatusWaiting    = "waiting"    // Waiting for the project directory to exist
+	projectWatchStatusNotWatched = "notWatched" // Not watched by the watch service (eg individual file watches only)
+)
+
+/** A periodic health report, sent from the filewatcher to the server */
+type wsHealthReportMessage struct {
+	Type        string               `json:"type"`
+	Timestamp   int64                `json:"timestamp"`
+	Projects    []*projectHealthJSON `json:"projects"`
+	PostQueue   *postQueueHealthJSON `json:"postQueue"`
+	ErrorCount  int64                `json:"errorCount"`
+	SevereCount int64                `json:"severeCount"`
+}
+
+type projectHealthJSON struct {
+	ProjectID          string           `json:"projectID"`
+	WatchStatus        string           `json:"watchStatus"`
+	WatchedDirectories int              `json:"watchedDirectories"`
+	PendingBatchSize   int              `json:"pendingBatchSize"`
+	Paused             bool             `json:"paused"`
+	LastCwctlResult    *cwctlResultJSON `json:"lastCwctlResult,omitempty"`
+}
+
+/** The result of the most recent cwctl project sync command of a project */
+type cwctlResultJSON struct {
+	ExitCode  int   `json:"exitCode"`
+	SpawnTime int64 `json:"spawnTime"`
+}
+
+type postQueueHealthJSON struct {
+	ChunkGroups     int   `json:"chunkGroups"`
+	ActiveWorkers   int   `json:"activeWorkers"`
+	InFlightBytes   int64 `json:"inFlightBytes"`
+	DeadLettered    int   `json:"deadLettered"`
+	FailingProjects int   `json:"failingProjects"`
+}
+
+/** Returns the health report interval, from FILEWATCHER_TELEMETRY_INTERVAL_MS, or 0 if health reports are disabled. */
+func getTelemetryInterval() time.Duration {
+
+	interval := time.Duration(utils.GetEnvInt64("FILEWATCHER_TELEMETRY_INTERVAL_MS", 0)) * time.Millisecond
+	if interval < 0 {
+		return 0
+	}
+
+	return interval
+}
+
+/**
+ * Start sending health reports on the (started) session, if health reports are enabled (the interval is greater than
+ * 0) and the transport can send messages. Returns true if health reports were started.
+ */
+func startHealthReports(session pushSession, transport pushTransport, debugTimer *DebugTimer, interval time.Duration) bool {
+
+	if interval <= 0 {
+		return false
+	}
+
+	if !transport.canSendMessages() {
+		utils.LogInfo("Health reports are not sent on " + transport.debugName())
+		return false
+	}
+
+	go sendHealthReports(session, debugTimer, interval)
+
+	return true
+}
+
+/** Send a health report every interval, until the session closes; this should be called on a new goroutine. */
+func sendHealthReports(session pushSession, debugTimer *DebugTimer, interval time.Duration) {
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			if err := session.SendMessage(debugTimer.CollectHealthReport()); err != nil {
+				utils.LogErrorErr("Unable to send health report to server", err)
+			}
+
+		case <-session.Done():
+			return
+		}
+	}
+}
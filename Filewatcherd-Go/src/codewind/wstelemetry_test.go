@@ -0,0 +1,174 @@
+/*******************************************************************************
+* Copyright (c) 2020 IBM Corporation and others.
+* All rights reserved. This program and the accompanying materials
+* are made available under the terms of the Eclipse Public License v2.0
+* which accompanies this distribution, and is available at
+* http://www.eclipse.org/legal/epl-v20.html
+*
+* Contributors:
+*     IBM Corporation - initial API and implementation
+*******************************************************************************/
+
+package main
+
+import (
+	"codewind/utils"
+	"sync"
+	"testing"
+	"time"
+)
+
+/** A push transport whose sessions are telemetryTestSessions; it never connects to a server. */
+type telemetryTestTransport struct {
+	canSend bool
+}
+
+func (transport *telemetryTestTransport) debugName() string {
+	return "test transport"
+}
+
+func (transport *telemetryTestTransport) connect(messageHandler func(message []byte, replier wsMessageReplier)) (pushSession, error) {
+	return newTelemetryTestSession(), nil
+}
+
+func (transport *telemetryTestTransport) canSendMessages() bool {
+	return transport.canSend
+}
+
+/** A push session that passes each message sent to the server to the 'sent' channel. */
+type telemetryTestSession struct {
+	sent      chan interface{}
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+func newTelemetryTestSession() *telemetryTestSession {
+	return &telemetryTestSession{
+		sent: make(chan interface{}, 100),
+		done: make(chan struct{}),
+	}
+}
+
+func (session *telemetryTestSession) SendMessage(message interface{}) error {
+	session.sent <- message
+	return nil
+}
+
+func (session *telemetryTestSession) Start() {}
+
+func (session *telemetryTestSession) Done() <-chan struct{} {
+	return session.done
+}
+
+func (session *telemetryTestSession) Close(reason string) {
+	session.closeOnce.Do(func() { close(session.done) })
+}
+
+func (session *telemetryTestSession) CloseReason() string {
+	return "closed by test"
+}
+
+/** Returns a debug timer of real (idle) components, that communicate with a test server. */
+func newTelemetryTestDebugTimer(t *testing.T) *DebugTimer {
+
+	server := newPostTestServer(t, nil, nil)
+	queue := newTestPostOutputQueue(t, server, 1)
+	projectList := NewProjectList(queue, "", BatchPolicy{QuietPeriod: time.Second, DeliveryMode: DeliveryModePost})
+	watchService := NewWatchService(projectList, server.URL, "test-client-uuid", NewSharedWatcherPool())
+	projectList.SetWatchService(watchService)
+
+	return NewDebugTimer(server.URL, watchService, projectList, queue)
+}
+
+func TestGetTelemetryInterval(t *testing.T) {
+
+	tests := []struct {
+		value    string
+		expected time.Duration
+	}{
+		{"", 0},
+		{"0", 0},
+		{"-1000", 0},
+		{"not a number", 0},
+		{"1500", 1500 * time.Millisecond},
+	}
+
+	for _, test := range tests {
+		t.Setenv("FILEWATCHER_TELEMETRY_INTERVAL_MS", test.value)
+
+		if actual := getTelemetryInterval(); actual != test.expected {
+			t.Errorf("getTelemetryInterval() with %q = %v, expected %v", test.value, actual, test.expected)
+		}
+	}
+}
+
+func TestHealthReportsAreOnlySentWhenEnabled(t *testing.T) {
+
+	debugTimer := newTelemetryTestDebugTimer(t)
+
+	tests := []struct {
+		name     string
+		interval string
+		canSend  bool
+		expected bool
+	}{
+		{"disabled", "0", true, false},
+		{"negative interval", "-50", true, false},
+		{"enabled", "50", true, true},
+		{"receive-only transport", "50", false, false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			t.Setenv("FILEWATCHER_TELEMETRY_INTERVAL_MS", test.interval)
+
+			transport := &telemetryTestTransport{canSend: test.canSend}
+			pushSession, err := transport.connect(nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			session := pushSession.(*telemetryTestSession)
+			defer session.Close("test complete")
+
+			if started := startHealthReports(session, transport, debugTimer, getTelemetryInterval()); started != test.expected {
+				t.Fatalf("startHealthReports() = %v, expected %v", started, test.expected)
+			}
+
+			select {
+			case message := <-session.sent:
+				if !test.expected {
+					t.Fatalf("Unexpected message: %+v", message)
+				}
+				if report, ok := message.(*wsHealthReportMessage); !ok || report.Type != wsMessageTypeHealthReport {
+					t.Fatalf("Unexpected message: %+v", message)
+				}
+			case <-time.After(500 * time.Millisecond):
+				if test.expected {
+					t.Fatal("Timed out waiting for a health report")
+				}
+			}
+		})
+	}
+}
+
+func TestHealthReportIncludesErrorCounts(t *testing.T) {
+
+	debugTimer := newTelemetryTestDebugTimer(t)
+
+	before := debugTimer.CollectHealthReport()
+
+	utils.LogError("Test error")
+	utils.LogSevere("Test severe error")
+
+	after := debugTimer.CollectHealthReport()
+
+	// Other goroutines may also log errors, so the counts may increase by more than one
+	if after.ErrorCount < before.ErrorCount+1 || after.SevereCount < before.SevereCount+1 {
+		t.Fatalf("Error counts did not increase: before %d/%d, after %d/%d", before.ErrorCount, before.SevereCount,
+			after.ErrorCount, after.SevereCount)
+	}
+
+	if after.PostQueue == nil || after.Projects == nil {
+		t.Fatalf("Incomplete health report: %+v", after)
+	}
+}